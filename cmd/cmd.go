@@ -1,14 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 
 	"github.com/urfave/cli/v2"
 )
 
 func Execute() {
-	if err := NewApp().Run(os.Args); err != nil {
+	// Cancel on interrupt so the debugger is detached and temp dirs are removed.
+	// Once cancelled, the default handling is restored so a second interrupt
+	// kills the process if cleanup hangs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err := NewApp().RunContext(ctx, os.Args)
+	stop()
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -17,6 +29,10 @@ func NewApp() *cli.App {
 	return &cli.App{
 		Commands: []*cli.Command{
 			traceCmd(),
+			tuiCmd(),
+			traceServeCmd(),
+			traceDiffCmd(),
+			listWorkflowsCmd(),
 		},
 	}
 }
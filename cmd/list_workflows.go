@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/urfave/cli/v2"
+)
+
+func listWorkflowsCmd() *cli.Command {
+	var config tracer.WorkflowFuncsConfig
+	var buildTags cli.StringSlice
+	var asJSON bool
+	return &cli.Command{
+		Name:      "list-workflows",
+		Usage:     "List the workflow functions that can be given to 'trace --fn'",
+		ArgsUsage: "[PACKAGE_PATTERN...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "root",
+				Usage:       "Root directory of the module containing the packages",
+				Value:       ".",
+				Destination: &config.RootDir,
+			},
+			&cli.StringFlag{
+				Name:        "go",
+				Usage:       "Go binary to list the packages with (default is go on the PATH)",
+				Destination: &config.GoBinary,
+			},
+			&cli.StringSliceFlag{
+				Name:        "tag",
+				Usage:       "Build tag for listing the packages",
+				Destination: &buildTags,
+			},
+			&cli.BoolFlag{
+				Name:        "json",
+				Usage:       "Output as JSON",
+				Destination: &asJSON,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			patterns := ctx.Args().Slice()
+			if len(patterns) == 0 {
+				patterns = []string{"./..."}
+			}
+			config.BuildTags = buildTags.Value()
+			infos, err := tracer.FindWorkflowFuncs(ctx.Context, config, patterns...)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				if infos == nil {
+					infos = []*tracer.WorkflowFuncInfo{}
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(infos)
+			}
+			absRoot, _ := filepath.Abs(config.RootDir)
+			for _, info := range infos {
+				file := info.File
+				if rel, err := filepath.Rel(absRoot, file); err == nil && !strings.HasPrefix(rel, "..") {
+					file = rel
+				}
+				fmt.Printf("%v (%v:%v)\n", info.Name, file, info.Line)
+			}
+			return nil
+		},
+	}
+}
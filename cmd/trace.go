@@ -1,14 +1,24 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/cretz/temporal-debug-go/tracer/tui"
+	"github.com/mattn/go-isatty"
 	"github.com/urfave/cli/v2"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/workflow"
@@ -27,20 +37,80 @@ func traceCmd() *cli.Command {
 }
 
 type TraceConfig struct {
-	Address         string
-	Namespace       string
-	WorkflowID      string
-	RunID           string
-	HistoryFile     string
-	Func            string
-	OutputStdout    bool
-	OutputJSONFile  string
-	OutputHTMLDir   string
-	OutputHTMLTheme string
-	RootDir         string
-	RetainTempDir   bool
-	ExcludeFuncs    cli.StringSlice
-	ExcludeFiles    cli.StringSlice
+	Address                 string
+	Namespace               string
+	TLSCertFile             string
+	TLSKeyFile              string
+	TLSCACertFile           string
+	TLSServerName           string
+	APIKey                  string
+	DataConverterExpr       string
+	DelveBackend            string
+	WorkflowID              string
+	RunID                   string
+	HistoryFile             string
+	HistoryFormat           string
+	Func                    cli.StringSlice
+	OutputStdout            bool
+	OutputNDJSON            bool
+	OutputTUI               bool
+	NoColor                 bool
+	Progress                bool
+	DivergenceOnly          bool
+	OutputJSONFile          string
+	OutputCSVFile           string
+	OutputMarkdownFile      string
+	OutputDOTFile           string
+	OutputHTMLDir           string
+	OutputHTMLSingle        string
+	OutputHTMLTheme         string
+	HTMLContextLines        int
+	HTMLStyle               string
+	HTMLMDXOnly             bool
+	HTMLProjectDir          string
+	PostURL                 string
+	PostAuthorization       string
+	RootDir                 string
+	RetainTempDir           bool
+	ExeName                 string
+	SourceCacheMaxBytes     int
+	ExcludeFuncs            cli.StringSlice
+	ExcludeFiles            cli.StringSlice
+	IncludeFuncs            cli.StringSlice
+	IncludeFiles            cli.StringSlice
+	Coroutine               cli.StringSlice
+	SampleRate              int
+	CaptureLocals           bool
+	CaptureLocalsPkgs       cli.StringSlice
+	CaptureStack            bool
+	StackDepth              int
+	Notes                   cli.StringSlice
+	FuzzRuns                int
+	Check                   bool
+	BuildCacheDir           string
+	BreakAt                 string
+	BreakCount              int
+	TraceTimeout            time.Duration
+	MaxSteps                int
+	IncludeTemporalInternal bool
+	ExcludeDirs             cli.StringSlice
+	GoBinary                string
+	BuildFlags              cli.StringSlice
+	BuildTags               cli.StringSlice
+	PrebuiltExe             string
+	ReplayerFetchesHistory  bool
+	KeepDuplicateLines      bool
+	ReplayerOptionsExpr     string
+	KeepDeadlockDetection   bool
+	FromEvent               int64
+	ToEvent                 int64
+	ReplayUntilEvent        int64
+	WorkflowType            string
+	LogLevel                string
+	Quiet                   bool
+	LogJSON                 bool
+	StreamJSON              bool
+	Open                    bool
 }
 
 func (t *TraceConfig) flags() []cli.Flag {
@@ -59,6 +129,48 @@ func (t *TraceConfig) flags() []cli.Flag {
 			Value:       client.DefaultNamespace,
 			Destination: &t.Namespace,
 		},
+		&cli.StringFlag{
+			Name:        "tls_cert",
+			Usage:       "TLS client cert file, requires tls_key",
+			Destination: &t.TLSCertFile,
+		},
+		&cli.StringFlag{
+			Name:        "tls_key",
+			Usage:       "TLS client key file, requires tls_cert",
+			Destination: &t.TLSKeyFile,
+		},
+		&cli.StringFlag{
+			Name:        "tls_ca_cert",
+			Usage:       "TLS CA cert file for verifying the server",
+			Destination: &t.TLSCACertFile,
+		},
+		&cli.StringFlag{
+			Name:        "tls_server_name",
+			Usage:       "TLS server name override",
+			Destination: &t.TLSServerName,
+		},
+		&cli.StringFlag{
+			Name:        "api_key",
+			Usage:       "API key to authenticate with, enables TLS",
+			EnvVars:     []string{tracer.APIKeyEnvVar},
+			Destination: &t.APIKey,
+		},
+		&cli.StringFlag{
+			Name:        "data_converter",
+			Usage:       "Go expression for the data converter, qualified with package, e.g. 'mydomain.com/pkg/path.NewConverter()'",
+			Destination: &t.DataConverterExpr,
+		},
+		&cli.StringFlag{
+			Name:        "replayer_options",
+			Usage:       "Go expression for the worker.WorkflowReplayerOptions, qualified with package, e.g. 'mydomain.com/pkg/path.ReplayerOptions()'",
+			Destination: &t.ReplayerOptionsExpr,
+		},
+		&cli.StringFlag{
+			Name:        "backend",
+			Usage:       "Delve backend, one of: " + strings.Join(tracer.DelveBackends, ", "),
+			Value:       "default",
+			Destination: &t.DelveBackend,
+		},
 		&cli.StringFlag{
 			Name:        "workflow_id",
 			Aliases:     []string{"wid", "w"},
@@ -74,38 +186,151 @@ func (t *TraceConfig) flags() []cli.Flag {
 		&cli.StringFlag{
 			Name:        "history",
 			Aliases:     []string{"hist"},
-			Usage:       "History file, required if workflow ID not set",
+			Usage:       "History JSON or binary protobuf file, optionally gzipped, or \"-\" for stdin. Required if workflow ID not set, cannot be used with workflow ID",
 			Destination: &t.HistoryFile,
 		},
-		// TODO(cretz): Support multiple workflow functions
 		&cli.StringFlag{
+			Name:        "history_format",
+			Usage:       "Format of the history file: auto, json, or proto",
+			Value:       "auto",
+			Destination: &t.HistoryFormat,
+		},
+		&cli.StringSliceFlag{
 			Name:        "func",
 			Aliases:     []string{"fn"},
-			Usage:       "Workflow function, qualified with package up to last dot. In case of struct-based workflow function a simplified version of fqdn is used: '.../package.Struct.Function' is used",
+			Usage:       "Workflow function, qualified with package up to last dot, or a package relative to the root dir's module like './pkg/workflows.MyWorkflow'. For methods, use '.../package.(*Struct).Method' for pointer receivers or '.../package.(Struct).Method' for value receivers ('.../package.Struct.Method' is treated as a pointer receiver). Can be given multiple times",
 			Required:    true,
 			Destination: &t.Func,
 		},
+		&cli.StringFlag{
+			Name:        "workflow_type",
+			Usage:       "Workflow type name the function was registered with, if not the function name. Requires a single --func",
+			Destination: &t.WorkflowType,
+		},
 		&cli.BoolFlag{
 			Name:        "stdout",
 			Usage:       "Dump trace to stdout (default true if no other output)",
 			Destination: &t.OutputStdout,
 		},
+		&cli.BoolFlag{
+			Name:        "ndjson",
+			Usage:       "Stream each event to stdout as a line of JSON as it is recorded",
+			Destination: &t.OutputNDJSON,
+		},
+		&cli.BoolFlag{
+			Name:        "progress",
+			Usage:       "Show a progress line on stderr while tracing",
+			Destination: &t.Progress,
+		},
+		&cli.StringFlag{
+			Name:        "log_level",
+			Usage:       "Minimum level of logs on stderr, one of: " + strings.Join(tracer.LogLevels, ", "),
+			Value:       "debug",
+			Destination: &t.LogLevel,
+		},
+		&cli.BoolFlag{
+			Name:        "quiet",
+			Usage:       "Only log errors, same as --log_level error",
+			Destination: &t.Quiet,
+		},
+		&cli.BoolFlag{
+			Name:        "log_json",
+			Usage:       "Write logs on stderr as lines of JSON with level, msg, and the key/values",
+			Destination: &t.LogJSON,
+		},
+		&cli.BoolFlag{
+			Name:        "tui",
+			Usage:       "Browse the trace interactively in the terminal once complete",
+			Destination: &t.OutputTUI,
+		},
+		&cli.BoolFlag{
+			Name:        "no_color",
+			Usage:       "Disable colors in stdout output, also disabled if not a terminal or NO_COLOR is set",
+			Destination: &t.NoColor,
+		},
+		&cli.BoolFlag{
+			Name:        "divergence_only",
+			Usage:       "If the replay fails, only dump the final workflow task of the trace to stdout along with the expected vs actual commands",
+			Destination: &t.DivergenceOnly,
+		},
 		&cli.StringFlag{
 			Name:        "json",
 			Usage:       "File to output JSON trace to",
 			Destination: &t.OutputJSONFile,
 		},
+		&cli.BoolFlag{
+			Name:        "stream_json",
+			Usage:       "Write events to the JSON file as they are recorded instead of the whole result at the end",
+			Destination: &t.StreamJSON,
+		},
+		&cli.StringFlag{
+			Name:        "csv",
+			Usage:       "File to output CSV trace to",
+			Destination: &t.OutputCSVFile,
+		},
+		&cli.StringFlag{
+			Name:        "markdown",
+			Usage:       "File to output Markdown trace to",
+			Destination: &t.OutputMarkdownFile,
+		},
+		&cli.StringFlag{
+			Name:        "dot",
+			Usage:       "File to output a Graphviz DOT graph of coroutine flow to",
+			Destination: &t.OutputDOTFile,
+		},
 		&cli.StringFlag{
 			Name:        "html",
 			Usage:       "Directory to output HTML to",
 			Destination: &t.OutputHTMLDir,
 		},
+		&cli.StringFlag{
+			Name:        "html_single",
+			Usage:       "File to output a single self-contained HTML document to, with source inlined",
+			Destination: &t.OutputHTMLSingle,
+		},
 		&cli.StringFlag{
 			Name:        "html_theme",
 			Usage:       "HTML theme to use. Either 'simple-linear' (default) or 'annotated'",
 			Value:       "simple-linear",
 			Destination: &t.OutputHTMLTheme,
 		},
+		&cli.IntFlag{
+			Name:        "html_context_lines",
+			Usage:       "Lines of source to show before and after each code step in the simple-linear HTML theme, negative for none",
+			Value:       2,
+			Destination: &t.HTMLContextLines,
+		},
+		&cli.StringFlag{
+			Name:        "html_style",
+			Usage:       "Chroma style for source in the simple-linear HTML theme, e.g. 'monokai' (default is 'github', or 'monokai' for browsers preferring dark mode)",
+			Destination: &t.HTMLStyle,
+		},
+		&cli.BoolFlag{
+			Name:        "html_mdx_only",
+			Usage:       "For the annotated HTML theme, only write trace.mdx to the HTML dir instead of building with Node",
+			Destination: &t.HTMLMDXOnly,
+		},
+		&cli.StringFlag{
+			Name:        "html_project_dir",
+			Usage:       "For the annotated HTML theme, Next project dir to build in (default is an embedded project extracted to the user cache dir)",
+			Destination: &t.HTMLProjectDir,
+		},
+		&cli.BoolFlag{
+			Name:        "open",
+			Usage:       "Open the HTML output in the default browser once written",
+			Destination: &t.Open,
+		},
+		&cli.StringFlag{
+			Name:        "post_url",
+			Usage:       "URL to POST the JSON trace to after a successful trace",
+			Destination: &t.PostURL,
+		},
+		&cli.StringFlag{
+			Name:        "post_auth",
+			Usage:       "Authorization header value to use with post_url",
+			EnvVars:     []string{"TEMPORAL_DEBUG_POST_AUTH"},
+			Destination: &t.PostAuthorization,
+		},
 		&cli.StringFlag{
 			Name:        "root",
 			Usage:       "Root directory of the module containing the package for the workflow",
@@ -117,6 +342,16 @@ func (t *TraceConfig) flags() []cli.Flag {
 			Usage:       "Retain the temporary directory created for running",
 			Destination: &t.RetainTempDir,
 		},
+		&cli.StringFlag{
+			Name:        "exe_name",
+			Usage:       "Name of the built replay binary (default is the unique temp dir name)",
+			Destination: &t.ExeName,
+		},
+		&cli.IntFlag{
+			Name:        "source_cache_max_bytes",
+			Usage:       "Maximum bytes of source files to keep in memory while tracing and writing output (default is unlimited)",
+			Destination: &t.SourceCacheMaxBytes,
+		},
 		&cli.StringSliceFlag{
 			Name:        "exclude_func",
 			Usage:       "Regex patterns for functions to not step through",
@@ -127,19 +362,201 @@ func (t *TraceConfig) flags() []cli.Flag {
 			Usage:       "Regex patterns for files to not step through",
 			Destination: &t.ExcludeFiles,
 		},
+		&cli.StringSliceFlag{
+			Name:        "exclude_dir",
+			Usage:       "Dirs whose files are not stepped through like GOROOT, e.g. a vendor dir",
+			Destination: &t.ExcludeDirs,
+		},
+		&cli.BoolFlag{
+			Name:        "include_temporal_internal",
+			Usage:       "Step through and record Temporal SDK code instead of stepping out of it (very slow)",
+			Destination: &t.IncludeTemporalInternal,
+		},
+		&cli.StringSliceFlag{
+			Name:        "include_func",
+			Usage:       "Regex patterns for functions to record, if any include pattern is set other code is not recorded",
+			Destination: &t.IncludeFuncs,
+		},
+		&cli.StringSliceFlag{
+			Name:        "include_file",
+			Usage:       "Regex patterns for files to record, if any include pattern is set other code is not recorded",
+			Destination: &t.IncludeFiles,
+		},
+		&cli.StringSliceFlag{
+			Name:        "coroutine",
+			Usage:       "Only record code of coroutines with this name, e.g. 'root' or a workflow.GoNamed name. Can be given multiple times",
+			Destination: &t.Coroutine,
+		},
+		&cli.BoolFlag{
+			Name:        "capture_locals",
+			Usage:       "Capture local variables on each code step, this is expensive",
+			Destination: &t.CaptureLocals,
+		},
+		&cli.StringSliceFlag{
+			Name:        "capture_locals_pkg",
+			Usage:       "Package prefixes to capture local variables for (default is the workflow function package)",
+			Destination: &t.CaptureLocalsPkgs,
+		},
+		&cli.BoolFlag{
+			Name:        "capture_stack",
+			Usage:       "Capture the call stack on each code step to tell apart call paths to the same line, this is expensive",
+			Destination: &t.CaptureStack,
+		},
+		&cli.IntFlag{
+			Name:        "stack_depth",
+			Usage:       "Maximum frames captured per stack with capture_stack (default 10)",
+			Destination: &t.StackDepth,
+		},
+		&cli.IntFlag{
+			Name:        "sample_rate",
+			Usage:       "Only record every Nth code step of each coroutine, server and client events are always recorded",
+			Destination: &t.SampleRate,
+		},
+		&cli.Int64Flag{
+			Name:        "from_event",
+			Usage:       "Only record server and code events from this history event ID on, replay still starts at the beginning",
+			Destination: &t.FromEvent,
+		},
+		&cli.Int64Flag{
+			Name:        "to_event",
+			Usage:       "Trim history to end at this event ID before replaying",
+			Destination: &t.ToEvent,
+		},
+		&cli.Int64Flag{
+			Name:        "replay_until_event",
+			Usage:       "Stop capturing at this workflow task completed event ID, like a reset point",
+			Destination: &t.ReplayUntilEvent,
+		},
+		&cli.BoolFlag{
+			Name:        "keep_duplicate_lines",
+			Usage:       "Record a code line again when stepping back to it immediately, e.g. on a loop header",
+			Destination: &t.KeepDuplicateLines,
+		},
+		&cli.BoolFlag{
+			Name:        "keep_deadlock_detection",
+			Usage:       "Do not set " + tracer.SDKDebugModeEnvVar + " for the replayer, leaving deadlock detection enabled",
+			Destination: &t.KeepDeadlockDetection,
+		},
+		&cli.StringSliceFlag{
+			Name:        "note",
+			Usage:       "Note to attach to a server event in the form EVENT_ID=NOTE",
+			Destination: &t.Notes,
+		},
+		&cli.IntFlag{
+			Name:        "fuzz",
+			Usage:       "Instead of tracing, replay this many times with varying time zones to find nondeterminism",
+			Destination: &t.FuzzRuns,
+		},
+		&cli.BoolFlag{
+			Name:        "check",
+			Usage:       "Only check that the history replays successfully, without tracing. Much faster, for use as a regression check.",
+			Destination: &t.Check,
+		},
+		&cli.StringFlag{
+			Name:        "go",
+			Usage:       "Go binary to build the replayer with (default is go on the PATH)",
+			Destination: &t.GoBinary,
+		},
+		&cli.StringSliceFlag{
+			Name:        "build_flag",
+			Usage:       "Extra flag for building the replayer as a single argument, e.g. -mod=mod",
+			Destination: &t.BuildFlags,
+		},
+		&cli.StringSliceFlag{
+			Name:        "tag",
+			Usage:       "Build tag for building the replayer",
+			Destination: &t.BuildTags,
+		},
+		&cli.BoolFlag{
+			Name:        "replayer_fetches_history",
+			Usage:       "Have the replayer fetch history from the server itself instead of it being fetched once beforehand",
+			Destination: &t.ReplayerFetchesHistory,
+		},
+		&cli.StringFlag{
+			Name:        "prebuilt_exe",
+			Usage:       "Trace this already built replayer instead of building one, should be built with -gcflags=\"all=-N -l\"",
+			Destination: &t.PrebuiltExe,
+		},
+		&cli.StringFlag{
+			Name:        "build_cache",
+			Usage:       "Dir to cache built replay binaries in, reused when the code and dependencies are unchanged",
+			Destination: &t.BuildCacheDir,
+		},
+		&cli.StringFlag{
+			Name:        "break_at",
+			Usage:       "Stop capturing once this file.go:line location is reached",
+			Destination: &t.BreakAt,
+		},
+		&cli.IntFlag{
+			Name:        "break_count",
+			Usage:       "Only stop at the break_at location once it is reached this many times",
+			Destination: &t.BreakCount,
+		},
+		&cli.DurationFlag{
+			Name:        "timeout",
+			Usage:       "Stop the trace and fail once stepping has taken this long (e.g. 5m), the partial result is still output",
+			Destination: &t.TraceTimeout,
+		},
+		&cli.IntFlag{
+			Name:        "max_steps",
+			Usage:       "Stop the trace and fail after this many debugger steps, the partial result is still output",
+			Destination: &t.MaxSteps,
+		},
 	}
 }
 
+// All outputs are written from the same result, so this is only used to
+// decide whether stdout is the default
+func (t *TraceConfig) hasFileOutput() bool {
+	return t.OutputJSONFile != "" || t.OutputCSVFile != "" || t.OutputMarkdownFile != "" ||
+		t.OutputDOTFile != "" || t.OutputHTMLDir != "" || t.OutputHTMLSingle != "" || t.OutputTUI
+}
+
+// Writer for messages other than trace output. With NDJSON, stdout only has
+// events so these go to stderr.
+func (t *TraceConfig) messageWriter() io.Writer {
+	if t.OutputNDJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Whether any output other than JSON or NDJSON needs all events in the result
+func (t *TraceConfig) needsEvents() bool {
+	return t.OutputStdout || t.DivergenceOnly || t.OutputCSVFile != "" || t.OutputMarkdownFile != "" ||
+		t.OutputDOTFile != "" || t.OutputHTMLDir != "" || t.OutputHTMLSingle != "" || t.OutputTUI || t.PostURL != ""
+}
+
 func trace(ctx context.Context, config TraceConfig) error {
+	out := config.messageWriter()
 	// Build config
 	tracerConfig := tracer.Config{
 		ClientOptions: client.Options{
 			HostPort:  config.Address,
 			Namespace: config.Namespace,
 		},
-		WorkflowFuncs: []string{config.Func},
-		RootDir:       config.RootDir,
-		RetainTempDir: config.RetainTempDir,
+		TLSCertFile:         config.TLSCertFile,
+		TLSKeyFile:          config.TLSKeyFile,
+		TLSCACertFile:       config.TLSCACertFile,
+		TLSServerName:       config.TLSServerName,
+		APIKey:              config.APIKey,
+		DataConverterExpr:   config.DataConverterExpr,
+		DelveBackend:        config.DelveBackend,
+		BuildCacheDir:       config.BuildCacheDir,
+		HTMLStyle:           config.HTMLStyle,
+		WorkflowFuncs:       config.Func.Value(),
+		RootDir:             config.RootDir,
+		RetainTempDir:       config.RetainTempDir,
+		ExeName:             config.ExeName,
+		SampleRate:          config.SampleRate,
+		SourceCacheMaxBytes: config.SourceCacheMaxBytes,
+		CaptureLocals:       config.CaptureLocals,
+		CaptureStack:        config.CaptureStack,
+		StackDepth:          config.StackDepth,
+		BreakAt:             config.BreakAt,
+		BreakCount:          config.BreakCount,
+		TraceTimeout:        config.TraceTimeout,
+		MaxSteps:            config.MaxSteps,
 	}
 	if config.WorkflowID != "" {
 		if config.HistoryFile != "" {
@@ -153,11 +570,117 @@ func trace(ctx context.Context, config TraceConfig) error {
 	} else {
 		tracerConfig.HistoryFile = config.HistoryFile
 	}
+	switch config.HistoryFormat {
+	case "", "auto":
+		tracerConfig.HistoryFormat = tracer.HistoryFormatAuto
+	case "json":
+		tracerConfig.HistoryFormat = tracer.HistoryFormatJSON
+	case "proto":
+		tracerConfig.HistoryFormat = tracer.HistoryFormatProto
+	default:
+		return fmt.Errorf("unrecognized history format %q", config.HistoryFormat)
+	}
+	tracerConfig.CaptureLocalsPackages = config.CaptureLocalsPkgs.Value()
+	tracerConfig.IncludeTemporalInternal = config.IncludeTemporalInternal
+	tracerConfig.ExcludeDirs = config.ExcludeDirs.Value()
+	tracerConfig.GoBinary = config.GoBinary
+	tracerConfig.BuildFlags = config.BuildFlags.Value()
+	tracerConfig.BuildTags = config.BuildTags.Value()
+	tracerConfig.PrebuiltExe = config.PrebuiltExe
+	tracerConfig.ReplayerFetchesHistory = config.ReplayerFetchesHistory
+	tracerConfig.KeepDuplicateLines = config.KeepDuplicateLines
+	tracerConfig.ReplayerOptionsExpr = config.ReplayerOptionsExpr
+	tracerConfig.KeepDeadlockDetection = config.KeepDeadlockDetection
+	tracerConfig.StartEventID = config.FromEvent
+	tracerConfig.EndEventID = config.ToEvent
+	tracerConfig.ReplayUntilEventID = config.ReplayUntilEvent
+	tracerConfig.WorkflowTypeName = config.WorkflowType
+	if config.LogJSON {
+		tracerConfig.Log = tracer.NewJSONLogger(os.Stderr)
+	}
+	if config.Quiet {
+		tracerConfig.LogLevel = tracer.LogLevelError
+	} else if level, err := tracer.ParseLogLevel(config.LogLevel); err != nil {
+		return err
+	} else {
+		tracerConfig.LogLevel = level
+	}
+	for _, note := range config.Notes.Value() {
+		pieces := strings.SplitN(note, "=", 2)
+		if len(pieces) != 2 {
+			return fmt.Errorf("note %q missing '='", note)
+		}
+		eventID, err := strconv.ParseInt(pieces[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("note %q has invalid event ID: %w", note, err)
+		}
+		if tracerConfig.EventNotes == nil {
+			tracerConfig.EventNotes = map[int64]string{}
+		}
+		tracerConfig.EventNotes[eventID] = pieces[1]
+	}
 	var err error
 	if tracerConfig.ExcludeFuncs, err = stringsToRegexps(config.ExcludeFuncs.Value()); err != nil {
 		return err
 	} else if tracerConfig.ExcludeFiles, err = stringsToRegexps(config.ExcludeFiles.Value()); err != nil {
 		return err
+	} else if tracerConfig.IncludeFuncs, err = stringsToRegexps(config.IncludeFuncs.Value()); err != nil {
+		return err
+	} else if tracerConfig.IncludeFiles, err = stringsToRegexps(config.IncludeFiles.Value()); err != nil {
+		return err
+	}
+	tracerConfig.CoroutineFilter = config.Coroutine.Value()
+
+	// Stream events if requested
+	var ndjsonErr error
+	if config.OutputNDJSON {
+		enc := json.NewEncoder(os.Stdout)
+		tracerConfig.OnEvent = func(event *tracer.Event) {
+			if ndjsonErr == nil {
+				ndjsonErr = enc.Encode(event)
+			}
+		}
+	}
+
+	// Stream events to the JSON file if requested
+	var streamJSON *jsonResultWriter
+	if config.StreamJSON {
+		if config.OutputJSONFile == "" {
+			return fmt.Errorf("cannot stream JSON without JSON file")
+		}
+		f, err := os.Create(config.OutputJSONFile)
+		if err != nil {
+			return fmt.Errorf("failed creating %v: %w", config.OutputJSONFile, err)
+		}
+		streamJSON = newJSONResultWriter(f)
+		// Closed explicitly with the result on success, this is for early
+		// error returns
+		defer streamJSON.Close(nil)
+		// Code events need not be kept if no other output uses them
+		tracerConfig.DiscardCodeEvents = !config.needsEvents()
+		onEvent := tracerConfig.OnEvent
+		tracerConfig.OnEvent = func(event *tracer.Event) {
+			if onEvent != nil {
+				onEvent(event)
+			}
+			streamJSON.Write(event)
+		}
+	}
+
+	// Overwrite a single stderr line with progress
+	progressCount := 0
+	if config.Progress {
+		const spinner = `|/-\`
+		tracerConfig.OnProgress = func(p tracer.Progress) {
+			fmt.Fprintf(os.Stderr, "\r%c %v server events, %v steps, %v elapsed, at %v:%v\033[K",
+				spinner[progressCount%len(spinner)], p.ServerEvents, p.Steps, p.Elapsed.Round(time.Second),
+				filepath.Base(p.File), p.Line)
+			progressCount++
+		}
+	}
+
+	if config.Check {
+		tracerConfig.Mode = tracer.ModeReplayOnly
 	}
 
 	// Do trace
@@ -165,61 +688,164 @@ func trace(ctx context.Context, config TraceConfig) error {
 	if err != nil {
 		return err
 	}
+	if config.Check {
+		res, err := t.Trace(ctx)
+		if err != nil {
+			if res != nil && res.ReplayError != "" {
+				fmt.Fprintln(out, res.ReplayError)
+			}
+			return fmt.Errorf("check failed: %w", err)
+		}
+		fmt.Fprintln(out, "Replay succeeded")
+		return nil
+	}
+	if config.FuzzRuns > 0 {
+		if err := t.FuzzReplay(ctx, config.FuzzRuns); err != nil {
+			return fmt.Errorf("fuzz failed: %w", err)
+		}
+		fmt.Fprintf(out, "All %v replays succeeded\n", config.FuzzRuns)
+		return nil
+	}
 	res, traceErr := t.Trace(ctx)
+	if progressCount > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if ndjsonErr != nil {
+		return fmt.Errorf("failed writing NDJSON: %w", ndjsonErr)
+	}
+	if streamJSON != nil {
+		if err := streamJSON.Close(res); err != nil {
+			return fmt.Errorf("failed writing %v: %w", config.OutputJSONFile, err)
+		}
+		fmt.Fprintf(out, "Wrote JSON to %v\n", config.OutputJSONFile)
+	}
 
 	// Dump if there is a result
+	var printedNonDeterminism bool
 	if res == nil || len(res.Events) == 0 {
-		fmt.Println("No events recorded")
+		fmt.Fprintln(out, "No events recorded")
+		var noEventsErr *tracer.NoEventsError
+		if errors.As(traceErr, &noEventsErr) {
+			printBreakpointHits(out, noEventsErr.Breakpoints)
+		}
 	} else {
 		// Dump result to stdout
-		if config.OutputStdout || (config.OutputJSONFile == "" && config.OutputHTMLDir == "") {
-			fmt.Printf("------ TRACE ------\n")
-			lastFile, lastLine := "", -1
-			for _, event := range res.Events {
-				if event.Server != nil {
-					fmt.Printf("Event %v - %v\n", event.Server.ID, event.Server.Type)
-					lastFile, lastLine = "", -1
-				} else if event.Client != nil {
-					for _, command := range event.Client.Commands {
-						fmt.Printf("\tCommand - %v\n", command)
-					}
-					lastFile, lastLine = "", -1
-				} else if event.Code != nil {
-					// Ignore if matches last file and line
-					if lastFile == event.Code.File && lastLine == event.Code.Line {
-						continue
-					}
-					fmt.Printf("\t%v - %v:%v\n", event.Code.Package, filepath.Base(event.Code.File), event.Code.Line)
-					lastFile, lastLine = event.Code.File, event.Code.Line
-				}
+		textOpts := tracer.TextOptions{Color: config.useColor()}
+		if config.DivergenceOnly && traceErr != nil {
+			if err := writeDivergence(out, res, textOpts); err != nil {
+				return fmt.Errorf("failed writing trace: %w", err)
+			}
+			// Already shown with the divergence
+			printedNonDeterminism = res.NonDeterminismError != nil
+		} else if config.OutputStdout || (!config.OutputNDJSON && !config.hasFileOutput()) {
+			fmt.Fprintf(out, "------ TRACE ------\n")
+			if err := tracer.WriteText(out, res, textOpts); err != nil {
+				return fmt.Errorf("failed writing trace: %w", err)
+			}
+			if res.Stats != nil {
+				fmt.Fprintf(out, "Stats: %v\n", res.Stats)
 			}
 		}
 
 		// Dump result to JSON if requested
-		if config.OutputJSONFile != "" {
+		if config.OutputJSONFile != "" && streamJSON == nil {
 			if j, err := json.MarshalIndent(res, "", "  "); err != nil {
 				return fmt.Errorf("failed marshaling JSON: %w", err)
 			} else if err = os.WriteFile(config.OutputJSONFile, j, 0644); err != nil {
 				return fmt.Errorf("failed writing %v: %w", config.OutputJSONFile, err)
 			}
-			fmt.Printf("Wrote JSON to %v\n", config.OutputJSONFile)
+			fmt.Fprintf(out, "Wrote JSON to %v\n", config.OutputJSONFile)
+		}
+
+		// Dump result to CSV if requested
+		if config.OutputCSVFile != "" {
+			var b bytes.Buffer
+			if err := tracer.WriteCSV(&b, res); err != nil {
+				return fmt.Errorf("failed building CSV: %w", err)
+			} else if err = os.WriteFile(config.OutputCSVFile, b.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed writing %v: %w", config.OutputCSVFile, err)
+			}
+			fmt.Fprintf(out, "Wrote CSV to %v\n", config.OutputCSVFile)
+		}
+
+		// Dump result to Markdown if requested
+		if config.OutputMarkdownFile != "" {
+			var b bytes.Buffer
+			if err := t.GenerateMarkdown(&b, res); err != nil {
+				return fmt.Errorf("failed generating Markdown: %w", err)
+			} else if err = os.WriteFile(config.OutputMarkdownFile, b.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed writing %v: %w", config.OutputMarkdownFile, err)
+			}
+			fmt.Fprintf(out, "Wrote Markdown to %v\n", config.OutputMarkdownFile)
+		}
+
+		// Dump result to DOT if requested
+		if config.OutputDOTFile != "" {
+			var b bytes.Buffer
+			if err := tracer.GenerateDOT(&b, res); err != nil {
+				return fmt.Errorf("failed generating DOT: %w", err)
+			} else if err = os.WriteFile(config.OutputDOTFile, b.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed writing %v: %w", config.OutputDOTFile, err)
+			}
+			fmt.Fprintf(out, "Wrote DOT to %v\n", config.OutputDOTFile)
 		}
 
 		// Dump result to HTML if requested
 		if config.OutputHTMLDir != "" {
-			var err error
-			switch config.OutputHTMLTheme {
-			case "annotated":
-				err = (&tracer.HTMLGeneratorAnnotated{}).GenerateHTML(ctx, t, config.OutputHTMLDir, res)
-			case "simple-linear":
-				err = tracer.HTMLGeneratorSimpleLinear{}.GenerateHTML(ctx, t, config.OutputHTMLDir, res)
-			default:
-				err = fmt.Errorf("unrecognized theme %q", config.OutputHTMLTheme)
+			if err := writeHTMLDir(ctx, config, t, res); err != nil {
+				return err
 			}
-			if err != nil {
+		}
+
+		// Dump result to single HTML file if requested
+		if config.OutputHTMLSingle != "" {
+			var b bytes.Buffer
+			if err := t.GenerateSingleHTML(&b, res); err != nil {
 				return fmt.Errorf("failed generating HTML: %w", err)
+			} else if err = os.WriteFile(config.OutputHTMLSingle, b.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed writing %v: %w", config.OutputHTMLSingle, err)
 			}
-			fmt.Printf("Wrote HTML to %v\n", config.OutputHTMLDir)
+			fmt.Fprintf(out, "Wrote HTML to %v\n", config.OutputHTMLSingle)
+		}
+
+		// Open HTML if requested, but not being able to is not a trace failure
+		if config.Open {
+			openHTML(config)
+		}
+	}
+
+	// Browse result if requested
+	if config.OutputTUI && res != nil && len(res.Events) > 0 {
+		if err := tui.Run(res); err != nil {
+			return fmt.Errorf("failed running TUI: %w", err)
+		}
+	}
+
+	// Post result if requested and successful
+	if config.PostURL != "" && traceErr == nil && res != nil {
+		if err := postResult(ctx, config.PostURL, config.PostAuthorization, res); err != nil {
+			return fmt.Errorf("failed posting result: %w", err)
+		}
+		fmt.Fprintf(out, "Posted JSON to %v\n", config.PostURL)
+	}
+
+	// Dump any warnings and mismatches
+	if res != nil && res.Summary != nil {
+		for _, warning := range res.Summary.Warnings {
+			fmt.Fprintf(out, "Warning: %v\n", warning)
+		}
+	}
+	if res != nil {
+		for _, mismatch := range res.Mismatches {
+			fmt.Fprintf(out, "Mismatch: workflow task started at event %v expected %v but code produced %v\n",
+				mismatch.TaskStartedEventID, mismatch.Expected, mismatch.Actual)
+		}
+		if res.Failure != nil {
+			printFailure(out, res.Failure)
+		}
+		// Non-determinism is shown last so it is most visible
+		if res.NonDeterminismError != nil && !printedNonDeterminism {
+			printNonDeterminismError(out, res.NonDeterminismError)
 		}
 	}
 
@@ -229,6 +855,215 @@ func trace(ctx context.Context, config TraceConfig) error {
 	return nil
 }
 
+func writeHTMLDir(ctx context.Context, config TraceConfig, t *tracer.Tracer, res *tracer.Result) error {
+	out := config.messageWriter()
+	var err error
+	switch config.OutputHTMLTheme {
+	case "annotated":
+		gen := &tracer.HTMLGeneratorAnnotated{EmitMDXOnly: config.HTMLMDXOnly, ProjectDir: config.HTMLProjectDir}
+		err = gen.GenerateHTML(ctx, t, config.OutputHTMLDir, res)
+	case "simple-linear":
+		gen := tracer.HTMLGeneratorSimpleLinear{ContextLines: config.HTMLContextLines}
+		if gen.ContextLines == 0 {
+			// Zero is the default for the generator, but no context for the flag
+			gen.ContextLines = -1
+		}
+		err = gen.GenerateHTML(ctx, t, config.OutputHTMLDir, res)
+	default:
+		err = fmt.Errorf("unrecognized theme %q", config.OutputHTMLTheme)
+	}
+	if err != nil {
+		return fmt.Errorf("failed generating HTML: %w", err)
+	}
+	fmt.Fprintf(out, "Wrote HTML to %v\n", config.OutputHTMLDir)
+	return nil
+}
+
+func openHTML(config TraceConfig) {
+	out := config.messageWriter()
+	var file string
+	if config.OutputHTMLDir != "" {
+		file = filepath.Join(config.OutputHTMLDir, "index.html")
+	} else if config.OutputHTMLSingle != "" {
+		file = config.OutputHTMLSingle
+	} else {
+		fmt.Fprintln(out, "Not opening browser, no HTML output")
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		fmt.Fprintf(out, "Not opening browser, %v not written\n", file)
+	} else if err = tracer.OpenInBrowser(file); errors.Is(err, tracer.ErrNoDisplay) {
+		fmt.Fprintf(out, "Not opening browser, %v\n", err)
+	} else if err != nil {
+		fmt.Fprintf(out, "Failed opening browser: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "Opened %v in browser\n", file)
+	}
+}
+
+func postResult(ctx context.Context, url, auth string, res *tracer.Result) error {
+	j, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("failed marshaling JSON: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// Writes the final workflow task of the trace followed by the commands expected
+// by history vs the ones the code produced
+func writeDivergence(out io.Writer, res *tracer.Result, textOpts tracer.TextOptions) error {
+	fmt.Fprintf(out, "------ DIVERGENCE ------\n")
+	textOpts.FinalTaskOnly = true
+	if err := tracer.WriteText(out, res, textOpts); err != nil {
+		return err
+	}
+	if res.NonDeterminismError != nil {
+		printNonDeterminismError(out, res.NonDeterminismError)
+	}
+	return nil
+}
+
+func printNonDeterminismError(out io.Writer, err *tracer.NonDeterminismError) {
+	fmt.Fprintf(out, "------ NON-DETERMINISM ------\n")
+	switch err.Kind {
+	case tracer.NonDeterminismMissingCommand:
+		fmt.Fprintf(out, "History has an event the code did not produce a command for\n")
+	case tracer.NonDeterminismExtraCommand:
+		fmt.Fprintf(out, "Code produced a command history does not have an event for\n")
+	case tracer.NonDeterminismMismatch:
+		fmt.Fprintf(out, "Code produced a command that does not match history\n")
+	}
+	if err.Kind != tracer.NonDeterminismExtraCommand {
+		fmt.Fprintf(out, "  History event: %v - %v\n", err.EventID, err.EventType)
+		fmt.Fprintf(out, "  Expected command: %v\n", err.ExpectedCommandType)
+	}
+	if err.ActualCommand != nil {
+		if details := err.ActualCommand.Details(); details != "" {
+			fmt.Fprintf(out, "  Actual command: %v (%v)\n", err.ActualCommand.Type, details)
+		} else {
+			fmt.Fprintf(out, "  Actual command: %v\n", err.ActualCommand.Type)
+		}
+	} else {
+		fmt.Fprintf(out, "  Actual command: <none>\n")
+	}
+}
+
+func printFailure(out io.Writer, failure *tracer.Failure) {
+	fmt.Fprintf(out, "------ PANIC ------\n")
+	fmt.Fprintf(out, "%v\n", failure.Message)
+	fmt.Fprintf(out, "  At: %v:%v (%v)\n", failure.File, failure.Line, failure.Function)
+	if failure.Coroutine != "" {
+		fmt.Fprintf(out, "  Coroutine: %v\n", failure.Coroutine)
+	}
+	for _, frame := range failure.Stack {
+		fmt.Fprintf(out, "    %v - %v:%v\n", frame.Function, frame.File, frame.Line)
+	}
+}
+
+func printBreakpointHits(out io.Writer, hits []*tracer.BreakpointHits) {
+	fmt.Fprintf(out, "------ BREAKPOINTS ------\n")
+	for _, bp := range hits {
+		fmt.Fprintf(out, "%v - %v:%v (%v) - hit %v time(s)\n", bp.Name, bp.File, bp.Line, bp.Function, bp.Hits)
+	}
+}
+
+// Colors are only used for a terminal, and never if NO_COLOR is set per
+// https://no-color.org
+func (t *TraceConfig) useColor() bool {
+	return !t.NoColor && os.Getenv("NO_COLOR") == "" && isatty.IsTerminal(os.Stdout.Fd())
+}
+
+// Writes a JSON result with events written as they arrive. The events array
+// comes first and the rest of the result is written after it on Close, so the
+// file is an ordinary result. The first error is retained and returned from
+// Close.
+type jsonResultWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	count  int
+	err    error
+	closed bool
+}
+
+func newJSONResultWriter(f *os.File) *jsonResultWriter {
+	j := &jsonResultWriter{f: f, w: bufio.NewWriter(f)}
+	_, j.err = fmt.Fprintf(j.w, `{"schemaVersion":%v,"events":[`, tracer.ResultSchemaVersion)
+	return j
+}
+
+func (j *jsonResultWriter) Write(event *tracer.Event) {
+	if j.err != nil {
+		return
+	}
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "\n"
+	}
+	var b []byte
+	if b, j.err = json.Marshal(event); j.err != nil {
+		return
+	} else if _, j.err = j.w.WriteString(sep); j.err == nil {
+		_, j.err = j.w.Write(b)
+	}
+	j.count++
+}
+
+// Fields of the result after the events. The fields already written are
+// shadowed by empty ones that are omitted.
+type jsonResultTail struct {
+	*tracer.Result
+	SchemaVersion int             `json:"schemaVersion,omitempty"`
+	Events        []*tracer.Event `json:"events,omitempty"`
+}
+
+// Close ends the events array, writes the rest of the result if not nil, and
+// closes the file. Later calls do nothing.
+func (j *jsonResultWriter) Close(res *tracer.Result) error {
+	if j.closed {
+		return j.err
+	}
+	j.closed = true
+	var tail []byte
+	if j.err == nil {
+		tail, j.err = json.Marshal(jsonResultTail{Result: res})
+	}
+	if j.err == nil {
+		end := "\n]"
+		if j.count == 0 {
+			end = "]"
+		}
+		if len(tail) > 2 {
+			end += "," + string(tail[1:]) + "\n"
+		} else {
+			end += "}\n"
+		}
+		if _, j.err = j.w.WriteString(end); j.err == nil {
+			j.err = j.w.Flush()
+		}
+	}
+	if err := j.f.Close(); j.err == nil {
+		j.err = err
+	}
+	return j.err
+}
+
 func stringsToRegexps(strs []string) ([]*regexp.Regexp, error) {
 	ret := make([]*regexp.Regexp, len(strs))
 	for i, str := range strs {
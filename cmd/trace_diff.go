@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/urfave/cli/v2"
+)
+
+func traceDiffCmd() *cli.Command {
+	var contextLines int
+	return &cli.Command{
+		Name:      "trace-diff",
+		Usage:     "Show where a trace diverges from a baseline trace, both JSON files written by 'trace --json'",
+		ArgsUsage: "OLD_JSON NEW_JSON",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "context",
+				Usage:       "Number of unchanged steps to show around each change",
+				Value:       3,
+				Destination: &contextLines,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 2 {
+				return fmt.Errorf("expected old and new JSON files")
+			}
+			old, err := readResultFile(ctx.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			new, err := readResultFile(ctx.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			diff, err := tracer.DiffResults(old, new)
+			if err != nil {
+				return err
+			}
+			return tracer.WriteDiffText(os.Stdout, diff, contextLines)
+		},
+	}
+}
+
+func readResultFile(file string) (*tracer.Result, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %v: %w", file, err)
+	}
+	res, err := tracer.UnmarshalResult(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %v: %w", file, err)
+	}
+	return res, nil
+}
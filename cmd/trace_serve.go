@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/urfave/cli/v2"
+)
+
+func traceServeCmd() *cli.Command {
+	var config TraceConfig
+	var addr, loadJSON string
+	flags := config.flags()
+	// Functions are only needed when tracing, not when loading JSON
+	for _, flag := range flags {
+		if f, ok := flag.(*cli.StringSliceFlag); ok && f.Name == "func" {
+			f.Required = false
+		}
+	}
+	return &cli.Command{
+		Name:  "trace-serve",
+		Usage: "Replay an existing run, or load a 'trace --json' file, and serve the HTML output over HTTP",
+		Flags: append(flags,
+			&cli.StringFlag{
+				Name:        "addr",
+				Usage:       "Address to serve the HTML on",
+				Value:       "localhost:8080",
+				Destination: &addr,
+			},
+			&cli.StringFlag{
+				Name:        "load_json",
+				Usage:       "JSON trace file written by 'trace --json' to serve instead of tracing",
+				Destination: &loadJSON,
+			},
+		),
+		Action: func(ctx *cli.Context) error {
+			return traceServe(ctx.Context, config, addr, loadJSON)
+		},
+	}
+}
+
+func traceServe(ctx context.Context, config TraceConfig, addr, loadJSON string) error {
+	if config.Open {
+		return fmt.Errorf("cannot open browser when serving, open the served URL instead")
+	}
+	// Generate into a temp dir unless one is given
+	if config.OutputHTMLDir == "" {
+		dir, err := os.MkdirTemp("", "temporal-debug-go-html-")
+		if err != nil {
+			return fmt.Errorf("failed creating temp dir: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		config.OutputHTMLDir = dir
+	}
+
+	// A failed trace still has HTML worth serving
+	var traceErr error
+	if loadJSON != "" {
+		if config.OutputHTMLTheme != "simple-linear" {
+			return fmt.Errorf("only the simple-linear theme can be used with a loaded JSON trace")
+		}
+		res, err := readResultFile(loadJSON)
+		if err != nil {
+			return err
+		}
+		t := &tracer.Tracer{Config: tracer.Config{HTMLStyle: config.HTMLStyle}}
+		if err := writeHTMLDir(ctx, config, t, res); err != nil {
+			return err
+		}
+	} else if len(config.Func.Value()) == 0 {
+		return fmt.Errorf("must have function unless loading JSON")
+	} else if traceErr = trace(ctx, config); traceErr != nil {
+		if _, err := os.Stat(filepath.Join(config.OutputHTMLDir, "index.html")); err != nil {
+			return traceErr
+		}
+		fmt.Printf("Serving HTML despite error: %v\n", traceErr)
+	}
+
+	fmt.Printf("Serving HTML at %v, press Ctrl+C to stop\n", serveURL(addr))
+	if err := tracer.ServeHTML(config.OutputHTMLDir, addr); err != nil {
+		return fmt.Errorf("failed serving HTML: %w", err)
+	}
+	return traceErr
+}
+
+func serveURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr + "/"
+	} else if host == "" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestJSONResultWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trace.json")
+	f, err := os.Create(file)
+	require.NoError(t, err)
+	events := []*tracer.Event{
+		{Server: &tracer.EventServer{ID: 1}},
+		{Code: &tracer.EventCode{File: "/foo.go", Line: 1, Coroutine: "root"}},
+	}
+	w := newJSONResultWriter(f)
+	for _, event := range events {
+		w.Write(event)
+	}
+	// Events in the result are not written again
+	require.NoError(t, w.Close(&tracer.Result{
+		SchemaVersion: tracer.ResultSchemaVersion,
+		Events:        events[:1],
+		Summary:       &tracer.Summary{Warnings: []string{"some warning"}},
+	}))
+	require.NoError(t, w.Close(nil))
+	res, err := readResultFile(file)
+	require.NoError(t, err)
+	require.Equal(t, events, res.Events)
+	require.Equal(t, []string{"some warning"}, res.Summary.Warnings)
+
+	// No events and no result is still a valid result
+	f, err = os.Create(file)
+	require.NoError(t, err)
+	require.NoError(t, newJSONResultWriter(f).Close(nil))
+	res, err = readResultFile(file)
+	require.NoError(t, err)
+	require.Empty(t, res.Events)
+}
+
+func TestWriteDivergence(t *testing.T) {
+	res := &tracer.Result{
+		Events: []*tracer.Event{
+			{Server: &tracer.EventServer{ID: 3, Type: tracer.EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}},
+			{Code: &tracer.EventCode{Package: "foo", File: "/foo.go", Line: 10}},
+			{Server: &tracer.EventServer{ID: 5, Type: tracer.EventServerType(enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED)}},
+		},
+		NonDeterminismError: &tracer.NonDeterminismError{
+			Kind:                tracer.NonDeterminismMismatch,
+			EventID:             5,
+			EventType:           tracer.EventServerType(enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED),
+			ExpectedCommandType: tracer.EventClientCommandType(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK),
+			ActualCommand: &tracer.EventClientCommand{
+				Type:    tracer.EventClientCommandType(enums.COMMAND_TYPE_START_TIMER),
+				TimerID: "1",
+			},
+		},
+	}
+	var b bytes.Buffer
+	require.NoError(t, writeDivergence(&b, res, tracer.TextOptions{}))
+	require.Contains(t, b.String(), "foo.go:10")
+	require.Contains(t, b.String(), "Expected command: ScheduleActivityTask")
+	require.Contains(t, b.String(), "Actual command: StartTimer (timer ID: 1)")
+}
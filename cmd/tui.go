@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/cretz/temporal-debug-go/tracer/tui"
+	"github.com/urfave/cli/v2"
+)
+
+func tuiCmd() *cli.Command {
+	var jsonFile string
+	return &cli.Command{
+		Name:  "tui",
+		Usage: "Interactively browse a trace from a JSON file written by 'trace --json'",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "json",
+				Usage:       "JSON trace file to browse",
+				Required:    true,
+				Destination: &jsonFile,
+			},
+		},
+		Action: func(*cli.Context) error {
+			res, err := readResultFile(jsonFile)
+			if err != nil {
+				return err
+			}
+			return tui.Run(res)
+		},
+	}
+}
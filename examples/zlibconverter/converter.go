@@ -0,0 +1,15 @@
+// Package zlibconverter is an example of a custom data converter. Workflows
+// whose payloads were written with it can be traced with:
+//
+//	temporal-debug-go trace --data_converter 'github.com/cretz/temporal-debug-go/examples/zlibconverter.NewConverter()' ...
+package zlibconverter
+
+import "go.temporal.io/sdk/converter"
+
+// NewConverter creates a data converter that zlib-compresses all payloads.
+func NewConverter() converter.DataConverter {
+	return converter.NewEncodingDataConverter(
+		converter.GetDefaultDataConverter(),
+		converter.NewZlibEncoder(converter.ZlibEncoderOptions{AlwaysEncode: true}),
+	)
+}
@@ -0,0 +1,19 @@
+package tracertest
+
+// Whether all of the wanted marks are present. This is in its own file so tests
+// can exclude it by file.
+func hasAllMarks(marks []string, want ...string) bool {
+	for _, w := range want {
+		found := false
+		for _, mark := range marks {
+			if mark == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
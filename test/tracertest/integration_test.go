@@ -1,20 +1,29 @@
 package tracertest_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DataDog/temporalite"
+	"github.com/cretz/temporal-debug-go/cmd"
+	"github.com/cretz/temporal-debug-go/examples/cancellation"
 	"github.com/cretz/temporal-debug-go/test/tracertest"
 	"github.com/cretz/temporal-debug-go/tracer"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
 	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/worker"
@@ -22,38 +31,493 @@ import (
 	"go.temporal.io/server/common/log"
 )
 
+const (
+	namespace = "my-namespace"
+	taskQueue = "my-task-queue"
+)
+
 func TestTracer(t *testing.T) {
 	require := require.New(t)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	srv, cl, run := runTestWorkflow(ctx, t)
 
-	// Start server
-	t.Log("Starting server")
-	const namespace = "my-namespace"
-	srv, err := temporalite.NewServer(
-		temporalite.WithNamespaces(namespace),
-		temporalite.WithPersistenceDisabled(),
-		temporalite.WithDynamicPorts(),
-		temporalite.WithLogger(log.NewNoopLogger()),
-	)
+	// Trace the execution
+	t.Log("Running trace")
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	})
 	require.NoError(err)
-	require.NoError(srv.Start())
-	defer srv.Stop()
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.True(hasCodeInFile(res, "helpers.go"))
+	// The workflow returns nil
+	var results []*tracer.EventResult
+	for _, event := range res.Events {
+		if event.Result != nil {
+			results = append(results, event.Result)
+		}
+	}
+	require.Equal([]*tracer.EventResult{{}}, results)
 
-	// Connect client
-	cl, err := srv.NewClient(ctx, namespace)
+	// TODO(cretz): Assert actual values
+	j, err := json.MarshalIndent(res, "", " ")
 	require.NoError(err)
-	defer cl.Close()
+	t.Logf("JSON: %s", j)
 
-	// Start worker with workflow registered
-	const taskQueue = "my-task-queue"
-	wrk := worker.New(cl, taskQueue, worker.Options{WorkflowPanicPolicy: worker.FailWorkflow})
-	wrk.RegisterWorkflow(tracertest.TestWorkflow)
-	require.NoError(wrk.Start())
-	defer wrk.Stop()
+	marks, err := marks(ctx, cl, run)
+	require.NoError(err)
+	t.Logf("Marks: %v", marks)
+
+	// Replay-only check
+	t.Log("Running replay-only check")
+	tr, err = tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+		Mode:          tracer.ModeReplayOnly,
+	})
+	require.NoError(err)
+	res, err = tr.Trace(ctx)
+	require.NoError(err)
+	require.True(res.Success)
+	require.Empty(res.Events)
+}
+
+func TestTraceCommandNDJSON(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, t)
+
+	// Capture stdout while running the command with other outputs that print
+	// messages
+	r, w, err := os.Pipe()
+	require.NoError(err)
+	origStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = origStdout }()
+	var stdout bytes.Buffer
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&stdout, r)
+		copyDone <- err
+	}()
+	_, currFile, _, _ := runtime.Caller(0)
+	outDir := t.TempDir()
+	err = cmd.NewApp().RunContext(ctx, []string{"temporal-debug-go", "trace",
+		"--address", srv.FrontendHostPort(),
+		"--namespace", namespace,
+		"--workflow_id", run.GetID(),
+		"--run_id", run.GetRunID(),
+		"--func", "github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow",
+		"--root", filepath.Dir(currFile),
+		"--ndjson",
+		"--json", filepath.Join(outDir, "trace.json"),
+		"--csv", filepath.Join(outDir, "trace.csv"),
+	})
+	os.Stdout = origStdout
+	require.NoError(w.Close())
+	require.NoError(<-copyDone)
+	require.NoError(err)
+
+	// Every stdout line is an event
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.NotEmpty(lines)
+	for _, line := range lines {
+		var event tracer.Event
+		require.NoError(json.Unmarshal([]byte(line), &event), "line: %v", line)
+	}
+}
+
+func TestTracerExclude(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, t)
+
+	// Helpers are called from the workflow but should be stepped out of
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+		ExcludeFiles:  []*regexp.Regexp{regexp.MustCompile(`/tracertest/helpers\.go$`)},
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.True(hasCodeInFile(res, "workflows.go"))
+	require.False(hasCodeInFile(res, "helpers.go"))
+}
+
+func TestTracerCancel(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, t)
+
+	// Cancel once the first line of code is recorded
+	traceCtx, traceCancel := context.WithCancel(ctx)
+	defer traceCancel()
+	logger := &recordingLogger{}
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+		Log:           logger,
+		OnEvent: func(event *tracer.Event) {
+			if event.Code != nil {
+				traceCancel()
+			}
+		},
+	})
+	require.NoError(err)
+	res, err := tr.Trace(traceCtx)
+	require.ErrorIs(err, context.Canceled)
+	require.NotNil(res)
+	require.NotEmpty(res.Events)
+	require.Contains(logger.messages(), "Detaching debugger")
+	require.NotContains(logger.messages(), "Failed detaching")
+}
+
+func TestTracerScopes(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl := startServerAndWorker(ctx, t)
+
+	// Run the cancellation example, cancelling while its activity heartbeats
+	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
+	run, err := cl.ExecuteWorkflow(ctx, startOpts, cancellation.MyWorkflow)
+	require.NoError(err)
+	time.Sleep(2 * time.Second)
+	require.NoError(cl.CancelWorkflow(ctx, run.GetID(), run.GetRunID()))
+	// Cancellation may be reported as an error
+	_ = run.Get(ctx, nil)
+
+	// Activities are not run on replay, so all example code is workflow code
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.True(hasCodeInFile(res, "workflow.go"))
+	for _, event := range res.Events {
+		if event.Code != nil {
+			require.Equal(tracer.EventCodeScopeWorkflow, event.Code.Scope, "%v:%v", event.Code.File, event.Code.Line)
+		}
+	}
+
+	// Coroutines in the test workflow are their own scope
+	srv, _, run = runTestWorkflow(ctx, t)
+	tr, err = tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	})
+	require.NoError(err)
+	res, err = tr.Trace(ctx)
+	require.NoError(err)
+	scopes := map[tracer.EventCodeScope]bool{}
+	for _, event := range res.Events {
+		if event.Code != nil && event.Code.Coroutine == "my-coroutine" {
+			require.Equal(tracer.EventCodeScopeCoroutine, event.Code.Scope)
+		}
+		if event.Code != nil {
+			// Every coroutine is named, including the root one
+			require.NotEmpty(event.Code.Coroutine)
+			if event.Code.Scope == tracer.EventCodeScopeWorkflow {
+				require.Equal("root", event.Code.Coroutine)
+			}
+			scopes[event.Code.Scope] = true
+		}
+	}
+	require.Equal(map[tracer.EventCodeScope]bool{tracer.EventCodeScopeWorkflow: true, tracer.EventCodeScopeCoroutine: true},
+		scopes)
+}
+
+func TestTracerCoroutineFilter(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, t)
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions:   client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs:   []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:       &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:         filepath.Dir(currFile),
+		CoroutineFilter: []string{"my-coroutine"},
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+
+	// Only code of the coroutine is kept, server and client events remain
+	var codeEvents, serverEvents, clientEvents int
+	for _, event := range res.Events {
+		switch {
+		case event.Code != nil:
+			require.Equal("my-coroutine", event.Code.Coroutine)
+			// Inherited from the root coroutine that spawned it
+			require.Equal("github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow", event.Code.WorkflowFunc)
+			codeEvents++
+		case event.Server != nil:
+			serverEvents++
+		case event.Client != nil:
+			clientEvents++
+		}
+	}
+	require.NotZero(codeEvents)
+	require.NotZero(serverEvents)
+	require.NotZero(clientEvents)
+	// Stats only count the recorded code
+	require.Equal(map[string]int{"my-coroutine": codeEvents}, res.Stats.CoroutineCodeEvents)
+	require.Greater(res.Stats.Steps, codeEvents)
+}
+
+func TestTracerPanic(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl := startServerAndWorker(ctx, t)
+	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
+	run, err := cl.ExecuteWorkflow(ctx, startOpts, tracertest.PanicWorkflow)
+	require.NoError(err)
+	require.Error(run.Get(ctx, nil))
+
+	// Replay fails the same way, but the panic is captured first
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.PanicWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.Error(err)
+	require.NotNil(res)
+	require.NotNil(res.Failure)
+	require.Equal("intentional panic", res.Failure.Message)
+	require.Equal("panicking-coroutine", res.Failure.Coroutine)
+	require.Equal("workflows.go", filepath.Base(res.Failure.File))
+	require.Equal("github.com/cretz/temporal-debug-go/test/tracertest.PanicWorkflow.func1", res.Failure.Function)
+}
+
+func TestTracerLongSyncSection(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl := startServerAndWorker(ctx, t)
+	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
+	run, err := cl.ExecuteWorkflow(ctx, startOpts, tracertest.LongSyncWorkflow, 2000)
+	require.NoError(err)
+	require.NoError(run.Get(ctx, nil))
+
+	// Stepping every line takes far longer than the deadlock detection timeout
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.LongSyncWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.Nil(res.Failure)
+}
+
+func TestTracerLimits(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl := startServerAndWorker(ctx, t)
+	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
+	run, err := cl.ExecuteWorkflow(ctx, startOpts, tracertest.LongSyncWorkflow, 2000)
+	require.NoError(err)
+	require.NoError(run.Get(ctx, nil))
+
+	_, currFile, _, _ := runtime.Caller(0)
+	config := tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.LongSyncWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	}
+
+	// Stops after the max steps with a partial result
+	config.MaxSteps = 200
+	tr, err := tracer.New(config)
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.ErrorIs(err, tracer.ErrMaxSteps)
+	require.NotNil(res)
+	require.NotEmpty(res.Events)
+	require.Equal(200, res.Stats.Steps)
+	require.False(hasResultEvent(res))
+
+	// Stops after the timeout with a partial result, stepping every line of the
+	// loop takes far longer than this
+	config.MaxSteps = 0
+	config.TraceTimeout = 3 * time.Second
+	tr, err = tracer.New(config)
+	require.NoError(err)
+	start := time.Now()
+	res, err = tr.Trace(ctx)
+	require.ErrorIs(err, tracer.ErrTraceTimeout)
+	require.Less(time.Since(start), time.Minute)
+	require.NotNil(res)
+	require.NotEmpty(res.Events)
+	require.False(hasResultEvent(res))
+}
+
+func TestTracerReplayUntilEvent(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl, run := runTestWorkflow(ctx, t)
+
+	// Use the first task boundary
+	var boundaryID int64
+	iter := cl.GetWorkflowHistory(ctx, run.GetID(), run.GetRunID(), false, enums.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
+	for boundaryID == 0 && iter.HasNext() {
+		event, err := iter.Next()
+		require.NoError(err)
+		if event.EventType == enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED {
+			boundaryID = event.EventId
+		}
+	}
+	require.NotZero(boundaryID)
+
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions:      client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs:      []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:          &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:            filepath.Dir(currFile),
+		ReplayUntilEventID: boundaryID,
+	})
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.NotEmpty(res.Events)
+	for _, event := range res.Events {
+		if event.Server != nil {
+			require.LessOrEqual(event.Server.ID, boundaryID)
+		}
+	}
+}
+
+func TestTracerDuplicateLines(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, t)
+
+	// The selector loop in the workflow steps back to the same lines, but they
+	// are only recorded again if requested
+	_, currFile, _, _ := runtime.Caller(0)
+	config := tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+	}
+	tr, err := tracer.New(config)
+	require.NoError(err)
+	res, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.Zero(duplicateCodeEvents(res))
+
+	config.KeepDuplicateLines = true
+	tr, err = tracer.New(config)
+	require.NoError(err)
+	resWithDupes, err := tr.Trace(ctx)
+	require.NoError(err)
+	require.NotZero(duplicateCodeEvents(resWithDupes))
+	require.Greater(len(resWithDupes.Events), len(res.Events))
+}
+
+// Measures a full trace of the test workflow. The harness build is cached so
+// this is mostly the debugger stepping and breakpoint handlers.
+func BenchmarkTrace(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _, run := runTestWorkflow(ctx, b)
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+		BuildCacheDir: b.TempDir(),
+	})
+	require.NoError(b, err)
+	// Warm the build cache
+	_, err = tr.Trace(ctx)
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = tr.Trace(ctx)
+		require.NoError(b, err)
+	}
+}
+
+// Measures a full trace of a workflow spawning many coroutines, which is
+// dominated by the coroutine spawn breakpoint handler.
+func BenchmarkTraceManyCoroutines(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, cl := startServerAndWorker(ctx, b)
+	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
+	run, err := cl.ExecuteWorkflow(ctx, startOpts, tracertest.ManyCoroutinesWorkflow, 100)
+	require.NoError(b, err)
+	require.NoError(b, run.Get(ctx, nil))
+
+	_, currFile, _, _ := runtime.Caller(0)
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.ManyCoroutinesWorkflow"},
+		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
+		RootDir:       filepath.Dir(currFile),
+		BuildCacheDir: b.TempDir(),
+	})
+	require.NoError(b, err)
+	// Warm the build cache
+	_, err = tr.Trace(ctx)
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = tr.Trace(ctx)
+		require.NoError(b, err)
+	}
+}
+
+// Starts a server and worker and runs the test workflow to completion. The
+// server and worker are stopped on test cleanup.
+func runTestWorkflow(ctx context.Context, tb testing.TB) (*temporalite.Server, client.Client, client.WorkflowRun) {
+	require := require.New(tb)
+	srv, cl := startServerAndWorker(ctx, tb)
 
 	// Start workflow
-	t.Log("Starting workflow")
+	tb.Log("Starting workflow")
 	startOpts := client.StartWorkflowOptions{ID: "my-workflow-" + uuid.NewString(), TaskQueue: taskQueue}
 	run, err := cl.ExecuteWorkflow(ctx, startOpts, tracertest.TestWorkflow)
 	require.NoError(err)
@@ -69,28 +533,42 @@ func TestTracer(t *testing.T) {
 	// Send a continue to finish the workflow
 	require.NoError(cl.SignalWorkflow(ctx, run.GetID(), run.GetRunID(), "continue-signal", nil))
 	require.NoError(run.Get(ctx, nil))
+	return srv, cl, run
+}
 
-	// Trace the execution
-	t.Log("Running trace")
-	_, currFile, _, _ := runtime.Caller(0)
-	tr, err := tracer.New(tracer.Config{
-		ClientOptions: client.Options{HostPort: srv.FrontendHostPort(), Namespace: namespace},
-		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/test/tracertest.TestWorkflow"},
-		Execution:     &workflow.Execution{ID: run.GetID(), RunID: run.GetRunID()},
-		RootDir:       filepath.Dir(currFile),
-	})
-	require.NoError(err)
-	res, err := tr.Trace(ctx)
-	require.NoError(err)
+// Starts a server and a worker with all test workflows registered. Both are
+// stopped on test cleanup.
+func startServerAndWorker(ctx context.Context, tb testing.TB) (*temporalite.Server, client.Client) {
+	require := require.New(tb)
 
-	// TODO(cretz): Assert actual values
-	j, err := json.MarshalIndent(res, "", " ")
+	// Start server
+	tb.Log("Starting server")
+	srv, err := temporalite.NewServer(
+		temporalite.WithNamespaces(namespace),
+		temporalite.WithPersistenceDisabled(),
+		temporalite.WithDynamicPorts(),
+		temporalite.WithLogger(log.NewNoopLogger()),
+	)
 	require.NoError(err)
-	t.Logf("JSON: %s", j)
+	require.NoError(srv.Start())
+	tb.Cleanup(srv.Stop)
 
-	marks, err := marks(ctx, cl, run)
+	// Connect client
+	cl, err := srv.NewClient(ctx, namespace)
 	require.NoError(err)
-	t.Logf("Marks: %v", marks)
+	tb.Cleanup(cl.Close)
+
+	// Start worker with workflow registered
+	wrk := worker.New(cl, taskQueue, worker.Options{WorkflowPanicPolicy: worker.FailWorkflow})
+	wrk.RegisterWorkflow(tracertest.TestWorkflow)
+	wrk.RegisterWorkflow(tracertest.ManyCoroutinesWorkflow)
+	wrk.RegisterWorkflow(tracertest.PanicWorkflow)
+	wrk.RegisterWorkflow(tracertest.LongSyncWorkflow)
+	wrk.RegisterWorkflow(cancellation.MyWorkflow)
+	wrk.RegisterActivity(&cancellation.Activities{})
+	require.NoError(wrk.Start())
+	tb.Cleanup(wrk.Stop)
+	return srv, cl
 }
 
 func waitForMark(ctx context.Context, c client.Client, run client.WorkflowRun, mark string) error {
@@ -131,3 +609,57 @@ func marks(ctx context.Context, c client.Client, run client.WorkflowRun) ([]stri
 	}
 	return marks, nil
 }
+
+func hasCodeInFile(res *tracer.Result, fileName string) bool {
+	for _, event := range res.Events {
+		if event.Code != nil && filepath.Base(event.Code.File) == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of code events on the same line and coroutine as the event before
+func hasResultEvent(res *tracer.Result) bool {
+	for _, event := range res.Events {
+		if event.Result != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicateCodeEvents(res *tracer.Result) int {
+	dupes := 0
+	for i := 1; i < len(res.Events); i++ {
+		prev, curr := res.Events[i-1].Code, res.Events[i].Code
+		if prev != nil && curr != nil && prev.File == curr.File && prev.Line == curr.Line &&
+			prev.Coroutine == curr.Coroutine {
+			dupes++
+		}
+	}
+	return dupes
+}
+
+// Records log messages, ignoring key values
+type recordingLogger struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (r *recordingLogger) record(msg string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func (r *recordingLogger) messages() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.msgs...)
+}
+
+func (r *recordingLogger) Debug(msg string, keyvals ...interface{}) { r.record(msg) }
+func (r *recordingLogger) Info(msg string, keyvals ...interface{})  { r.record(msg) }
+func (r *recordingLogger) Warn(msg string, keyvals ...interface{})  { r.record(msg) }
+func (r *recordingLogger) Error(msg string, keyvals ...interface{}) { r.record(msg) }
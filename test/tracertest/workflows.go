@@ -36,15 +36,7 @@ func TestWorkflow(ctx workflow.Context) error {
 
 	// Wait for asyncs to be done
 	err := workflow.Await(ctx, func() bool {
-		var coroutine1Ended, coroutine2Ended bool
-		for _, mark := range marks {
-			if mark == "coroutine 1 ended" {
-				coroutine1Ended = true
-			} else if mark == "coroutine 2 ended" {
-				coroutine2Ended = true
-			}
-		}
-		return coroutine1Ended && coroutine2Ended
+		return hasAllMarks(marks, "coroutine 1 ended", "coroutine 2 ended")
 	})
 	if err != nil {
 		return err
@@ -75,3 +67,41 @@ func TestWorkflow(ctx workflow.Context) error {
 	marks = append(marks, "workflow ended")
 	return nil
 }
+
+// ManyCoroutinesWorkflow spawns the given number of named coroutines that each
+// sleep briefly, then waits for them all to complete.
+func ManyCoroutinesWorkflow(ctx workflow.Context, count int) error {
+	wg := workflow.NewWaitGroup(ctx)
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		workflow.GoNamed(ctx, "coroutine-"+strconv.Itoa(i), func(ctx workflow.Context) {
+			defer wg.Done()
+			workflow.Sleep(ctx, 10*time.Millisecond)
+		})
+	}
+	wg.Wait(ctx)
+	return nil
+}
+
+// PanicWorkflow panics in a coroutine after a timer, failing the workflow.
+func PanicWorkflow(ctx workflow.Context) error {
+	workflow.Sleep(ctx, 10*time.Millisecond)
+	workflow.GoNamed(ctx, "panicking-coroutine", func(ctx workflow.Context) {
+		panic("intentional panic")
+	})
+	return workflow.Await(ctx, func() bool { return false })
+}
+
+// LongSyncWorkflow runs many lines without yielding, which takes well over the
+// SDK's deadlock detection timeout when single-stepped.
+func LongSyncWorkflow(ctx workflow.Context, iterations int) (int, error) {
+	sum := 0
+	for i := 0; i < iterations; i++ {
+		if i%2 == 0 {
+			sum += i
+		} else {
+			sum -= i / 2
+		}
+	}
+	return sum, nil
+}
@@ -0,0 +1,52 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrNoDisplay is returned from OpenInBrowser when there is no graphical
+// display to open a browser on.
+var ErrNoDisplay = errors.New("no display available")
+
+// OpenInBrowser opens the given file in the default browser using the
+// platform's open, xdg-open, or start command.
+func OpenInBrowser(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed getting absolute path: %w", err)
+	} else if _, err := os.Stat(abs); err != nil {
+		return err
+	}
+	name, args := browserCommand(runtime.GOOS, os.Getenv, abs)
+	if name == "" {
+		return ErrNoDisplay
+	} else if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%w: %v not found", ErrNoDisplay, name)
+	}
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running %v: %w, output: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Returns an empty name if there is no display.
+func browserCommand(goos string, getenv func(string) string, path string) (name string, args []string) {
+	switch goos {
+	case "darwin":
+		return "open", []string{path}
+	case "windows":
+		// First quoted arg to start is the window title
+		return "cmd", []string{"/c", "start", "", path}
+	default:
+		if getenv("DISPLAY") == "" && getenv("WAYLAND_DISPLAY") == "" {
+			return "", nil
+		}
+		return "xdg-open", []string{path}
+	}
+}
@@ -0,0 +1,26 @@
+package tracer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrowserCommand(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(key string) string { return env[key] }
+	name, args := browserCommand("darwin", getenv, "/out/index.html")
+	require.Equal(t, "open", name)
+	require.Equal(t, []string{"/out/index.html"}, args)
+	name, args = browserCommand("windows", getenv, `C:\out\index.html`)
+	require.Equal(t, "cmd", name)
+	require.Equal(t, []string{"/c", "start", "", `C:\out\index.html`}, args)
+
+	// No display on Linux skips
+	name, _ = browserCommand("linux", getenv, "/out/index.html")
+	require.Empty(t, name)
+	env["WAYLAND_DISPLAY"] = "wayland-0"
+	name, args = browserCommand("linux", getenv, "/out/index.html")
+	require.Equal(t, "xdg-open", name)
+	require.Equal(t, []string{"/out/index.html"}, args)
+}
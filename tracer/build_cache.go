@@ -0,0 +1,119 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Hashes everything that affects the built harness. Other modules are
+// represented by go.mod and go.sum, main module packages by their files.
+func (t *Tracer) buildCacheKey(ctx context.Context, dir string, mainSource []byte) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v/%v\n", runtime.GOOS, runtime.GOARCH)
+	h.Write(mainSource)
+	fmt.Fprintf(h, "%q\n", t.buildArgs("", "main.go"))
+
+	// Go version and module files
+	out, err := t.goOutput(ctx, dir, "env", "GOVERSION", "GOMOD")
+	if err != nil {
+		return "", err
+	}
+	h.Write(out)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || lines[1] == "" || lines[1] == os.DevNull {
+		return "", fmt.Errorf("build cache requires a module")
+	}
+	goMod := lines[1]
+	for _, file := range []string{goMod, filepath.Join(filepath.Dir(goMod), "go.sum")} {
+		if b, err := os.ReadFile(file); err == nil {
+			h.Write(b)
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed reading %v: %w", file, err)
+		}
+	}
+
+	// Main module files depended on
+	listArgs := []string{"list", "-deps", "-f",
+		`{{if and .Module .Module.Main}}{{$dir := .Dir}}{{range .GoFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}` +
+			`{{range .CgoFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}{{range .EmbedFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}{{end}}`}
+	if len(t.BuildTags) > 0 {
+		listArgs = append(listArgs, "-tags", strings.Join(t.BuildTags, ","))
+	}
+	out, err = t.goOutput(ctx, dir, append(listArgs, "main.go")...)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range strings.Fields(string(out)) {
+		// Harness files are already hashed
+		if filepath.Dir(file) == dir {
+			continue
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed reading %v: %w", file, err)
+		}
+		fmt.Fprintf(h, "%v\n", file)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (t *Tracer) goOutput(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return goOutput(ctx, t.GoBinary, dir, args...)
+}
+
+func goOutput(ctx context.Context, goBinary, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, goBinary, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return nil, fmt.Errorf("failed running go %v: %w: %s", args[0], err, bytes.TrimSpace(exitErr.Stderr))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed running go %v: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// Returns the cached exe and the dir it was originally built in
+func (t *Tracer) loadCachedHarness(key string) (exe, buildDir string, ok bool) {
+	entryDir := filepath.Join(t.BuildCacheDir, key)
+	b, err := os.ReadFile(filepath.Join(entryDir, "build-dir"))
+	if err != nil {
+		return "", "", false
+	}
+	pieces := strings.SplitN(string(b), "\n", 2)
+	if len(pieces) != 2 {
+		return "", "", false
+	}
+	exe = filepath.Join(entryDir, pieces[1])
+	if _, err := os.Stat(exe); err != nil {
+		return "", "", false
+	}
+	return exe, pieces[0], true
+}
+
+func (t *Tracer) storeCachedHarness(key, exe, buildDir string) error {
+	entryDir := filepath.Join(t.BuildCacheDir, key)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(exe)
+	if err != nil {
+		return err
+	}
+	// Write the exe first since the build dir file marks the entry complete
+	if err := os.WriteFile(filepath.Join(entryDir, filepath.Base(exe)), b, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(entryDir, "build-dir"), []byte(buildDir+"\n"+filepath.Base(exe)), 0644)
+}
@@ -0,0 +1,92 @@
+package tracer
+
+import (
+	"strings"
+
+	"go.temporal.io/api/enums/v1"
+)
+
+// Code event that produced each command, and the server events that resulted
+// from those commands. A command's code is the next code event in its
+// workflow task after the previous command's code whose source line calls
+// the SDK function for the command. Commands without such a call, e.g. those
+// from helpers wrapping the SDK calls, are not correlated.
+type commandSources struct {
+	// Keyed by client event, parallel to its commands with nil for unknown
+	commands map[*Event][]*Event
+	// Keyed by server event resulting from a command with known code
+	server map[*Event]*Event
+}
+
+// SDK calls whose source line produces each command type
+var commandCalls = map[enums.CommandType][]string{
+	enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK:                     {"ExecuteActivity("},
+	enums.COMMAND_TYPE_START_TIMER:                                {"NewTimer(", "Sleep("},
+	enums.COMMAND_TYPE_START_CHILD_WORKFLOW_EXECUTION:             {"ExecuteChildWorkflow("},
+	enums.COMMAND_TYPE_RECORD_MARKER:                              {"SideEffect(", "GetVersion(", "ExecuteLocalActivity("},
+	enums.COMMAND_TYPE_SIGNAL_EXTERNAL_WORKFLOW_EXECUTION:         {"SignalExternalWorkflow("},
+	enums.COMMAND_TYPE_REQUEST_CANCEL_EXTERNAL_WORKFLOW_EXECUTION: {"RequestCancelExternalWorkflow("},
+	enums.COMMAND_TYPE_UPSERT_WORKFLOW_SEARCH_ATTRIBUTES:          {"UpsertSearchAttributes("},
+	enums.COMMAND_TYPE_CONTINUE_AS_NEW_WORKFLOW_EXECUTION:         {"NewContinueAsNewError("},
+}
+
+// The sourceLine function returns the source of the code event's line or an
+// empty string if unavailable.
+func correlateCommands(events []*Event, sourceLine func(*EventCode) string) *commandSources {
+	c := &commandSources{commands: map[*Event][]*Event{}, server: map[*Event]*Event{}}
+	// Code events of the current task not yet matched to a command
+	var taskCode []*Event
+	var lastClient *Event
+	// Next command of the last client event to match to a server event
+	nextCommand := 0
+	for _, event := range events {
+		switch {
+		case event.Code != nil:
+			if len(taskCode) > 0 && taskCode[0].Code.Task != event.Code.Task {
+				taskCode = nil
+			}
+			taskCode = append(taskCode, event)
+		case event.Client != nil:
+			codes := make([]*Event, len(event.Client.Commands))
+			for j, command := range event.Client.Commands {
+				calls := commandCalls[enums.CommandType(command)]
+				for k, code := range taskCode {
+					if code.Code.Task == event.Client.Task && lineCalls(sourceLine(code.Code), calls) {
+						codes[j] = code
+						taskCode = taskCode[k+1:]
+						break
+					}
+				}
+			}
+			c.commands[event] = codes
+			taskCode = nil
+			lastClient, nextCommand = event, 0
+		case event.Server != nil && lastClient != nil:
+			eventType := enums.EventType(event.Server.Type)
+			if !isCommandEventType(eventType) {
+				continue
+			}
+			commands := lastClient.Client.Commands
+			if nextCommand >= len(commands) ||
+				commandEventTypes[enums.CommandType(commands[nextCommand])] != eventType {
+				// Events no longer line up with the commands
+				lastClient = nil
+				continue
+			}
+			if code := c.commands[lastClient][nextCommand]; code != nil {
+				c.server[event] = code
+			}
+			nextCommand++
+		}
+	}
+	return c
+}
+
+func lineCalls(line string, calls []string) bool {
+	for _, call := range calls {
+		if strings.Contains(line, call) {
+			return true
+		}
+	}
+	return false
+}
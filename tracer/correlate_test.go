@@ -0,0 +1,40 @@
+package tracer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestCorrelateCommands(t *testing.T) {
+	source := map[int]string{
+		10: `	ctx = workflow.WithActivityOptions(ctx, opts)`,
+		11: `	fut := workflow.ExecuteActivity(ctx, MyActivity)`,
+		12: `	workflow.Sleep(ctx, time.Second)`,
+		13: `	return fut.Get(ctx, nil)`,
+	}
+	code := func(line int) *Event {
+		return &Event{Code: &EventCode{File: "workflow.go", Line: line, Coroutine: "root", Task: 1}}
+	}
+	server := func(eventType enums.EventType) *Event {
+		return &Event{Server: &EventServer{Type: EventServerType(eventType)}}
+	}
+	activityCode, sleepCode := code(11), code(12)
+	client := &Event{Client: &EventClient{Task: 1, Commands: []EventClientCommandType{
+		EventClientCommandType(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK),
+		EventClientCommandType(enums.COMMAND_TYPE_START_TIMER),
+		EventClientCommandType(enums.COMMAND_TYPE_CANCEL_TIMER),
+	}}}
+	activityScheduled, timerStarted := server(enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED),
+		server(enums.EVENT_TYPE_TIMER_STARTED)
+	timerCanceled := server(enums.EVENT_TYPE_TIMER_CANCELED)
+	c := correlateCommands([]*Event{
+		code(10), activityCode, sleepCode, code(13), client,
+		server(enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED), activityScheduled, timerStarted, timerCanceled,
+	}, func(code *EventCode) string { return source[code.Line] })
+
+	// Cancel has no call to find
+	require.Equal(t, []*Event{activityCode, sleepCode, nil}, c.commands[client])
+	require.Equal(t, map[*Event]*Event{activityScheduled: activityCode, timerStarted: sleepCode}, c.server)
+}
@@ -0,0 +1,34 @@
+package tracer
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// WriteCSV writes the result as CSV with a header row and one row per server
+// event, client command, or code line.
+func WriteCSV(w io.Writer, res *Result) error {
+	c := csv.NewWriter(w)
+	rows := [][]string{{"kind", "event_id", "type", "package", "file", "line", "coroutine"}}
+	for _, event := range res.Events {
+		switch {
+		case event.Server != nil:
+			rows = append(rows, []string{"server", strconv.FormatInt(event.Server.ID, 10), event.Server.Type.String(),
+				"", "", "", ""})
+		case event.Client != nil:
+			for _, command := range event.Client.Commands {
+				rows = append(rows, []string{"client", "", command.String(), "", "", "", ""})
+			}
+		case event.Code != nil:
+			rows = append(rows, []string{"code", "", "", event.Code.Package, event.Code.File,
+				strconv.Itoa(event.Code.Line), event.Code.Coroutine})
+		case event.Result != nil:
+			rows = append(rows, []string{"result", "", event.Result.Details(), "", "", "", ""})
+		}
+	}
+	if err := c.WriteAll(rows); err != nil {
+		return err
+	}
+	return c.Error()
+}
@@ -0,0 +1,261 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Diff is the difference between the events of two results.
+type Diff struct {
+	// Index of the first step that is not DiffOpSame, or -1 if the results have
+	// the same events. Since all steps before it are the same, this is also the
+	// index of the divergent event in both the old and new results.
+	FirstDivergence int
+	// Every event of both results in order
+	Steps []*DiffStep
+}
+
+type DiffOp int
+
+const (
+	DiffOpSame DiffOp = iota
+	DiffOpRemoved
+	DiffOpAdded
+)
+
+type DiffStep struct {
+	Op DiffOp
+	// Event from the old result for DiffOpSame and DiffOpRemoved, the new
+	// result for DiffOpAdded
+	Event *Event
+}
+
+// DiffResults aligns the events of two results and reports which were removed
+// from old and added in new. Server events are matched on ID and type, client
+// events on their commands, and code events on package, file name, line, and
+// coroutine. File directories are ignored so traces from different machines
+// can be compared.
+func DiffResults(old, new *Result) (*Diff, error) {
+	if old == nil || new == nil {
+		return nil, fmt.Errorf("both results required")
+	}
+	oldKeys, newKeys := diffKeys(old.Events, new.Events)
+	var ops []DiffOp
+	diffOps(oldKeys, newKeys, &ops)
+
+	// Build steps, putting the removed events of each change before the added
+	d := &Diff{FirstDivergence: -1}
+	var removed, added []*DiffStep
+	flushChange := func() {
+		d.Steps = append(append(d.Steps, removed...), added...)
+		removed, added = removed[:0], added[:0]
+	}
+	i, j := 0, 0
+	for _, op := range ops {
+		switch op {
+		case DiffOpSame:
+			flushChange()
+			d.Steps = append(d.Steps, &DiffStep{Op: DiffOpSame, Event: old.Events[i]})
+			i++
+			j++
+		case DiffOpRemoved:
+			if d.FirstDivergence < 0 {
+				d.FirstDivergence = len(d.Steps)
+			}
+			removed = append(removed, &DiffStep{Op: DiffOpRemoved, Event: old.Events[i]})
+			i++
+		case DiffOpAdded:
+			if d.FirstDivergence < 0 {
+				d.FirstDivergence = len(d.Steps)
+			}
+			added = append(added, &DiffStep{Op: DiffOpAdded, Event: new.Events[j]})
+			j++
+		}
+	}
+	flushChange()
+	return d, nil
+}
+
+// Appends the ops to turn a into b to ops. This is Myers' algorithm in linear
+// space, recursively splitting on the middle of the shortest edit path, so
+// memory stays proportional to the number of events even for long traces.
+func diffOps(a, b []int, ops *[]DiffOp) {
+	// Common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	appendOps(ops, DiffOpSame, prefix)
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) == 0 || len(b) == 0 {
+		appendOps(ops, DiffOpRemoved, len(a))
+		appendOps(ops, DiffOpAdded, len(b))
+	} else if x, y, ok := diffMiddle(a, b); ok {
+		diffOps(a[:x], b[:y], ops)
+		diffOps(a[x:], b[y:], ops)
+	} else {
+		appendOps(ops, DiffOpRemoved, len(a))
+		appendOps(ops, DiffOpAdded, len(b))
+	}
+	appendOps(ops, DiffOpSame, suffix)
+}
+
+func appendOps(ops *[]DiffOp, op DiffOp, count int) {
+	for i := 0; i < count; i++ {
+		*ops = append(*ops, op)
+	}
+}
+
+// Finds where the forward and reverse searches of the shortest edit path meet,
+// returning the indexes in a and b to split at. False if there is no common
+// element at all.
+func diffMiddle(a, b []int) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// Furthest x reached on each diagonal k, indexed by offset+k, from the
+	// start and from the end
+	forward, reverse := make([]int, 2*offset+1), make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], reverse[i] = -1, -1
+	}
+	forward[offset+1], reverse[offset+1] = 0, 0
+	delta := n - m
+	// With an odd delta the paths meet while extending forward, otherwise in
+	// reverse
+	checkForward := delta%2 != 0
+	// Diagonals that went past the edges are not extended further
+	forwardStart, forwardEnd, reverseStart, reverseEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if x > n {
+				forwardEnd += 2
+			} else if y > m {
+				forwardStart += 2
+			} else if checkForward {
+				if rk := offset + delta - k; rk >= 0 && rk < len(reverse) && reverse[rk] != -1 && x >= n-reverse[rk] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + reverseStart; k <= d-reverseEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && reverse[offset+k-1] < reverse[offset+k+1]) {
+				x = reverse[offset+k+1]
+			} else {
+				x = reverse[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			reverse[offset+k] = x
+			if x > n {
+				reverseEnd += 2
+			} else if y > m {
+				reverseStart += 2
+			} else if !checkForward {
+				if fk := offset + delta - k; fk >= 0 && fk < len(forward) && forward[fk] != -1 && forward[fk] >= n-x {
+					return forward[fk], forward[fk] - (fk - offset), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Keys of the events of both results, as ints so they are cheap to compare
+func diffKeys(old, new []*Event) (oldKeys, newKeys []int) {
+	ids := map[string]int{}
+	keys := func(events []*Event) []int {
+		keys := make([]int, len(events))
+		for i, event := range events {
+			line := eventLine(event)
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			keys[i] = id
+		}
+		return keys
+	}
+	return keys(old), keys(new)
+}
+
+// Single-line description of an event used for diff keys and output
+func eventLine(event *Event) string {
+	switch {
+	case event.Server != nil:
+		return fmt.Sprintf("Event %v - %v", event.Server.ID, event.Server.Type)
+	case event.Client != nil:
+		commands := make([]string, len(event.Client.Commands))
+		for i, command := range event.Client.Commands {
+			commands[i] = command.String()
+		}
+		return "Commands - " + strings.Join(commands, ", ")
+	case event.Code != nil:
+		return fmt.Sprintf("%v - %v:%v (coroutine: %v)", event.Code.Package, filepath.Base(event.Code.File),
+			event.Code.Line, event.Code.Coroutine)
+	case event.Result != nil:
+		return "Workflow " + event.Result.Details()
+	}
+	return ""
+}
+
+// WriteDiffText writes a unified-style view of the diff with the given number
+// of unchanged steps before and after each change.
+func WriteDiffText(w io.Writer, d *Diff, contextLines int) error {
+	if d.FirstDivergence < 0 {
+		_, err := fmt.Fprintln(w, "No differences")
+		return err
+	}
+	var s simpleStringBuilder
+	s.linef("First divergence at step %v", d.FirstDivergence+1)
+	// Mark which steps to show
+	show := make([]bool, len(d.Steps))
+	for i, step := range d.Steps {
+		if step.Op != DiffOpSame {
+			for j := i - contextLines; j <= i+contextLines; j++ {
+				if j >= 0 && j < len(show) {
+					show[j] = true
+				}
+			}
+		}
+	}
+	for i, step := range d.Steps {
+		if !show[i] {
+			continue
+		} else if i == 0 || !show[i-1] {
+			s.linef("@@ step %v @@", i+1)
+		}
+		prefix := " "
+		if step.Op == DiffOpRemoved {
+			prefix = "-"
+		} else if step.Op == DiffOpAdded {
+			prefix = "+"
+		}
+		s.line(prefix + eventLine(step.Event))
+	}
+	_, err := io.WriteString(w, s.String())
+	return err
+}
@@ -0,0 +1,121 @@
+package tracer
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestDiffResults(t *testing.T) {
+	server := func(id int64, typ enums.EventType) *Event {
+		return &Event{Server: &EventServer{ID: id, Type: EventServerType(typ)}}
+	}
+	code := func(dir string, line int) *Event {
+		return &Event{Code: &EventCode{Package: "mypkg", File: dir + "/workflow.go", Line: line, Coroutine: "root"}}
+	}
+	command := func(typ enums.CommandType) *Event {
+		return &Event{Client: &EventClient{Commands: []EventClientCommandType{EventClientCommandType(typ)}}}
+	}
+	old := &Result{Events: []*Event{
+		server(3, enums.EVENT_TYPE_WORKFLOW_TASK_STARTED),
+		code("/old", 10),
+		code("/old", 11),
+		command(enums.COMMAND_TYPE_START_TIMER),
+		server(4, enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED),
+	}}
+
+	// Same except for dirs
+	same := &Result{Events: []*Event{
+		server(3, enums.EVENT_TYPE_WORKFLOW_TASK_STARTED),
+		code("/new", 10),
+		code("/new", 11),
+		command(enums.COMMAND_TYPE_START_TIMER),
+		server(4, enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED),
+	}}
+	d, err := DiffResults(old, same)
+	require.NoError(t, err)
+	require.Equal(t, -1, d.FirstDivergence)
+	require.Len(t, d.Steps, 5)
+
+	// Different line and command
+	changed := &Result{Events: []*Event{
+		server(3, enums.EVENT_TYPE_WORKFLOW_TASK_STARTED),
+		code("/new", 10),
+		code("/new", 12),
+		command(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK),
+		server(4, enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED),
+	}}
+	d, err = DiffResults(old, changed)
+	require.NoError(t, err)
+	require.Equal(t, 2, d.FirstDivergence)
+	var ops []DiffOp
+	for _, step := range d.Steps {
+		ops = append(ops, step.Op)
+	}
+	require.Equal(t, []DiffOp{DiffOpSame, DiffOpSame, DiffOpRemoved, DiffOpRemoved,
+		DiffOpAdded, DiffOpAdded, DiffOpSame}, ops)
+
+	var b bytes.Buffer
+	require.NoError(t, WriteDiffText(&b, d, 1))
+	require.Equal(t, `First divergence at step 3
+@@ step 2 @@
+ mypkg - workflow.go:10 (coroutine: root)
+-mypkg - workflow.go:11 (coroutine: root)
+-Commands - StartTimer
++mypkg - workflow.go:12 (coroutine: root)
++Commands - ScheduleActivityTask
+ Event 4 - WorkflowTaskCompleted
+`, b.String())
+}
+
+func TestDiffOps(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 500; iter++ {
+		a, b := make([]int, rnd.Intn(30)), make([]int, rnd.Intn(30))
+		for i := range a {
+			a[i] = rnd.Intn(4)
+		}
+		for i := range b {
+			b[i] = rnd.Intn(4)
+		}
+		var ops []DiffOp
+		diffOps(a, b, &ops)
+
+		// Ops must cover both sides, only keeping equal elements
+		i, j, same := 0, 0, 0
+		for _, op := range ops {
+			switch op {
+			case DiffOpSame:
+				require.Equal(t, a[i], b[j])
+				i, j, same = i+1, j+1, same+1
+			case DiffOpRemoved:
+				i++
+			case DiffOpAdded:
+				j++
+			}
+		}
+		require.Equal(t, len(a), i)
+		require.Equal(t, len(b), j)
+
+		// And be a shortest edit, i.e. keep a longest common subsequence
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] > lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		require.Equal(t, lcs[0][0], same, "a: %v, b: %v", a, b)
+	}
+}
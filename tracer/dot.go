@@ -0,0 +1,112 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GenerateDOT writes a Graphviz DOT graph of coroutine flow. There is a node
+// for the server and one per coroutine. Edges are added from the coroutine
+// running when another coroutine is first seen (a spawn), between coroutines
+// when control passes from one to another (a switch), from the server to the
+// first coroutine that runs after server events, and from coroutines to the
+// server for the commands they produce. Repeated edges are combined with a
+// count.
+func GenerateDOT(w io.Writer, res *Result) error {
+	const serverNode = "server"
+	var nodes []string
+	nodeLabels := map[string]string{}
+	addNode := func(id, label string) {
+		if _, ok := nodeLabels[id]; !ok {
+			nodes = append(nodes, id)
+			nodeLabels[id] = label
+		}
+	}
+	type edge struct{ from, to, label string }
+	var edges []edge
+	edgeCounts := map[edge]int{}
+	addEdge := func(e edge) {
+		if edgeCounts[e] == 0 {
+			edges = append(edges, e)
+		}
+		edgeCounts[e]++
+	}
+
+	addNode(serverNode, "Server")
+	// Coroutine of the last code event, or empty if there hasn't been one since
+	// the last server event
+	lastCoroutine := ""
+	// Server events since the last code or client event
+	var serverTypes []string
+	for _, event := range res.Events {
+		switch {
+		case event.Server != nil:
+			serverTypes = append(serverTypes, event.Server.Type.String())
+			lastCoroutine = ""
+		case event.Client != nil:
+			commands := make([]string, len(event.Client.Commands))
+			for i, command := range event.Client.Commands {
+				commands[i] = command.String()
+			}
+			from := serverNode
+			if lastCoroutine != "" {
+				from = coroutineNode(lastCoroutine)
+			}
+			addEdge(edge{from, serverNode, strings.Join(commands, "\n")})
+			serverTypes = nil
+		case event.Code != nil:
+			node := coroutineNode(event.Code.Coroutine)
+			_, seen := nodeLabels[node]
+			if !seen {
+				label := event.Code.Coroutine
+				if label == "" {
+					label = "(unknown)"
+				}
+				addNode(node, label)
+			}
+			switch {
+			case lastCoroutine == "" && len(serverTypes) > 0:
+				addEdge(edge{serverNode, node, strings.Join(serverTypes, "\n")})
+				serverTypes = nil
+			case lastCoroutine != "" && lastCoroutine != event.Code.Coroutine && !seen:
+				addEdge(edge{coroutineNode(lastCoroutine), node, "spawn"})
+			case lastCoroutine != "" && lastCoroutine != event.Code.Coroutine:
+				addEdge(edge{coroutineNode(lastCoroutine), node, "switch"})
+			}
+			lastCoroutine = event.Code.Coroutine
+		}
+	}
+
+	var s simpleStringBuilder
+	s.line("digraph coroutines {")
+	s.line("  rankdir=LR;")
+	s.line("  node [shape=box];")
+	for _, node := range nodes {
+		shape := ""
+		if node == serverNode {
+			shape = ", shape=ellipse"
+		}
+		s.linef("  %v [label=%v%v];", dotQuote(node), dotQuote(nodeLabels[node]), shape)
+	}
+	for _, e := range edges {
+		label := e.label
+		if count := edgeCounts[e]; count > 1 {
+			label += fmt.Sprintf("\n(x%v)", count)
+		}
+		s.linef("  %v -> %v [label=%v];", dotQuote(e.from), dotQuote(e.to), dotQuote(label))
+	}
+	s.line("}")
+	_, err := io.WriteString(w, s.String())
+	return err
+}
+
+// Coroutine names are prefixed so they cannot collide with the server node
+func coroutineNode(coroutine string) string { return "coroutine:" + coroutine }
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
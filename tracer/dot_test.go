@@ -0,0 +1,39 @@
+package tracer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestGenerateDOT(t *testing.T) {
+	code := func(coroutine string, line int) *Event {
+		return &Event{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: line, Coroutine: coroutine}}
+	}
+	var b bytes.Buffer
+	require.NoError(t, GenerateDOT(&b, &Result{Events: []*Event{
+		{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED)}},
+		{Server: &EventServer{ID: 3, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}},
+		code("root", 10),
+		code(`my "coroutine"`, 20),
+		code("root", 11),
+		code(`my "coroutine"`, 21),
+		code("root", 12),
+		{Client: &EventClient{Commands: []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_START_TIMER)}}},
+	}}))
+	require.Equal(t, `digraph coroutines {
+  rankdir=LR;
+  node [shape=box];
+  "server" [label="Server", shape=ellipse];
+  "coroutine:root" [label="root"];
+  "coroutine:my \"coroutine\"" [label="my \"coroutine\""];
+  "server" -> "coroutine:root" [label="WorkflowExecutionStarted\nWorkflowTaskStarted"];
+  "coroutine:root" -> "coroutine:my \"coroutine\"" [label="spawn"];
+  "coroutine:my \"coroutine\"" -> "coroutine:root" [label="switch\n(x2)"];
+  "coroutine:root" -> "coroutine:my \"coroutine\"" [label="switch"];
+  "coroutine:root" -> "server" [label="StartTimer"];
+}
+`, b.String())
+}
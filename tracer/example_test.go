@@ -0,0 +1,47 @@
+package tracer_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/workflow"
+)
+
+// Traces an execution from another program, printing events as they stream
+// and then the summary of the result.
+func Example() {
+	tr, err := tracer.New(tracer.Config{
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+		WorkflowFuncs: []string{"example.com/myapp/workflows.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: "my-workflow-id"},
+		// Where the harness is generated, must be in the module of the workflow
+		RootDir: ".",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Stream events while tracing, the channel is closed when Trace returns
+	events := tr.Events()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			if event.Code != nil {
+				fmt.Printf("%v:%v (%v)\n", event.Code.File, event.Code.Line, event.Code.Coroutine)
+			} else if event.Server != nil {
+				fmt.Printf("Server event %v: %v\n", event.Server.ID, event.Server.Type)
+			}
+		}
+	}()
+
+	res, err := tr.Trace(context.Background())
+	<-done
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Recorded %v events\n", len(res.Events))
+}
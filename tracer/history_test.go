@@ -0,0 +1,198 @@
+package tracer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/history/v1"
+	"go.temporal.io/sdk/client"
+)
+
+func TestLoadGzippedHistory(t *testing.T) {
+	// Copy fixture without the extension so the magic header is what's sniffed
+	b, err := os.ReadFile("testdata/history.json.gz")
+	require.NoError(t, err)
+	noExt := filepath.Join(t.TempDir(), "history")
+	require.NoError(t, os.WriteFile(noExt, b, 0644))
+
+	for _, file := range []string{"testdata/history.json.gz", noExt} {
+		tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: file})
+		require.NoError(t, err)
+		hist, err := tr.loadHistory(context.Background())
+		require.NoError(t, err)
+		require.Len(t, hist.Events, 2)
+		require.Equal(t, enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED, hist.Events[0].EventType)
+		require.Equal(t, enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED, hist.Events[1].EventType)
+	}
+}
+
+func TestBuildReplayMainCodeGzippedHistory(t *testing.T) {
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "testdata/history.json.gz",
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+	})
+	require.NoError(t, err)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), "gzip.NewReader(f)")
+	require.NotContains(t, string(source), "ReplayWorkflowHistoryFromJSONFile")
+}
+
+func TestLoadHistoryFormats(t *testing.T) {
+	expected := &history.History{Events: []*history.HistoryEvent{
+		{EventId: 1, EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED},
+		{EventId: 2, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED},
+	}}
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "history.json")
+	j, err := (&jsonpb.Marshaler{}).MarshalToString(expected)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(jsonFile, []byte("\n  "+j), 0644))
+	protoFile := filepath.Join(dir, "history.pb")
+	b, err := expected.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(protoFile, b, 0644))
+
+	for _, test := range []struct {
+		file   string
+		format HistoryFormat
+	}{
+		{jsonFile, HistoryFormatAuto},
+		{jsonFile, HistoryFormatJSON},
+		{protoFile, HistoryFormatAuto},
+		{protoFile, HistoryFormatProto},
+	} {
+		tr, err := New(Config{
+			WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+			HistoryFile:   test.file,
+			HistoryFormat: test.format,
+			ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+		})
+		require.NoError(t, err)
+		hist, err := tr.loadHistory(context.Background())
+		require.NoError(t, err)
+		require.True(t, expected.Equal(hist), test.file)
+		// Generated code for proto must unmarshal the proto
+		if test.file == protoFile {
+			source, err := tr.buildReplayMainCode()
+			require.NoError(t, err)
+			require.Contains(t, string(source), "hist.Unmarshal(b)")
+		}
+	}
+
+	// Wrong explicit format fails
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   protoFile,
+		HistoryFormat: HistoryFormatJSON,
+	})
+	require.NoError(t, err)
+	_, err = tr.loadHistory(context.Background())
+	require.Error(t, err)
+}
+
+func TestLoadStdinHistory(t *testing.T) {
+	b, err := os.ReadFile("testdata/history.json.gz")
+	require.NoError(t, err)
+	tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "-"})
+	require.NoError(t, err)
+	// Simulate already-buffered stdin
+	tr.stdinHistory = b
+	hist, err := tr.loadHistory(context.Background())
+	require.NoError(t, err)
+	require.Len(t, hist.Events, 2)
+}
+
+func TestTrimHistory(t *testing.T) {
+	hist := &history.History{Events: []*history.HistoryEvent{
+		{EventId: 1, EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED},
+		{EventId: 2, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED},
+		{EventId: 3, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_STARTED},
+		{EventId: 4, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED},
+		{EventId: 5, EventType: enums.EVENT_TYPE_TIMER_STARTED},
+	}}
+	trimmed, err := trimHistory(hist, 4)
+	require.NoError(t, err)
+	require.Equal(t, hist.Events[:4], trimmed.Events)
+	require.Len(t, hist.Events, 5)
+	_, err = trimHistory(hist, 2)
+	require.EqualError(t, err, "end event ID 2 is before the first workflow task started event")
+
+	// The replayer reads the trimmed history even for a history file
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "history.json",
+		EndEventID:    4,
+	})
+	require.NoError(t, err)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), `os.ReadFile("`+fetchedHistoryFileName+`")`)
+	require.NotContains(t, string(source), "history.json")
+}
+
+func TestCheckTaskBoundary(t *testing.T) {
+	hist := &history.History{Events: []*history.HistoryEvent{
+		{EventId: 1, EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED},
+		{EventId: 2, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED},
+		{EventId: 3, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_STARTED},
+		{EventId: 4, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED},
+	}}
+	require.NoError(t, checkTaskBoundary(hist, 4))
+	require.EqualError(t, checkTaskBoundary(hist, 3),
+		"replay until event 3 is WorkflowTaskStarted, not a workflow task completed event")
+	require.EqualError(t, checkTaskBoundary(hist, 5), "replay until event 5 not found in history")
+}
+
+func TestDetectWorkflowTypeName(t *testing.T) {
+	hist := &history.History{Events: []*history.HistoryEvent{{
+		EventId:   1,
+		EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED,
+		Attributes: &history.HistoryEvent_WorkflowExecutionStartedEventAttributes{
+			WorkflowExecutionStartedEventAttributes: &history.WorkflowExecutionStartedEventAttributes{
+				WorkflowType: &common.WorkflowType{Name: "my-workflow"},
+			},
+		},
+	}}}
+	require.Equal(t, "my-workflow", historyWorkflowType(hist))
+	require.Empty(t, historyWorkflowType(&history.History{}))
+	historyFile := filepath.Join(t.TempDir(), "history.pb")
+	b, err := hist.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(historyFile, b, 0644))
+
+	// Differing type name is registered
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: historyFile}
+	tr, err := New(config)
+	require.NoError(t, err)
+	tr.detectWorkflowTypeName(context.Background())
+	require.Equal(t, "my-workflow", tr.detectedTypeName)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source),
+		`replayer.RegisterWorkflowWithOptions(fnpkg0.MyWorkflow, workflow.RegisterOptions{Name: "my-workflow"})`)
+
+	// Not when explicitly given or the function name already matches
+	config.WorkflowTypeName = "other-workflow"
+	tr, err = New(config)
+	require.NoError(t, err)
+	tr.detectWorkflowTypeName(context.Background())
+	require.Empty(t, tr.detectedTypeName)
+	require.Equal(t, "other-workflow", tr.registerName())
+	config.WorkflowTypeName = ""
+	hist.Events[0].GetWorkflowExecutionStartedEventAttributes().WorkflowType.Name = "MyWorkflow"
+	b, err = hist.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(historyFile, b, 0644))
+	tr, err = New(config)
+	require.NoError(t, err)
+	tr.detectWorkflowTypeName(context.Background())
+	require.Empty(t, tr.detectedTypeName)
+}
@@ -1,47 +1,112 @@
 package tracer
 
 import (
+	"bytes"
 	"context"
+	"embed"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 
 	"github.com/gogo/protobuf/jsonpb"
-	"go.temporal.io/api/enums/v1"
-	"go.temporal.io/api/history/v1"
-	"go.temporal.io/sdk/client"
 )
 
 type HTMLGeneratorAnnotated struct {
 	RetainTempDir bool
+	// Next project dir to build in. It must be configured for MDX with Code
+	// Hike and have a style.scss like the html_annotated_proj dir in this
+	// package. If unset, an embedded copy of that dir is extracted to the user
+	// cache dir and used.
+	ProjectDir string
+	// If true, only trace.mdx is written to the output dir and Node is not
+	// used. See the README for building it separately.
+	EmitMDXOnly bool
 }
 
-var htmlAnnotatedProjDir string
+//go:embed html_annotated_proj/next.config.js html_annotated_proj/package.json
+//go:embed html_annotated_proj/package-lock.json html_annotated_proj/style.scss
+var htmlAnnotatedProjFS embed.FS
 
-func init() {
-	_, currFile, _, _ := runtime.Caller(0)
-	htmlAnnotatedProjDir = filepath.Join(currFile, "..", "html_annotated_proj")
+// Gets ProjectDir if set, otherwise extracts the embedded project to the user
+// cache dir. Files are only written if changed and node_modules is removed if
+// the package files changed so it is reinstalled.
+func (h *HTMLGeneratorAnnotated) projectDir() (string, error) {
+	if h.ProjectDir != "" {
+		return h.ProjectDir, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed getting user cache dir: %w", err)
+	}
+	dir := filepath.Join(cacheDir, "temporal-debug-go", "html_annotated_proj")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed creating dir %v: %w", dir, err)
+	}
+	entries, err := htmlAnnotatedProjFS.ReadDir("html_annotated_proj")
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		b, err := htmlAnnotatedProjFS.ReadFile("html_annotated_proj/" + entry.Name())
+		if err != nil {
+			return "", err
+		}
+		file := filepath.Join(dir, entry.Name())
+		if existing, err := os.ReadFile(file); err == nil && bytes.Equal(existing, b) {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), "package") {
+			if err := os.RemoveAll(filepath.Join(dir, "node_modules")); err != nil {
+				return "", fmt.Errorf("failed removing stale node_modules: %w", err)
+			}
+		}
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			return "", fmt.Errorf("failed writing %v: %w", file, err)
+		}
+	}
+	return dir, nil
 }
 
+// GenerateHTML generates the annotated HTML. If Node or NPM are not on the
+// PATH, this falls back to HTMLGeneratorSimpleLinear with a warning. If
+// EmitMDXOnly is set, only the MDX is written.
 func (h *HTMLGeneratorAnnotated) GenerateHTML(ctx context.Context, t *Tracer, outDir string, res *Result) error {
+	if h.EmitMDXOnly {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return fmt.Errorf("failed creating dir %v: %w", outDir, err)
+		}
+		return h.writeMDX(ctx, t, outDir, res)
+	}
+
+	// Fall back to simple linear if Node tools are not present
+	for _, exe := range []string{"node", "npm"} {
+		if _, err := exec.LookPath(exe); err != nil {
+			t.Log.Warn("Annotated HTML requires Node and NPM, falling back to simple-linear HTML", "Missing", exe)
+			return HTMLGeneratorSimpleLinear{}.GenerateHTML(ctx, t, outDir, res)
+		}
+	}
+
 	// Run NPM in annotated proj dir if no node_modules
-	if _, err := os.Stat(filepath.Join(htmlAnnotatedProjDir, "node_modules")); os.IsNotExist(err) {
-		t.Log.Debug("Running NPM install", "Dir", htmlAnnotatedProjDir)
+	projDir, err := h.projectDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(projDir, "node_modules")); os.IsNotExist(err) {
+		t.Log.Debug("Running NPM install", "Dir", projDir)
 		cmd := exec.CommandContext(ctx, "npm", "install")
 		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-		cmd.Dir = htmlAnnotatedProjDir
+		cmd.Dir = projDir
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("npm install failed: %w", err)
 		}
 	}
 
 	// Create temp dir
-	tmpDir, err := os.MkdirTemp(htmlAnnotatedProjDir, "temp-app-")
+	tmpDir, err := os.MkdirTemp(projDir, "temp-app-")
 	if err != nil {
 		return fmt.Errorf("failed creating temp dir: %w", err)
 	}
@@ -95,7 +160,7 @@ export default function Page() {
 	t.Log.Debug("Running Next build", "Dir", tmpDir)
 	cmd := exec.CommandContext(ctx, "npm", "run", "next", "--", "build", filepath.Base(tmpDir))
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	cmd.Dir = htmlAnnotatedProjDir
+	cmd.Dir = projDir
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("next build failed: %w", err)
 	}
@@ -111,7 +176,7 @@ export default function Page() {
 	}
 	cmd = exec.CommandContext(ctx, "npm", "run", "next", "--", "export", "-o", ourDirAbs, filepath.Base(tmpDir))
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	cmd.Dir = htmlAnnotatedProjDir
+	cmd.Dir = projDir
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("next export failed: %w", err)
 	}
@@ -138,7 +203,7 @@ func (h *HTMLGeneratorAnnotated) writeMDX(ctx context.Context, t *Tracer, dir st
 	s.line("<CH.Scrollycoding>").line()
 
 	// Load the history and convert to indented JSON
-	hist, err := h.loadHistory(ctx, t)
+	hist, err := t.loadHistory(ctx)
 	if err != nil {
 		return err
 	}
@@ -160,6 +225,12 @@ func (h *HTMLGeneratorAnnotated) writeMDX(ctx context.Context, t *Tracer, dir st
 		case event.Server != nil:
 			// Put the event as a heading
 			s.linef("### %v", event.Server.Type).line()
+			if details := event.Server.Details(); details != "" {
+				s.linef("%v", details).line()
+			}
+			if event.Server.Note != "" {
+				s.linef("_%v_", event.Server.Note).line()
+			}
 			focus := ""
 			// Find the event ID in the history JSON
 			eventIDIndex := strings.Index(histJSON, "\n      \"eventId\": \""+strconv.FormatInt(event.Server.ID, 10)+`"`)
@@ -195,6 +266,9 @@ func (h *HTMLGeneratorAnnotated) writeMDX(ctx context.Context, t *Tracer, dir st
 			commandStrs := make([]string, len(event.Client.Commands))
 			for i, c := range event.Client.Commands {
 				commandStrs[i] = c.String()
+				if details := event.Client.CommandDetails(i); details != "" {
+					commandStrs[i] += " (" + details + ")"
+				}
 			}
 			commandsJSON, err := json.MarshalIndent(map[string][]string{"commands": commandStrs}, "", "  ")
 			if err != nil {
@@ -202,6 +276,10 @@ func (h *HTMLGeneratorAnnotated) writeMDX(ctx context.Context, t *Tracer, dir st
 			}
 			s.line("```json commands.json").line(string(commandsJSON)).line("```").line()
 
+		case event.Result != nil:
+			s.line("### Workflow result").line()
+			s.linef("%v", event.Result.Details()).line()
+
 		case event.Code != nil:
 			// Get line numbers for all subsequent code events that have the same
 			// file, coroutine, and increasing line
@@ -245,39 +323,6 @@ func (h *HTMLGeneratorAnnotated) writeMDX(ctx context.Context, t *Tracer, dir st
 	return os.WriteFile(filepath.Join(dir, "trace.mdx"), []byte(s.String()), 0644)
 }
 
-func (h *HTMLGeneratorAnnotated) loadHistory(ctx context.Context, t *Tracer) (*history.History, error) {
-	// If the history file is present, unmarshal from it. Otherwise load from
-	// execution.
-	var hist history.History
-	if t.HistoryFile != "" {
-		if b, err := os.ReadFile(t.HistoryFile); err != nil {
-			return nil, fmt.Errorf("failed loading history file: %w", err)
-		} else if err = jsonpb.UnmarshalString(string(b), &hist); err != nil {
-			return nil, fmt.Errorf("failed unmarshaling history file: %w", err)
-		}
-	} else if t.Execution != nil {
-		// We have to connect to server to obtain history
-		c, err := client.NewClient(t.ClientOptions)
-		if err != nil {
-			return nil, fmt.Errorf("failed connecting to server: %w", err)
-		}
-		defer c.Close()
-
-		// Iterate and build events
-		iter := c.GetWorkflowHistory(ctx, t.Execution.ID, t.Execution.RunID, false, enums.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
-		for iter.HasNext() {
-			event, err := iter.Next()
-			if err != nil {
-				return nil, fmt.Errorf("failed fetching history: %w", err)
-			}
-			hist.Events = append(hist.Events, event)
-		}
-	} else {
-		return nil, fmt.Errorf("must have execution or history file")
-	}
-	return &hist, nil
-}
-
 type simpleStringBuilder struct{ strings.Builder }
 
 func (s *simpleStringBuilder) linef(f string, v ...interface{}) *simpleStringBuilder {
@@ -0,0 +1,61 @@
+package tracer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestHTMLGeneratorAnnotatedEmitMDXOnly(t *testing.T) {
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "testdata/history.json.gz",
+	})
+	require.NoError(t, err)
+	outDir := filepath.Join(t.TempDir(), "out")
+	err = (&HTMLGeneratorAnnotated{EmitMDXOnly: true}).GenerateHTML(context.Background(), tr, outDir, &Result{
+		Events: []*Event{{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED)}}},
+	})
+	require.NoError(t, err)
+	entries, err := os.ReadDir(outDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	b, err := os.ReadFile(filepath.Join(outDir, "trace.mdx"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "### WorkflowExecutionStarted")
+	require.Contains(t, string(b), "<CH.Scrollycoding>")
+}
+
+func TestHTMLGeneratorAnnotatedProjectDir(t *testing.T) {
+	// Explicit dir is used as is
+	dir, err := (&HTMLGeneratorAnnotated{ProjectDir: "my-proj"}).projectDir()
+	require.NoError(t, err)
+	require.Equal(t, "my-proj", dir)
+
+	// Otherwise embedded project is extracted to the cache dir
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	t.Setenv("HOME", cacheDir)
+	dir, err = (&HTMLGeneratorAnnotated{}).projectDir()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(dir, cacheDir))
+	for _, name := range []string{"next.config.js", "package.json", "package-lock.json", "style.scss"} {
+		require.FileExists(t, filepath.Join(dir, name))
+	}
+
+	// Existing node_modules kept if unchanged, removed if package files change
+	nodeModules := filepath.Join(dir, "node_modules")
+	require.NoError(t, os.Mkdir(nodeModules, 0755))
+	_, err = (&HTMLGeneratorAnnotated{}).projectDir()
+	require.NoError(t, err)
+	require.DirExists(t, nodeModules)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644))
+	_, err = (&HTMLGeneratorAnnotated{}).projectDir()
+	require.NoError(t, err)
+	require.NoDirExists(t, nodeModules)
+}
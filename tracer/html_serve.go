@@ -0,0 +1,44 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// ServeHTML serves the HTML output dir over HTTP at the given address until
+// interrupted. Serving avoids the restrictions browsers place on iframes and
+// relative paths for pages opened from file:// URLs.
+func ServeHTML(dir string, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed listening on %v: %w", addr, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return serveHTML(ctx, ln, dir)
+}
+
+func serveHTML(ctx context.Context, ln net.Listener, dir string) error {
+	srv := &http.Server{Handler: http.FileServer(http.Dir(dir))}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ln) }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed shutting down server: %w", err)
+	} else if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
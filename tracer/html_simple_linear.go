@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"html"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -16,14 +17,29 @@ import (
 	chromahtml "github.com/alecthomas/chroma/formatters/html"
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/alecthomas/chroma/styles"
+	"github.com/gogo/protobuf/jsonpb"
 )
 
-type HTMLGeneratorSimpleLinear struct{}
+type HTMLGeneratorSimpleLinear struct {
+	// Lines of source shown before and after the lines of each code step.
+	// Default is 2, use a negative value for none.
+	ContextLines int
+}
+
+const defaultHTMLContextLines = 2
 
 func (h HTMLGeneratorSimpleLinear) GenerateHTML(ctx context.Context, t *Tracer, dir string, res *Result) error {
 	// Create all the source HTML files and keep map of file path to html path
+	sources := newSourceCache(t.SourceCacheMaxBytes)
 	var p simplePage
 	p.sources = map[string]string{}
+	p.style = t.HTMLStyle
+	p.contextLines = h.ContextLines
+	if p.contextLines == 0 {
+		p.contextLines = defaultHTMLContextLines
+	} else if p.contextLines < 0 {
+		p.contextLines = 0
+	}
 	for _, event := range res.Events {
 		if event.Code != nil && p.sources[event.Code.File] == "" {
 			relFile := path.Join("sources",
@@ -35,29 +51,88 @@ func (h HTMLGeneratorSimpleLinear) GenerateHTML(ctx context.Context, t *Tracer,
 				return fmt.Errorf("failed creating dir %v: %w", filepath.Dir(absFile), err)
 			}
 			// Write
-			if err := h.writeGoHTMLFile(event.Code.File, absFile); err != nil {
+			if err := h.writeGoHTMLFile(sources, event.Code.File, absFile, p.style, p.contextLines); err != nil {
 				return err
 			}
 			p.sources[event.Code.File] = relFile
 		}
 	}
 
+	// Write the history alongside to cross-reference server events
+	if t.HistoryFile != "" || t.Execution != nil || t.fetchedHistory != nil {
+		if err := writeHistoryJSON(ctx, t, filepath.Join(dir, simpleHistoryFile)); err != nil {
+			return err
+		}
+		p.historyFile = simpleHistoryFile
+	}
+
 	// Build index page
 	p.h("<!DOCTYPE html>")
 	p.h("<html>")
 	p.h("<head>")
 	p.indent()
 	p.h(`<meta charset="utf-8">`)
+	p.h("<script>", htmlFitFrameScript, "</script>")
+	p.h("<style>", htmlBodyCSS(p.style), "</style>")
+	p.title(t)
+	p.dedent()
+	p.h("</head>")
+	p.h("<body>")
+	p.indent()
+	p.executionHeader(t)
+
+	// Anchor each code step so commands and server events can link to the
+	// code that caused them
+	groups := groupEvents(res.Events)
+	p.anchors = map[*Event]string{}
+	for i, events := range groups {
+		for _, event := range events {
+			if event.Code != nil {
+				p.anchors[event] = "step-" + strconv.Itoa(i)
+			}
+		}
+	}
+	p.commandSources = correlateCommands(res.Events, sources.line)
+
+	// Iterate events, keeping like events together
+	for _, events := range groups {
+		p.eventSet(events)
+	}
+	p.dedent()
+	p.h("</body>")
+	p.h("</html>")
+
+	// Write index page
+	return os.WriteFile(filepath.Join(dir, "index.html"), p.Bytes(), 0644)
+}
+
+const simpleHistoryFile = "history.json"
+
+func writeHistoryJSON(ctx context.Context, t *Tracer, file string) error {
+	hist, err := t.loadHistory(ctx)
+	if err != nil {
+		return err
+	}
+	histJSON, err := (&jsonpb.Marshaler{Indent: "  "}).MarshalToString(hist)
+	if err != nil {
+		return fmt.Errorf("failed marshaling history: %w", err)
+	} else if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed creating dir %v: %w", filepath.Dir(file), err)
+	} else if err := os.WriteFile(file, []byte(histJSON), 0644); err != nil {
+		return fmt.Errorf("failed writing %v: %w", file, err)
+	}
+	return nil
+}
+
+func (p *simplePage) title(t *Tracer) {
 	if t.Execution != nil {
 		p.h("<title>", "Workflow ", esc(t.Execution.ID), "</title>")
 	} else if t.HistoryFile != "" {
 		p.h("<title>", "History ", esc(t.HistoryFile), "</title>")
 	}
-	p.dedent()
-	p.h("</head>")
-	p.h("<body>")
-	p.indent()
-	// Header
+}
+
+func (p *simplePage) executionHeader(t *Tracer) {
 	p.h("<div>")
 	p.indent()
 	p.h("<h1>Workflow Execution</h1>")
@@ -69,54 +144,28 @@ func (h HTMLGeneratorSimpleLinear) GenerateHTML(ctx context.Context, t *Tracer,
 	} else if t.HistoryFile != "" {
 		p.h("<strong>History: </strong>", esc(t.HistoryFile), "<br />")
 	}
-	p.h("<strong>Entry Function: </strong>", t.fnPkg, " - ", t.fn)
-	p.dedent()
-	p.h("</div>")
-
-	// Iterate events, keeping like events together
-	var pendingEvents []*Event
-	for _, event := range res.Events {
-		// See if we need to flush pending events
-		needsFlush := len(pendingEvents) > 0
-		if needsFlush {
-			lastEvent := pendingEvents[len(pendingEvents)-1]
-			needsFlush = (lastEvent.Server != nil && event.Server == nil) ||
-				(lastEvent.Client != nil && event.Client == nil) ||
-				(lastEvent.Code != nil && event.Code == nil)
-			// If we think we don't need flush due to code, make sure it's an
-			// increasing line number of the same file and same coroutine
-			if !needsFlush && lastEvent.Code != nil {
-				needsFlush = lastEvent.Code.File != event.Code.File ||
-					lastEvent.Code.Line > event.Code.Line ||
-					lastEvent.Code.Coroutine != event.Code.Coroutine
-			}
-		}
-		if needsFlush {
-			p.eventSet(pendingEvents)
-			pendingEvents = pendingEvents[:0]
-		}
-		pendingEvents = append(pendingEvents, event)
+	for _, fn := range t.fns {
+		p.h("<strong>Entry Function: </strong>", esc(fn.pkg), " - ", esc(strings.TrimPrefix(fn.qualified, fn.pkg+".")), "<br />")
 	}
-	if len(pendingEvents) > 0 {
-		p.eventSet(pendingEvents)
+	if p.historyFile != "" {
+		p.h(`<strong>History JSON: </strong><a href="`, esc(p.historyFile), `" download>`, esc(p.historyFile), "</a><br />")
 	}
 	p.dedent()
-	p.h("</body>")
-	p.h("</html>")
-
-	// Write index page
-	return os.WriteFile(filepath.Join(dir, "index.html"), p.Bytes(), 0644)
+	p.h("</div>")
 }
 
-func (HTMLGeneratorSimpleLinear) writeGoHTMLFile(sourceFile, targetFile string) error {
+func (HTMLGeneratorSimpleLinear) writeGoHTMLFile(
+	sources *sourceCache,
+	sourceFile, targetFile, style string,
+	contextLines int,
+) error {
 	// Read source
-	source, err := os.ReadFile(sourceFile)
+	source, err := sources.get(sourceFile)
 	if err != nil {
-		return fmt.Errorf("failed reading %v: %w", sourceFile, err)
+		return err
 	}
 
 	// Format
-	lexer := chroma.Coalesce(lexers.Get("go"))
 	formatter := chromahtml.New(
 		chromahtml.Standalone(true),
 		chromahtml.WithClasses(true),
@@ -124,19 +173,28 @@ func (HTMLGeneratorSimpleLinear) writeGoHTMLFile(sourceFile, targetFile string)
 		chromahtml.LinkableLineNumbers(true, ""),
 		// We want to act like the entire file is highlighted to get proper wrapping
 		// of spans
-		chromahtml.HighlightLines([][2]int{{1, bytes.Count(source, []byte{'\n'})}}),
+		chromahtml.HighlightLines([][2]int{{1, strings.Count(source, "\n")}}),
 	)
-	style := styles.Get("github")
-	iter, err := lexer.Tokenise(nil, string(source))
+	iter, err := tokeniseGo(source)
 	if err != nil {
 		return err
 	}
 	var target bytes.Buffer
-	if err := formatter.Format(&target, style, iter); err != nil {
+	if err := formatter.Format(&target, htmlChromaStyle(style), iter); err != nil {
 		return err
 	}
 	b := target.Bytes()
 
+	// Add the dark style if using the default
+	if style == "" {
+		var css bytes.Buffer
+		if err := formatter.WriteCSS(&css, styles.Get(htmlDarkStyle)); err != nil {
+			return err
+		}
+		b = bytes.Replace(b, []byte("<body"), []byte("<style>@media (prefers-color-scheme: dark) {\n"+
+			css.String()+"}</style><body"), 1)
+	}
+
 	// Remove the target highlight
 	b = regexp.MustCompile(`/\* LineNumbers.* targeted.*\n`).ReplaceAll(b, nil)
 	// Remove the highlight class from all lines
@@ -150,10 +208,10 @@ func (HTMLGeneratorSimpleLinear) writeGoHTMLFile(sourceFile, targetFile string)
   lines.forEach(v => document.getElementById(v).parentElement.classList.add('hl'))
 
   // Due to chrome scrolling the parent when using an anchor, we instead just
-  // manually scroll to two before the given line
+  // manually scroll to the context lines before the given line
   if (lines.length > 0) {
     setTimeout(() =>
-      scroll({ top: document.getElementById('' + Math.max(1, parseInt(lines[0], 10) - 2)).offsetTop }), 1)
+      scroll({ top: document.getElementById('' + Math.max(1, parseInt(lines[0], 10) - `+strconv.Itoa(contextLines)+`)).offsetTop }), 1)
   }
 </script>
 </body>`))
@@ -162,10 +220,121 @@ func (HTMLGeneratorSimpleLinear) writeGoHTMLFile(sourceFile, targetFile string)
 	return os.WriteFile(targetFile, b, 0644)
 }
 
+// RenderCodeEventHTML renders the source around the given code event as an
+// HTML snippet with contextLines lines before and after it. Classes are used
+// instead of inline styles and the event's line has the "hl" class.
+func RenderCodeEventHTML(ev *EventCode, contextLines int) ([]byte, error) {
+	lines, err := newSourceCache(0).tokenLines(ev.File)
+	if err != nil {
+		return nil, err
+	} else if ev.Line < 1 || ev.Line > len(lines) {
+		return nil, fmt.Errorf("line %v not in %v", ev.Line, ev.File)
+	}
+	var b bytes.Buffer
+	err = formatGoLinesHTML(&b, lines, ev.Line-contextLines, ev.Line+contextLines, [][2]int{{ev.Line, ev.Line}})
+	return b.Bytes(), err
+}
+
+// Formats the given range of lines with classes instead of inline styles. The
+// range is clamped to the lines that exist and nothing is written if none do.
+// Highlight ranges are by line number, not relative to the start line.
+func formatGoLinesHTML(w io.Writer, lines [][]chroma.Token, startLine, endLine int, hl [][2]int) error {
+	if startLine < 1 {
+		startLine = 1
+	}
+	if endLine > len(lines) {
+		endLine = len(lines)
+	}
+	if startLine > endLine {
+		return nil
+	}
+	var tokens []chroma.Token
+	for _, line := range lines[startLine-1 : endLine] {
+		tokens = append(tokens, line...)
+	}
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.BaseLineNumber(startLine),
+		chromahtml.HighlightLines(hl),
+	)
+	// The style is irrelevant since classes are used
+	return formatter.Format(w, styles.Get(htmlLightStyle), chroma.Literator(tokens...))
+}
+
+// Chroma styles used when Config.HTMLStyle is not set, switching on the
+// browser's preferred color scheme
+const (
+	htmlLightStyle = "github"
+	htmlDarkStyle  = "monokai"
+)
+
+func htmlChromaStyle(style string) *chroma.Style {
+	if style == "" {
+		return styles.Get(htmlLightStyle)
+	}
+	return styles.Get(style)
+}
+
+// CSS for the index page to match the background and text colors of the
+// style, or of both default styles if unset
+func htmlBodyCSS(style string) string {
+	bodyCSS := func(style *chroma.Style) string {
+		var css []string
+		entry := style.Get(chroma.Background)
+		if entry.Background.IsSet() {
+			css = append(css, "background-color: "+entry.Background.String()+";")
+		}
+		if entry.Colour.IsSet() {
+			css = append(css, "color: "+entry.Colour.String()+";")
+		}
+		return "body { " + strings.Join(css, " ") + " }"
+	}
+	if style != "" {
+		return bodyCSS(styles.Get(style))
+	}
+	return bodyCSS(styles.Get(htmlLightStyle)) +
+		" @media (prefers-color-scheme: dark) { " + bodyCSS(styles.Get(htmlDarkStyle)) + " }"
+}
+
+// Pixels per source line used for iframe height when it cannot be fit
+const htmlFallbackLineHeight = 16
+
+// Sets the iframe height to exactly fit the given source lines. Line elements
+// have the line number as their ID. The end line may be past the end of the
+// file so we walk back to the last line that exists.
+const htmlFitFrameScript = `
+function fitFrame(frame, startLine, endLine) {
+  try {
+    const doc = frame.contentDocument
+    const first = doc.getElementById('' + startLine)
+    let last = null
+    for (let i = endLine; i >= startLine && !last; i--) last = doc.getElementById('' + i)
+    if (!first || !last) return
+    const top = first.parentElement.offsetTop
+    const bottom = last.parentElement.offsetTop + last.parentElement.offsetHeight
+    frame.height = bottom - top
+  } catch (e) {
+    // Keep the fallback height
+  }
+}
+`
+
+func tokeniseGo(source string) (chroma.Iterator, error) {
+	return chroma.Coalesce(lexers.Get("go")).Tokenise(nil, source)
+}
+
 type simplePage struct {
 	bytes.Buffer
-	indentStr string
-	sources   map[string]string
+	indentStr    string
+	sources      map[string]string
+	style        string
+	contextLines int
+	// Relative path of the history JSON, empty if not written
+	historyFile string
+	// Anchor ID of the step for each code event, nil if not linking
+	anchors        map[*Event]string
+	commandSources *commandSources
 }
 
 func (p *simplePage) h(v ...interface{}) {
@@ -185,47 +354,107 @@ func (p *simplePage) dedent() {
 }
 
 func (p *simplePage) eventSet(events []*Event) {
-	p.h("<hr />")
-	// Handle if server or client
+	if anchor := p.anchors[events[0]]; anchor != "" {
+		p.h(`<hr id="`, anchor, `" />`)
+	} else {
+		p.h("<hr />")
+	}
+	if events[0].Code == nil {
+		p.nonCodeEventSet(events)
+		return
+	}
+
+	// Now we know it's a code event, collect lines to highlight
+	var hl []string
+	for _, event := range events {
+		hl = append(hl, strconv.Itoa(event.Code.Line))
+	}
+	src := p.sources[events[0].Code.File] + "?hl=" + strings.Join(hl, ",")
+	p.h("<strong>Code: </strong>", esc(events[0].Code.Package), ` - <a href="`,
+		esc(src), `">`, esc(filepath.Base(events[0].Code.File)), "</a>",
+		" (coroutine: ", esc(events[0].Code.Coroutine), ")", stackHoverHTML(events[0].Code.Stack), "<br />")
+	// Show the context lines before and after, but not before the first line
+	startLine := events[0].Code.Line - p.contextLines
+	if startLine < 1 {
+		startLine = 1
+	}
+	endLine := events[len(events)-1].Code.Line + p.contextLines
+	// The height is fit to the lines once loaded, but this is used if the
+	// browser does not allow access to the frame (e.g. Chrome with file URLs)
+	height := (endLine - startLine + 1) * htmlFallbackLineHeight
+	// Build URL for iframe
+	p.h(`<iframe height="`, height, `" src="`, esc(src), `" onload="fitFrame(this, `, startLine, ", ", endLine,
+		`)" frameborder="0" style="width: 100%"></iframe>`)
+}
+
+// Collapsed stack that shows its frames on hover, or empty if no stack
+func stackHoverHTML(stack []StackFrame) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	frames := make([]string, len(stack))
+	for i, frame := range stack {
+		frames[i] = fmt.Sprintf("%v (%v:%v)", frame.Function, filepath.Base(frame.File), frame.Line)
+	}
+	return ` <span title="` + esc(strings.Join(frames, "\n")) +
+		`" style="cursor: help; text-decoration: underline dotted">[stack]</span>`
+}
+
+// Writes the list of server events or client commands
+func (p *simplePage) nonCodeEventSet(events []*Event) {
 	if events[0].Server != nil {
 		p.h("<strong>Events from server:</strong><br />")
 		p.h("<ul>")
 		p.indent()
 		for _, event := range events {
-			p.h("<li>", event.Server.Type, "</li>")
+			li := []interface{}{"<li>", event.Server.Type}
+			if details := event.Server.Details(); details != "" {
+				li = append(li, " (", esc(details), ")")
+			}
+			if event.Server.Note != "" {
+				li = append(li, " - <em>", esc(event.Server.Note), "</em>")
+			}
+			if p.commandSources != nil {
+				li = append(li, p.codeLink(p.commandSources.server[event]))
+			}
+			p.h(append(li, "</li>")...)
 		}
 		p.dedent()
 		p.h("</ul>")
-		return
+	} else if events[0].Result != nil {
+		p.h("<strong>Workflow result: </strong>", esc(events[0].Result.Details()), "<br />")
 	} else if events[0].Client != nil {
 		p.h("<strong>Commands to server:</strong><br />")
 		p.h("<ul>")
 		p.indent()
 		for _, event := range events {
-			for _, command := range event.Client.Commands {
-				p.h("<li>", command, "</li>")
+			var codes []*Event
+			if p.commandSources != nil {
+				codes = p.commandSources.commands[event]
+			}
+			for i, command := range event.Client.Commands {
+				li := []interface{}{"<li>", command}
+				if details := event.Client.CommandDetails(i); details != "" {
+					li = append(li, " (", esc(details), ")")
+				}
+				if i < len(codes) {
+					li = append(li, p.codeLink(codes[i]))
+				}
+				p.h(append(li, "</li>")...)
 			}
 		}
 		p.dedent()
 		p.h("</ul>")
-		return
 	}
+}
 
-	// Now we know it's a code event, collect lines to highlight
-	var hl []string
-	for _, event := range events {
-		hl = append(hl, strconv.Itoa(event.Code.Line))
+// Link to the step of the code event, or empty if none
+func (p *simplePage) codeLink(code *Event) string {
+	if code == nil || p.anchors[code] == "" {
+		return ""
 	}
-	src := p.sources[events[0].Code.File] + "?hl=" + strings.Join(hl, ",")
-	p.h("<strong>Code: </strong>", esc(events[0].Code.Package), ` - <a href="`,
-		esc(src), `">`, esc(filepath.Base(events[0].Code.File)), "</a>",
-		" (coroutine: ", esc(events[0].Code.Coroutine), ")<br />")
-	// We want 2 lines before and 2 lines after
-	startLine := events[0].Code.Line - 2
-	endLine := events[len(events)-1].Code.Line + 2
-	height := (endLine - startLine) * 16
-	// Build URL for iframe
-	p.h(`<iframe height="`, height, `" src="`, esc(src), `" frameborder="0" style="width: 100%"></iframe>`)
+	return ` - <a href="#` + p.anchors[code] + `">from ` + esc(filepath.Base(code.Code.File)) + ":" +
+		strconv.Itoa(code.Code.Line) + "</a>"
 }
 
 func esc(s string) string { return html.EscapeString(s) }
@@ -0,0 +1,113 @@
+package tracer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/history/v1"
+)
+
+func TestRenderCodeEventHTML(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(file, []byte(`package foo
+
+func Foo() {
+	a := 1
+	b := 2
+	c := 3
+	_, _, _ = a, b, c
+}
+`), 0644))
+
+	b, err := RenderCodeEventHTML(&EventCode{File: file, Line: 5}, 1)
+	require.NoError(t, err)
+	html := string(b)
+
+	// Only lines 4 through 6 are present
+	require.Contains(t, html, `class="ln">4<`)
+	require.Contains(t, html, `class="ln">6<`)
+	require.NotContains(t, html, `class="ln">3<`)
+	require.NotContains(t, html, `class="ln">7<`)
+	// Only the event line is highlighted
+	require.Len(t, regexp.MustCompile(`class="hl"`).FindAllString(html, -1), 1)
+	require.Regexp(t, `class="hl"><span class="ln">5</span>.*>b<`, html)
+}
+
+func TestSimplePageEventSetContextLines(t *testing.T) {
+	events := []*Event{
+		{Code: &EventCode{File: "/src/workflow.go", Line: 3}},
+		{Code: &EventCode{File: "/src/workflow.go", Line: 4}},
+	}
+	// Start is clamped to the first line
+	p := simplePage{sources: map[string]string{"/src/workflow.go": "sources/workflow.go.html"}, contextLines: 5}
+	p.eventSet(events)
+	require.Contains(t, p.String(), `<iframe height="144" src="sources/workflow.go.html?hl=3,4" onload="fitFrame(this, 1, 9)"`)
+
+	// No context
+	p = simplePage{sources: map[string]string{"/src/workflow.go": "sources/workflow.go.html"}}
+	p.eventSet(events)
+	require.Contains(t, p.String(), `<iframe height="32" `)
+}
+
+func TestHTMLStyle(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	config.HTMLStyle = "dracula"
+	_, err := New(config)
+	require.NoError(t, err)
+	config.HTMLStyle = "not-a-style"
+	_, err = New(config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown HTML style "not-a-style"`)
+
+	// Only the default has a dark mode
+	require.NotContains(t, htmlBodyCSS("dracula"), "prefers-color-scheme")
+	require.Contains(t, htmlBodyCSS(""), "@media (prefers-color-scheme: dark)")
+
+	// Source files get the dark CSS only by default
+	src := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(src, []byte("package foo\n"), 0644))
+	target := filepath.Join(t.TempDir(), "workflow.go.html")
+	require.NoError(t, HTMLGeneratorSimpleLinear{}.writeGoHTMLFile(newSourceCache(0), src, target, "", 2))
+	b, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "@media (prefers-color-scheme: dark)")
+	require.NoError(t, HTMLGeneratorSimpleLinear{}.writeGoHTMLFile(newSourceCache(0), src, target, "dracula", 2))
+	b, err = os.ReadFile(target)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "prefers-color-scheme")
+}
+
+func TestHTMLGeneratorSimpleLinearHistory(t *testing.T) {
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "testdata/history.json.gz",
+	})
+	require.NoError(t, err)
+	outDir := filepath.Join(t.TempDir(), "out")
+	err = HTMLGeneratorSimpleLinear{}.GenerateHTML(context.Background(), tr, outDir, &Result{
+		Events: []*Event{{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED)}}},
+	})
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(outDir, "history.json"))
+	require.NoError(t, err)
+	var hist history.History
+	require.NoError(t, jsonpb.UnmarshalString(string(b), &hist))
+	require.Len(t, hist.Events, 2)
+	b, err = os.ReadFile(filepath.Join(outDir, "index.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), `<a href="history.json" download>history.json</a>`)
+
+	// Not written without a history
+	outDir = filepath.Join(t.TempDir(), "out")
+	require.NoError(t, os.MkdirAll(outDir, 0755))
+	err = HTMLGeneratorSimpleLinear{}.GenerateHTML(context.Background(), &Tracer{}, outDir, &Result{})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(outDir, "history.json"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,83 @@
+package tracer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// GenerateSingleHTML writes the result as a single self-contained HTML
+// document. Unlike HTMLGeneratorSimpleLinear, source is inlined for each code
+// step with the executed lines highlighted, so there are no iframes or other
+// files. The source style is Config.HTMLStyle.
+func (t *Tracer) GenerateSingleHTML(w io.Writer, res *Result) error {
+	// Build the CSS for the style, including dark mode if default
+	var css bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.WriteCSS(&css, htmlChromaStyle(t.HTMLStyle)); err != nil {
+		return err
+	}
+	if t.HTMLStyle == "" {
+		css.WriteString("@media (prefers-color-scheme: dark) {\n")
+		if err := formatter.WriteCSS(&css, styles.Get(htmlDarkStyle)); err != nil {
+			return err
+		}
+		css.WriteString("}\n")
+	}
+	css.WriteString(htmlBodyCSS(t.HTMLStyle) + "\n")
+
+	p := simplePage{style: t.HTMLStyle, contextLines: defaultHTMLContextLines}
+	p.h("<!DOCTYPE html>")
+	p.h("<html>")
+	p.h("<head>")
+	p.indent()
+	p.h(`<meta charset="utf-8">`)
+	p.h("<style>\n", css.String(), "</style>")
+	p.title(t)
+	p.dedent()
+	p.h("</head>")
+	p.h("<body>")
+	p.indent()
+	p.executionHeader(t)
+
+	// Iterate events, keeping like events together
+	sources := newSourceCache(t.SourceCacheMaxBytes)
+	for _, events := range groupEvents(res.Events) {
+		p.h("<hr />")
+		if events[0].Code == nil {
+			p.nonCodeEventSet(events)
+			continue
+		}
+		code := events[0].Code
+		lines, err := sources.tokenLines(code.File)
+		if err != nil {
+			return err
+		}
+		p.h("<strong>Code: </strong>", esc(code.Package), " - ", esc(filepath.Base(code.File)),
+			" (coroutine: ", esc(code.Coroutine), ")", stackHoverHTML(code.Stack), "<br />")
+		// Source may have changed since the trace, or the result loaded from
+		// elsewhere
+		if code.Line < 1 || code.Line > len(lines) {
+			p.h("<em>Unable to show source, line ", code.Line, " not in file</em><br />")
+			continue
+		}
+		hl := make([][2]int, len(events))
+		for i, event := range events {
+			hl[i] = [2]int{event.Code.Line, event.Code.Line}
+		}
+		err = formatGoLinesHTML(&p, lines, code.Line-p.contextLines,
+			events[len(events)-1].Code.Line+p.contextLines, hl)
+		if err != nil {
+			return fmt.Errorf("failed formatting %v: %w", code.File, err)
+		}
+	}
+	p.dedent()
+	p.h("</body>")
+	p.h("</html>")
+	_, err := w.Write(p.Bytes())
+	return err
+}
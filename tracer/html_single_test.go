@@ -0,0 +1,65 @@
+package tracer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/alecthomas/chroma"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestGenerateSingleHTML(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(file, []byte("package foo\n\nfunc a() {\n\tb()\n\tc()\n\td()\n}\n"), 0644))
+	tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"})
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, tr.GenerateSingleHTML(&b, &Result{Events: []*Event{
+		{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED), Note: "start"}},
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 4, Coroutine: "root"}},
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 5, Coroutine: "root"}},
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 4, Coroutine: "root", Stack: []StackFrame{
+			{Function: "example.com/foo.a", File: file, Line: 4},
+			{Function: "example.com/foo.MyWorkflow", File: file, Line: 10},
+		}}},
+		{Client: &EventClient{Commands: []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_COMPLETE_WORKFLOW_EXECUTION)}}},
+		{Result: &EventResult{Error: "<failed>"}},
+	}}))
+	html := b.String()
+	require.Contains(t, html, "<title>History history.json</title>")
+	require.Contains(t, html, "<li>WorkflowExecutionStarted - <em>start</em></li>")
+	require.Contains(t, html, "<strong>Code: </strong>example.com/foo - workflow.go (coroutine: root)<br />")
+	require.Contains(t, html, `(coroutine: root) <span title="example.com/foo.a (workflow.go:4)
+example.com/foo.MyWorkflow (workflow.go:10)" style="cursor: help; text-decoration: underline dotted">[stack]</span><br />`)
+	require.Contains(t, html, "<li>CompleteWorkflowExecution</li>")
+	require.Contains(t, html, "<strong>Workflow result: </strong>error: &lt;failed&gt;<br />")
+	require.Contains(t, html, "@media (prefers-color-scheme: dark)")
+	require.NotContains(t, html, "<iframe")
+	// Lines 2 through 7 shown, 4 and 5 highlighted
+	require.Contains(t, html, `class="ln">2<`)
+	require.Contains(t, html, `class="ln">7<`)
+	require.NotContains(t, html, `class="ln">1<`)
+	require.Len(t, regexp.MustCompile(`class="hl"`).FindAllString(html, -1), 3)
+}
+
+func TestGenerateSingleHTMLLinePastEOF(t *testing.T) {
+	// Source changed since the trace
+	file := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(file, []byte("package foo\n\nfunc a() {}\n"), 0644))
+	tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"})
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, tr.GenerateSingleHTML(&b, &Result{Events: []*Event{
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 20, Coroutine: "root"}},
+	}}))
+	require.Contains(t, b.String(), "<em>Unable to show source, line 20 not in file</em><br />")
+
+	// Nothing is formatted when the range is past the end
+	b.Reset()
+	require.NoError(t, formatGoLinesHTML(&b, make([][]chroma.Token, 3), 17, 23, [][2]int{{20, 20}}))
+	require.Empty(t, b.String())
+}
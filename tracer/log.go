@@ -1,7 +1,12 @@
 package tracer
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"strings"
+	"sync"
 
 	sdklog "go.temporal.io/sdk/log"
 )
@@ -13,17 +18,117 @@ var DefaultLogger sdklog.Logger = LoggerFunc(func(level, msg string, keyVals ...
 type LoggerFunc func(level, msg string, keyVals ...interface{})
 
 func (l LoggerFunc) Debug(msg string, keyVals ...interface{}) {
-	l("DEBUG", msg, keyVals)
+	l("DEBUG", msg, keyVals...)
 }
 
 func (l LoggerFunc) Info(msg string, keyVals ...interface{}) {
-	l("INFO", msg, keyVals)
+	l("INFO", msg, keyVals...)
 }
 
 func (l LoggerFunc) Warn(msg string, keyVals ...interface{}) {
-	l("WARN", msg, keyVals)
+	l("WARN", msg, keyVals...)
 }
 
 func (l LoggerFunc) Error(msg string, keyVals ...interface{}) {
-	l("ERROR", msg, keyVals)
+	l("ERROR", msg, keyVals...)
+}
+
+// NewJSONLogger creates a logger that writes each message as a line of JSON
+// with "level", "msg", and the key/values as fields. Errors and other
+// stringers are written as strings.
+func NewJSONLogger(w io.Writer) sdklog.Logger {
+	var lock sync.Mutex
+	return LoggerFunc(func(level, msg string, keyVals ...interface{}) {
+		fields := map[string]interface{}{"level": level, "msg": msg}
+		for i := 0; i < len(keyVals); i += 2 {
+			var val interface{}
+			if i+1 < len(keyVals) {
+				val = jsonLogValue(keyVals[i+1])
+			}
+			fields[fmt.Sprint(keyVals[i])] = val
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"level": level, "msg": msg, "logError": err.Error()})
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		_, _ = w.Write(append(b, '\n'))
+	})
+}
+
+func jsonLogValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// LogLevel is the minimum level of messages that are logged
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// LogLevels are the names of the log levels in order, as accepted by
+// ParseLogLevel
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogLevelDebug || l > LogLevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return LogLevels[l]
+}
+
+// ParseLogLevel parses one of LogLevels, case-insensitive
+func ParseLogLevel(str string) (LogLevel, error) {
+	for i, name := range LogLevels {
+		if strings.EqualFold(str, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of: %v", str, strings.Join(LogLevels, ", "))
+}
+
+// NewLevelLogger wraps the logger to drop messages below the given level
+func NewLevelLogger(logger sdklog.Logger, level LogLevel) sdklog.Logger {
+	return &levelLogger{Logger: logger, level: level}
+}
+
+type levelLogger struct {
+	sdklog.Logger
+	level LogLevel
+}
+
+func (l *levelLogger) Debug(msg string, keyVals ...interface{}) {
+	if l.level <= LogLevelDebug {
+		l.Logger.Debug(msg, keyVals...)
+	}
+}
+
+func (l *levelLogger) Info(msg string, keyVals ...interface{}) {
+	if l.level <= LogLevelInfo {
+		l.Logger.Info(msg, keyVals...)
+	}
+}
+
+func (l *levelLogger) Warn(msg string, keyVals ...interface{}) {
+	if l.level <= LogLevelWarn {
+		l.Logger.Warn(msg, keyVals...)
+	}
+}
+
+func (l *levelLogger) Error(msg string, keyVals ...interface{}) {
+	l.Logger.Error(msg, keyVals...)
 }
@@ -0,0 +1,95 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelLogger(t *testing.T) {
+	var logged []string
+	var lastKeyVals []interface{}
+	base := LoggerFunc(func(level, msg string, keyVals ...interface{}) {
+		logged = append(logged, level)
+		lastKeyVals = keyVals
+	})
+	logger := NewLevelLogger(base, LogLevelWarn)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn", "Key", "value")
+	logger.Error("error")
+	require.Equal(t, []string{"WARN", "ERROR"}, logged)
+
+	// Key values are forwarded as is
+	logger.Warn("warn", "Dir", "/tmp", "Count", 2)
+	require.Equal(t, []interface{}{"Dir", "/tmp", "Count", 2}, lastKeyVals)
+
+	// Config applies the level to the logger
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "history.json",
+		Log:           base,
+		LogLevel:      LogLevelInfo,
+	})
+	require.NoError(t, err)
+	logged = nil
+	tr.Log.Debug("debug")
+	tr.Log.Info("info")
+	require.Equal(t, []string{"INFO"}, logged)
+}
+
+func TestDefaultLoggerKeyVals(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(flags int) {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}(log.Flags())
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	DefaultLogger.Debug("Created temp dir", "Dir", "/tmp")
+	DefaultLogger.Info("Done")
+	require.Equal(t, "DEBUG Created temp dir Dir /tmp\nINFO Done\n", buf.String())
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+	logger.Debug("Created temp dir", "Dir", "/tmp", "Count", 2)
+	logger.Warn("Failed", "Error", errors.New("oops"), "Elapsed", time.Second, "Func", func() {}, "Dangling")
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]interface{}
+		require.NoError(t, dec.Decode(&line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+	require.Equal(t, map[string]interface{}{"level": "DEBUG", "msg": "Created temp dir", "Dir": "/tmp", "Count": 2.0},
+		lines[0])
+	require.Equal(t, "WARN", lines[1]["level"])
+	require.Equal(t, "oops", lines[1]["Error"])
+	require.Equal(t, "1s", lines[1]["Elapsed"])
+	require.NotEmpty(t, lines[1]["Func"])
+	require.Contains(t, lines[1], "Dangling")
+	require.Nil(t, lines[1]["Dangling"])
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for i, name := range LogLevels {
+		level, err := ParseLogLevel(name)
+		require.NoError(t, err)
+		require.Equal(t, LogLevel(i), level)
+		require.Equal(t, name, level.String())
+	}
+	level, err := ParseLogLevel("WARN")
+	require.NoError(t, err)
+	require.Equal(t, LogLevelWarn, level)
+	_, err = ParseLogLevel("trace")
+	require.EqualError(t, err, `unknown log level "trace", expected one of: debug, info, warn, error`)
+}
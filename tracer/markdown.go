@@ -0,0 +1,99 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Number of lines shown before and after executed code in Markdown output
+const markdownContextLines = 2
+
+// GenerateMarkdown writes the result as a single self-contained Markdown
+// document. Executed code lines are marked with a trailing "// <--" comment.
+func (t *Tracer) GenerateMarkdown(w io.Writer, res *Result) error {
+	bw := bufio.NewWriter(w)
+	// Header
+	fmt.Fprintln(bw, "# Workflow Execution")
+	fmt.Fprintln(bw)
+	if t.Execution != nil {
+		fmt.Fprintf(bw, "* **ID:** %v\n", t.Execution.ID)
+		if t.Execution.RunID != "" {
+			fmt.Fprintf(bw, "* **Run ID:** %v\n", t.Execution.RunID)
+		}
+	} else if t.HistoryFile != "" {
+		fmt.Fprintf(bw, "* **History:** %v\n", t.HistoryFile)
+	}
+	for _, fn := range t.fns {
+		fmt.Fprintf(bw, "* **Entry Function:** `%v`\n", fn.qualified)
+	}
+
+	// Events
+	sources := newSourceCache(t.SourceCacheMaxBytes)
+	for _, events := range groupEvents(res.Events) {
+		fmt.Fprintln(bw)
+		if events[0].Server != nil {
+			fmt.Fprintln(bw, "### Events from server")
+			fmt.Fprintln(bw)
+			for _, event := range events {
+				fmt.Fprintf(bw, "* %v - %v", event.Server.ID, event.Server.Type)
+				if details := event.Server.Details(); details != "" {
+					fmt.Fprintf(bw, " (%v)", details)
+				}
+				if event.Server.Note != "" {
+					fmt.Fprintf(bw, " - _%v_", event.Server.Note)
+				}
+				fmt.Fprintln(bw)
+			}
+			continue
+		} else if events[0].Client != nil {
+			fmt.Fprintln(bw, "### Commands to server")
+			fmt.Fprintln(bw)
+			for _, event := range events {
+				for i, command := range event.Client.Commands {
+					fmt.Fprintf(bw, "* %v", command)
+					if details := event.Client.CommandDetails(i); details != "" {
+						fmt.Fprintf(bw, " (%v)", details)
+					}
+					fmt.Fprintln(bw)
+				}
+			}
+			continue
+		} else if events[0].Result != nil {
+			fmt.Fprintf(bw, "### Workflow result\n\n%v\n", events[0].Result.Details())
+			continue
+		}
+
+		// Code, load lines if not already loaded
+		code := events[0].Code
+		lines, err := sources.lines(code.File)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "### Code: %v - `%v` (coroutine: %v)\n", code.Package, filepath.Base(code.File), code.Coroutine)
+		fmt.Fprintln(bw)
+		executed := map[int]bool{}
+		for _, event := range events {
+			executed[event.Code.Line] = true
+		}
+		startLine := code.Line - markdownContextLines
+		if startLine < 1 {
+			startLine = 1
+		}
+		endLine := events[len(events)-1].Code.Line + markdownContextLines
+		if endLine > len(lines) {
+			endLine = len(lines)
+		}
+		fmt.Fprintln(bw, "```go")
+		for line := startLine; line <= endLine; line++ {
+			fmt.Fprintf(bw, "/* %4d */ %v", line, lines[line-1])
+			if executed[line] {
+				fmt.Fprint(bw, " // <--")
+			}
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintln(bw, "```")
+	}
+	return bw.Flush()
+}
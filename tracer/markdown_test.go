@@ -0,0 +1,31 @@
+package tracer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestGenerateMarkdown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(file, []byte("package foo\n\nfunc a() {\n\tb()\n\tc()\n}\n"), 0644))
+	tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"})
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, tr.GenerateMarkdown(&b, &Result{Events: []*Event{
+		{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED), Note: "start"}},
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 4}},
+		{Code: &EventCode{Package: "example.com/foo", File: file, Line: 5}},
+		{Client: &EventClient{Commands: []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_COMPLETE_WORKFLOW_EXECUTION)}}},
+	}}))
+	md := b.String()
+	require.Contains(t, md, "* **History:** history.json\n")
+	require.Contains(t, md, "* 1 - WorkflowExecutionStarted - _start_\n")
+	require.Contains(t, md, "```go\n/*    2 */ \n/*    3 */ func a() {\n/*    4 */ \tb() // <--\n"+
+		"/*    5 */ \tc() // <--\n/*    6 */ }\n```\n")
+	require.Contains(t, md, "* CompleteWorkflowExecution\n")
+}
@@ -0,0 +1,144 @@
+package tracer
+
+import (
+	"fmt"
+
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/history/v1"
+)
+
+// Mismatch is a workflow task where the commands produced by the code do not
+// match the command events recorded in history after the task completed.
+type Mismatch struct {
+	// ID of the workflow task started event for the task
+	TaskStartedEventID int64                    `json:"taskStartedEventId"`
+	Expected           []EventServerType        `json:"expected"`
+	Actual             []EventClientCommandType `json:"actual"`
+}
+
+// NonDeterminismError is the replayer's non-determinism check failure,
+// captured when the replay commands do not match the history events.
+type NonDeterminismError struct {
+	// One of the NonDeterminism constants
+	Kind string `json:"kind"`
+	// History event that did not match. Not set for NonDeterminismExtraCommand.
+	EventID   int64           `json:"eventId,omitempty"`
+	EventType EventServerType `json:"eventType,omitempty"`
+	// Command type the history event results from. Not set for
+	// NonDeterminismExtraCommand or events that do not result from commands.
+	ExpectedCommandType EventClientCommandType `json:"expectedCommandType,omitempty"`
+	// Replay command that did not match. Not set for
+	// NonDeterminismMissingCommand.
+	ActualCommand *EventClientCommand `json:"actualCommand,omitempty"`
+}
+
+const (
+	// History has a command event the code did not produce a command for
+	NonDeterminismMissingCommand = "missing_command"
+	// Code produced a command history does not have an event for
+	NonDeterminismExtraCommand = "extra_command"
+	// Code produced a command that does not match the history event
+	NonDeterminismMismatch = "mismatch"
+)
+
+func (n *NonDeterminismError) Error() string {
+	var expected, actual string = "<none>", "<none>"
+	if n.Kind != NonDeterminismExtraCommand {
+		expected = fmt.Sprintf("%v (event %v - %v)", n.ExpectedCommandType, n.EventID, n.EventType)
+	}
+	if n.ActualCommand != nil {
+		actual = n.ActualCommand.Type.String()
+		if details := n.ActualCommand.Details(); details != "" {
+			actual += " (" + details + ")"
+		}
+	}
+	return fmt.Sprintf("non-determinism (%v): expected %v, actual %v", n.Kind, expected, actual)
+}
+
+// Event type each command type results in
+var commandEventTypes = map[enums.CommandType]enums.EventType{
+	enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK:                     enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED,
+	enums.COMMAND_TYPE_REQUEST_CANCEL_ACTIVITY_TASK:               enums.EVENT_TYPE_ACTIVITY_TASK_CANCEL_REQUESTED,
+	enums.COMMAND_TYPE_START_TIMER:                                enums.EVENT_TYPE_TIMER_STARTED,
+	enums.COMMAND_TYPE_COMPLETE_WORKFLOW_EXECUTION:                enums.EVENT_TYPE_WORKFLOW_EXECUTION_COMPLETED,
+	enums.COMMAND_TYPE_FAIL_WORKFLOW_EXECUTION:                    enums.EVENT_TYPE_WORKFLOW_EXECUTION_FAILED,
+	enums.COMMAND_TYPE_CANCEL_TIMER:                               enums.EVENT_TYPE_TIMER_CANCELED,
+	enums.COMMAND_TYPE_CANCEL_WORKFLOW_EXECUTION:                  enums.EVENT_TYPE_WORKFLOW_EXECUTION_CANCELED,
+	enums.COMMAND_TYPE_REQUEST_CANCEL_EXTERNAL_WORKFLOW_EXECUTION: enums.EVENT_TYPE_REQUEST_CANCEL_EXTERNAL_WORKFLOW_EXECUTION_INITIATED,
+	enums.COMMAND_TYPE_RECORD_MARKER:                              enums.EVENT_TYPE_MARKER_RECORDED,
+	enums.COMMAND_TYPE_CONTINUE_AS_NEW_WORKFLOW_EXECUTION:         enums.EVENT_TYPE_WORKFLOW_EXECUTION_CONTINUED_AS_NEW,
+	enums.COMMAND_TYPE_START_CHILD_WORKFLOW_EXECUTION:             enums.EVENT_TYPE_START_CHILD_WORKFLOW_EXECUTION_INITIATED,
+	enums.COMMAND_TYPE_SIGNAL_EXTERNAL_WORKFLOW_EXECUTION:         enums.EVENT_TYPE_SIGNAL_EXTERNAL_WORKFLOW_EXECUTION_INITIATED,
+	enums.COMMAND_TYPE_UPSERT_WORKFLOW_SEARCH_ATTRIBUTES:          enums.EVENT_TYPE_UPSERT_WORKFLOW_SEARCH_ATTRIBUTES,
+}
+
+func isCommandEventType(t enums.EventType) bool {
+	for _, eventType := range commandEventTypes {
+		if eventType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the commands for each workflow task in the result with the command
+// events in history. The last workflow task is not compared since the
+// replayer does not check commands of the final task.
+func findCommandMismatches(hist *history.History, res *Result) []*Mismatch {
+	// Collect command event types in history keyed by the started event ID of
+	// the task that produced them
+	expected := map[int64][]EventServerType{}
+	for i, event := range hist.Events {
+		if event.EventType != enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED {
+			continue
+		}
+		startedID := event.GetWorkflowTaskCompletedEventAttributes().GetStartedEventId()
+		for _, next := range hist.Events[i+1:] {
+			if !isCommandEventType(next.EventType) {
+				break
+			}
+			expected[startedID] = append(expected[startedID], EventServerType(next.EventType))
+		}
+	}
+
+	// Collect commands in result in task order
+	var taskStartedIDs []int64
+	actual := map[int64][]EventClientCommandType{}
+	for _, event := range res.Events {
+		if event.Server != nil && enums.EventType(event.Server.Type) == enums.EVENT_TYPE_WORKFLOW_TASK_STARTED {
+			taskStartedIDs = append(taskStartedIDs, event.Server.ID)
+		} else if event.Client != nil && len(taskStartedIDs) > 0 {
+			startedID := taskStartedIDs[len(taskStartedIDs)-1]
+			actual[startedID] = append(actual[startedID], event.Client.Commands...)
+		}
+	}
+
+	// Compare all but last
+	var mismatches []*Mismatch
+	for i := 0; i < len(taskStartedIDs)-1; i++ {
+		startedID := taskStartedIDs[i]
+		expectedTypes, actualTypes := expected[startedID], actual[startedID]
+		matches := len(expectedTypes) == len(actualTypes)
+		for j := 0; matches && j < len(actualTypes); j++ {
+			matches = commandEventTypes[enums.CommandType(actualTypes[j])] == enums.EventType(expectedTypes[j])
+		}
+		if !matches {
+			mismatches = append(mismatches, &Mismatch{
+				TaskStartedEventID: startedID,
+				Expected:           expectedTypes,
+				Actual:             actualTypes,
+			})
+		}
+	}
+	return mismatches
+}
+
+// Command type the event results from or unspecified if none
+func eventCommandType(t enums.EventType) enums.CommandType {
+	for commandType, eventType := range commandEventTypes {
+		if eventType == t {
+			return commandType
+		}
+	}
+	return enums.COMMAND_TYPE_UNSPECIFIED
+}
@@ -0,0 +1,77 @@
+package tracer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-delve/delve/service/api"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/history/v1"
+)
+
+func TestFindCommandMismatches(t *testing.T) {
+	hist := &history.History{Events: []*history.HistoryEvent{
+		{EventId: 1, EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED},
+		{EventId: 2, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED},
+		{EventId: 3, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_STARTED},
+		{EventId: 4, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED, Attributes: &history.HistoryEvent_WorkflowTaskCompletedEventAttributes{
+			WorkflowTaskCompletedEventAttributes: &history.WorkflowTaskCompletedEventAttributes{StartedEventId: 3},
+		}},
+		{EventId: 5, EventType: enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED},
+		{EventId: 6, EventType: enums.EVENT_TYPE_ACTIVITY_TASK_STARTED},
+		{EventId: 7, EventType: enums.EVENT_TYPE_ACTIVITY_TASK_COMPLETED},
+		{EventId: 8, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED},
+		{EventId: 9, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_STARTED},
+		{EventId: 10, EventType: enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED, Attributes: &history.HistoryEvent_WorkflowTaskCompletedEventAttributes{
+			WorkflowTaskCompletedEventAttributes: &history.WorkflowTaskCompletedEventAttributes{StartedEventId: 9},
+		}},
+		{EventId: 11, EventType: enums.EVENT_TYPE_WORKFLOW_EXECUTION_COMPLETED},
+	}}
+	resultWithCommand := func(command enums.CommandType) *Result {
+		return &Result{Events: []*Event{
+			{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED)}},
+			{Server: &EventServer{ID: 3, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}},
+			{Client: &EventClient{Task: 1, Commands: []EventClientCommandType{EventClientCommandType(command)}}},
+			{Server: &EventServer{ID: 9, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}},
+		}}
+	}
+
+	// Matching
+	require.Empty(t, findCommandMismatches(hist, resultWithCommand(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK)))
+
+	// Not matching
+	mismatches := findCommandMismatches(hist, resultWithCommand(enums.COMMAND_TYPE_START_TIMER))
+	require.Len(t, mismatches, 1)
+	require.Equal(t, int64(3), mismatches[0].TaskStartedEventID)
+	require.Equal(t, []EventServerType{EventServerType(enums.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED)}, mismatches[0].Expected)
+	require.Equal(t, []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_START_TIMER)}, mismatches[0].Actual)
+}
+
+func TestNonDeterminismErrorFromVars(t *testing.T) {
+	eventVar := &api.Variable{Kind: reflect.Ptr, Children: []api.Variable{{Kind: reflect.Struct, Addr: 1,
+		Children: []api.Variable{
+			{Name: "EventId", Kind: reflect.Int64, Value: "5"},
+			{Name: "EventType", Kind: reflect.Int32, Value: "EVENT_TYPE_TIMER_STARTED (17)"},
+		}}}}
+	commandVar := &api.Variable{Kind: reflect.Ptr, Children: []api.Variable{{Kind: reflect.Struct, Addr: 1,
+		Children: []api.Variable{
+			{Name: "CommandType", Kind: reflect.Int32, Value: "COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK (1)"},
+		}}}}
+
+	nonDetErr, err := nonDeterminismErrorFromVars(NonDeterminismMismatch, eventVar, commandVar)
+	require.NoError(t, err)
+	require.Equal(t, &NonDeterminismError{
+		Kind:                NonDeterminismMismatch,
+		EventID:             5,
+		EventType:           EventServerType(enums.EVENT_TYPE_TIMER_STARTED),
+		ExpectedCommandType: EventClientCommandType(enums.COMMAND_TYPE_START_TIMER),
+		ActualCommand:       &EventClientCommand{Type: EventClientCommandType(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK)},
+	}, nonDetErr)
+	require.Equal(t, "non-determinism (mismatch): expected StartTimer (event 5 - TimerStarted), actual ScheduleActivityTask",
+		nonDetErr.Error())
+
+	nonDetErr, err = nonDeterminismErrorFromVars(NonDeterminismExtraCommand, nil, commandVar)
+	require.NoError(t, err)
+	require.Equal(t, "non-determinism (extra_command): expected <none>, actual ScheduleActivityTask", nonDetErr.Error())
+}
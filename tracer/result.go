@@ -1,9 +1,226 @@
 package tracer
 
-import "go.temporal.io/api/enums/v1"
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"go.temporal.io/api/enums/v1"
+)
+
+// ResultSchemaVersion is the version of the JSON format of Result. It is
+// incremented whenever a field is removed or its meaning changes. Added fields
+// do not change the version.
+const ResultSchemaVersion = 1
 
 type Result struct {
-	Events []*Event `json:"events"`
+	// Always ResultSchemaVersion for results created by this version of the
+	// package
+	SchemaVersion int `json:"schemaVersion"`
+	// Version of this module that created the result, or "(devel)" if unknown
+	ToolVersion string   `json:"toolVersion,omitempty"`
+	Events      []*Event `json:"events"`
+	Summary     *Summary `json:"summary,omitempty"`
+	// Only set for traces, not for ModeReplayOnly
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+	// Only set for traces, not for ModeReplayOnly
+	Stats *Stats `json:"stats,omitempty"`
+	// Workflow tasks whose commands did not match history. Only set for
+	// successful traces.
+	Mismatches []*Mismatch `json:"mismatches,omitempty"`
+	// Set if the replay failed the non-determinism check
+	NonDeterminismError *NonDeterminismError `json:"nonDeterminismError,omitempty"`
+	// Set if the replay failed after workflow code panicked
+	Failure *Failure `json:"failure,omitempty"`
+	// Whether the replay succeeded. Only set in ModeReplayOnly.
+	Success bool `json:"success,omitempty"`
+	// Output of the failed replay. Only set in ModeReplayOnly.
+	ReplayError string `json:"replayError,omitempty"`
+}
+
+func newResult() *Result {
+	return &Result{SchemaVersion: ResultSchemaVersion, ToolVersion: toolVersion()}
+}
+
+// UnmarshalResult unmarshals a JSON result, failing if it is not of
+// ResultSchemaVersion.
+func UnmarshalResult(b []byte) (*Result, error) {
+	var res Result
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling result: %w", err)
+	} else if res.SchemaVersion == 0 {
+		return nil, fmt.Errorf("result has no schema version, expected version %v", ResultSchemaVersion)
+	} else if res.SchemaVersion != ResultSchemaVersion {
+		return nil, fmt.Errorf("result has schema version %v (created by tool version %v), expected version %v",
+			res.SchemaVersion, res.ToolVersion, ResultSchemaVersion)
+	}
+	return &res, nil
+}
+
+const toolModulePath = "github.com/cretz/temporal-debug-go"
+
+// Gets the version of this module from the build info
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	} else if info.Main.Path == toolModulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == toolModulePath {
+			// Replaced with a local dir has no version
+			if dep.Replace != nil && dep.Replace.Version == "" {
+				break
+			} else if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+type Summary struct {
+	// ID of the last server event processed by the replayer
+	LastProcessedEventID int64 `json:"lastProcessedEventId,omitempty"`
+	// ID of the last workflow task started event in the history which is the
+	// last event the replayer is expected to process
+	LastHistoryEventID int64    `json:"lastHistoryEventId,omitempty"`
+	Warnings           []string `json:"warnings,omitempty"`
+}
+
+// Diagnostics is information about the trace itself rather than the workflow,
+// useful when a trace is empty or incomplete.
+type Diagnostics struct {
+	// Every breakpoint set in the order they were set
+	Breakpoints []*BreakpointHits `json:"breakpoints,omitempty"`
+}
+
+// Stats are aggregate counts and timings of a trace, useful for comparing the
+// replay complexity of workflow versions.
+type Stats struct {
+	// Debugger steps taken, including steps not recorded as code events
+	Steps        int `json:"steps"`
+	CodeEvents   int `json:"codeEvents"`
+	ServerEvents int `json:"serverEvents"`
+	// Distinct source files of the code events
+	Files int `json:"files"`
+	// Code events per coroutine name
+	CoroutineCodeEvents map[string]int `json:"coroutineCodeEvents,omitempty"`
+	// Wall-clock time of stepping through the replay. Nanoseconds in JSON.
+	StepDuration time.Duration `json:"stepDuration"`
+	// Wall-clock time of the whole trace including building the replayer.
+	// Nanoseconds in JSON.
+	Duration time.Duration `json:"duration"`
+}
+
+func newStats(events []*Event, steps int, stepDuration time.Duration) *Stats {
+	var c statsCounter
+	for _, event := range events {
+		c.add(event)
+	}
+	return c.finish(steps, stepDuration)
+}
+
+// Counts events for stats as they are recorded so the events themselves need
+// not be kept
+type statsCounter struct {
+	codeEvents          int
+	serverEvents        int
+	files               map[string]bool
+	coroutineCodeEvents map[string]int
+}
+
+func (c *statsCounter) add(event *Event) {
+	if event.Code != nil {
+		if c.files == nil {
+			c.files, c.coroutineCodeEvents = map[string]bool{}, map[string]int{}
+		}
+		c.codeEvents++
+		c.files[event.Code.File] = true
+		c.coroutineCodeEvents[event.Code.Coroutine]++
+	} else if event.Server != nil {
+		c.serverEvents++
+	}
+}
+
+func (c *statsCounter) finish(steps int, stepDuration time.Duration) *Stats {
+	s := &Stats{Steps: steps, CodeEvents: c.codeEvents, ServerEvents: c.serverEvents, Files: len(c.files),
+		CoroutineCodeEvents: map[string]int{}, StepDuration: stepDuration}
+	for name, count := range c.coroutineCodeEvents {
+		s.CoroutineCodeEvents[name] = count
+	}
+	return s
+}
+
+// String returns a one-line summary of the stats.
+func (s *Stats) String() string {
+	coroutines := make([]string, 0, len(s.CoroutineCodeEvents))
+	for name := range s.CoroutineCodeEvents {
+		coroutines = append(coroutines, name)
+	}
+	sort.Strings(coroutines)
+	for i, name := range coroutines {
+		coroutines[i] = fmt.Sprintf("%v: %v", name, s.CoroutineCodeEvents[name])
+	}
+	str := fmt.Sprintf("%v steps, %v code events in %v files, %v server events", s.Steps, s.CodeEvents, s.Files,
+		s.ServerEvents)
+	if len(coroutines) > 0 {
+		str += " (" + strings.Join(coroutines, ", ") + ")"
+	}
+	return str + fmt.Sprintf(", stepped for %v of %v", s.StepDuration.Round(time.Millisecond),
+		s.Duration.Round(time.Millisecond))
+}
+
+type BreakpointHits struct {
+	// What the breakpoint is for, e.g. "process event"
+	Name     string `json:"name"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Hits     int    `json:"hits"`
+}
+
+// Failure is the last panic in a workflow coroutine before the replay failed.
+// The location is the innermost frame that is traced code, or the innermost
+// non-runtime frame if none is.
+type Failure struct {
+	// Panic value
+	Message   string `json:"message"`
+	Function  string `json:"function,omitempty"`
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Coroutine string `json:"coroutine,omitempty"`
+	// Innermost frame first, starting at the function that panicked
+	Stack []StackFrame `json:"stack,omitempty"`
+}
+
+// NeverHit returns the breakpoints that were set but never hit. Some, like the
+// non-determinism breakpoints, are expected to not be hit on success.
+func (d *Diagnostics) NeverHit() []*BreakpointHits {
+	var neverHit []*BreakpointHits
+	for _, bp := range d.Breakpoints {
+		if bp.Hits == 0 {
+			neverHit = append(neverHit, bp)
+		}
+	}
+	return neverHit
+}
+
+// FinalTaskEvents returns the events starting at the last workflow task
+// started event from the server. This is the most relevant context when replay
+// fails.
+func (r *Result) FinalTaskEvents() []*Event {
+	for i := len(r.Events) - 1; i >= 0; i-- {
+		if r.Events[i].Server != nil && enums.EventType(r.Events[i].Server.Type) == enums.EVENT_TYPE_WORKFLOW_TASK_STARTED {
+			return r.Events[i:]
+		}
+	}
+	return r.Events
 }
 
 type Event struct {
@@ -11,11 +228,60 @@ type Event struct {
 	Server *EventServer `json:"server,omitempty"`
 	Client *EventClient `json:"client,omitempty"`
 	Code   *EventCode   `json:"code,omitempty"`
+	// Only once, when the workflow function returns
+	Result *EventResult `json:"result,omitempty"`
+}
+
+// EventResult is what the workflow function returned
+type EventResult struct {
+	// Each payload of the return value. JSON payloads are as-is, other data
+	// is shown as a string if valid UTF-8 or its size if not.
+	Values []string `json:"values,omitempty"`
+	// Set if the workflow returned an error
+	Error string `json:"error,omitempty"`
+}
+
+// Details is a single-line description of the result
+func (e *EventResult) Details() string {
+	if e.Error != "" {
+		return "error: " + e.Error
+	} else if len(e.Values) > 0 {
+		return "returned " + strings.Join(e.Values, ", ")
+	}
+	return "returned no value"
 }
 
 type EventServer struct {
 	ID   int64           `json:"eventId"`
 	Type EventServerType `json:"eventType"`
+	// User-supplied note from Config.EventNotes
+	Note string `json:"note,omitempty"`
+	// Only set for ActivityTaskScheduled
+	ActivityType string `json:"activityType,omitempty"`
+	ActivityID   string `json:"activityId,omitempty"`
+	// Only set for TimerStarted, TimerDuration is only set if the timeout is
+	// readable from the event
+	TimerID       string `json:"timerId,omitempty"`
+	TimerDuration string `json:"timerDuration,omitempty"`
+}
+
+// Details returns a human-readable summary of the activity and timer fields
+// that are set, or an empty string if none are.
+func (e *EventServer) Details() string {
+	var pieces []string
+	if e.ActivityType != "" {
+		pieces = append(pieces, "activity type: "+e.ActivityType)
+	}
+	if e.ActivityID != "" {
+		pieces = append(pieces, "activity ID: "+e.ActivityID)
+	}
+	if e.TimerID != "" {
+		pieces = append(pieces, "timer ID: "+e.TimerID)
+	}
+	if e.TimerDuration != "" {
+		pieces = append(pieces, "duration: "+e.TimerDuration)
+	}
+	return strings.Join(pieces, ", ")
 }
 
 type EventServerType enums.EventType
@@ -34,7 +300,46 @@ func (e EventServerType) String() string {
 }
 
 type EventClient struct {
+	// Workflow task the commands were produced in, starting at 1
+	Task     int                      `json:"task,omitempty"`
 	Commands []EventClientCommandType `json:"commands,omitempty"`
+	// Parallel to Commands with details of each command
+	Details []*EventClientCommand `json:"details,omitempty"`
+}
+
+// CommandDetails returns the details for the command at the given index or
+// an empty string if there are none.
+func (e *EventClient) CommandDetails(index int) string {
+	if index < len(e.Details) && e.Details[index] != nil {
+		return e.Details[index].Details()
+	}
+	return ""
+}
+
+type EventClientCommand struct {
+	Type EventClientCommandType `json:"commandType"`
+	// Only set for ScheduleActivityTask
+	ActivityType string `json:"activityType,omitempty"`
+	// Only set for StartTimer
+	TimerID string `json:"timerId,omitempty"`
+	// Only set for StartChildWorkflowExecution
+	ChildWorkflowType string `json:"childWorkflowType,omitempty"`
+}
+
+// Details returns a human-readable summary of the detail fields that are set,
+// or an empty string if none are.
+func (e *EventClientCommand) Details() string {
+	var pieces []string
+	if e.ActivityType != "" {
+		pieces = append(pieces, "activity type: "+e.ActivityType)
+	}
+	if e.TimerID != "" {
+		pieces = append(pieces, "timer ID: "+e.TimerID)
+	}
+	if e.ChildWorkflowType != "" {
+		pieces = append(pieces, "child workflow type: "+e.ChildWorkflowType)
+	}
+	return strings.Join(pieces, ", ")
 }
 
 type EventClientCommandType enums.CommandType
@@ -57,6 +362,79 @@ type EventCode struct {
 	File      string `json:"file,omitempty"`
 	Line      int    `json:"line,omitempty"`
 	Coroutine string `json:"coroutine,omitempty"`
-	// TODO(cretz): Locals
-	// LocalsUpdated []api.Variable `json:"locals_updated,omitempty"`
+	// What the code ran as, empty if unknown
+	Scope EventCodeScope `json:"scope,omitempty"`
+	// Workflow task the code ran in, starting at 1
+	Task int `json:"task,omitempty"`
+	// Entry in Config.WorkflowFuncs of the workflow the code ran in, with a
+	// relative package resolved
+	WorkflowFunc string `json:"workflowFunc,omitempty"`
+	// Only present if locals are captured for the package
+	Locals []EventCodeLocal `json:"locals,omitempty"`
+	// Only present if the stack is captured, innermost frame first
+	Stack []StackFrame `json:"stack,omitempty"`
+}
+
+type StackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// EventCodeScope is what a code event ran as
+type EventCodeScope string
+
+const (
+	// Root workflow coroutine
+	EventCodeScopeWorkflow EventCodeScope = "workflow"
+	// Coroutine started by the workflow, e.g. with workflow.Go
+	EventCodeScopeCoroutine EventCodeScope = "coroutine"
+	// Function given to workflow.SideEffect or workflow.MutableSideEffect. On
+	// replay, only mutable side effects are run.
+	EventCodeScopeSideEffect EventCodeScope = "sideEffect"
+	// Local activities are not run on replay, so this is only seen if run
+	// outside of replay
+	EventCodeScopeLocalActivity EventCodeScope = "localActivity"
+	// Activities are not run on replay, so this is only seen if run outside of
+	// replay
+	EventCodeScopeActivity EventCodeScope = "activity"
+)
+
+type EventCodeLocal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Groups consecutive like events together. Code events are only grouped if
+// they are increasing line numbers of the same file and coroutine.
+func groupEvents(events []*Event) [][]*Event {
+	var groups [][]*Event
+	var pendingEvents []*Event
+	for _, event := range events {
+		// See if we need to flush pending events
+		needsFlush := len(pendingEvents) > 0
+		if needsFlush {
+			lastEvent := pendingEvents[len(pendingEvents)-1]
+			needsFlush = (lastEvent.Server != nil && event.Server == nil) ||
+				(lastEvent.Client != nil && event.Client == nil) ||
+				(lastEvent.Code != nil && event.Code == nil) ||
+				lastEvent.Result != nil || event.Result != nil
+			// If we think we don't need flush due to code, make sure it's an
+			// increasing line number of the same file and same coroutine
+			if !needsFlush && lastEvent.Code != nil {
+				needsFlush = lastEvent.Code.File != event.Code.File ||
+					lastEvent.Code.Line > event.Code.Line ||
+					lastEvent.Code.Coroutine != event.Code.Coroutine
+			}
+		}
+		if needsFlush {
+			groups = append(groups, pendingEvents)
+			pendingEvents = nil
+		}
+		pendingEvents = append(pendingEvents, event)
+	}
+	if len(pendingEvents) > 0 {
+		groups = append(groups, pendingEvents)
+	}
+	return groups
 }
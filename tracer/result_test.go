@@ -0,0 +1,60 @@
+package tracer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestUnmarshalResult(t *testing.T) {
+	// Round trip
+	res := newResult()
+	res.Events = []*Event{{Server: &EventServer{ID: 3, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}}}
+	res.Diagnostics = &Diagnostics{Breakpoints: []*BreakpointHits{{Name: "process event", Hits: 1}}}
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"schemaVersion":1`)
+	actual, err := UnmarshalResult(b)
+	require.NoError(t, err)
+	require.Equal(t, res, actual)
+
+	// Missing and wrong versions
+	_, err = UnmarshalResult([]byte(`{"events":[]}`))
+	require.EqualError(t, err, "result has no schema version, expected version 1")
+	_, err = UnmarshalResult([]byte(`{"schemaVersion":2,"toolVersion":"v9.9.9","events":[]}`))
+	require.EqualError(t, err, "result has schema version 2 (created by tool version v9.9.9), expected version 1")
+}
+
+func TestDiagnosticsNeverHit(t *testing.T) {
+	d := &Diagnostics{Breakpoints: []*BreakpointHits{
+		{Name: "workflow function example.com/foo.MyWorkflow", Hits: 1},
+		{Name: "process event", Hits: 0},
+		{Name: "replay commands", Hits: 3},
+	}}
+	require.Equal(t, []*BreakpointHits{d.Breakpoints[1]}, d.NeverHit())
+}
+
+func TestNewStats(t *testing.T) {
+	stats := newStats([]*Event{
+		{Server: &EventServer{ID: 1, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_EXECUTION_STARTED)}},
+		{Code: &EventCode{File: "/src/workflow.go", Line: 10, Coroutine: "root"}},
+		{Code: &EventCode{File: "/src/workflow.go", Line: 11, Coroutine: "root"}},
+		{Code: &EventCode{File: "/src/helper.go", Line: 5, Coroutine: "my-coroutine"}},
+		{Client: &EventClient{Commands: []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_START_TIMER)}}},
+	}, 40, 1500*time.Millisecond)
+	stats.Duration = 3 * time.Second
+	require.Equal(t, &Stats{
+		Steps:               40,
+		CodeEvents:          3,
+		ServerEvents:        1,
+		Files:               2,
+		CoroutineCodeEvents: map[string]int{"root": 2, "my-coroutine": 1},
+		StepDuration:        1500 * time.Millisecond,
+		Duration:            3 * time.Second,
+	}, stats)
+	require.Equal(t, "40 steps, 3 code events in 2 files, 1 server events (my-coroutine: 1, root: 2), "+
+		"stepped for 1.5s of 3s", stats.String())
+}
@@ -0,0 +1,128 @@
+package tracer
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+)
+
+// Cache of normalized source file contents, and what is derived from them,
+// that evicts the least recently used files once the total size exceeds
+// maxBytes. If maxBytes is 0, nothing is ever evicted.
+type sourceCache struct {
+	maxBytes int
+	size     int
+	// Front is most recently used
+	order *list.List
+	files map[string]*list.Element
+}
+
+type sourceCacheEntry struct {
+	file   string
+	source string
+	// Only set once requested
+	lines      []string
+	tokenLines [][]chroma.Token
+	// Approximate bytes of the source and what is derived from it
+	size int
+}
+
+// Approximate bytes of a string or slice header and of a chroma.Token, used to
+// size derived entries since their strings share the source's memory
+const (
+	sourceCacheHeaderBytes = 24
+	sourceCacheTokenBytes  = 24
+)
+
+func newSourceCache(maxBytes int) *sourceCache {
+	return &sourceCache{maxBytes: maxBytes, order: list.New(), files: map[string]*list.Element{}}
+}
+
+// Get the source for the file, reading it if not cached. A leading UTF-8 BOM
+// is removed and "\r\n" line endings are normalized to "\n". A lone "\r" is
+// left as is since the Go compiler does not count it as a line break, so
+// replacing it would shift lines from the ones in debug info.
+func (s *sourceCache) get(file string) (string, error) {
+	entry, err := s.entry(file)
+	if err != nil {
+		return "", err
+	}
+	return entry.source, nil
+}
+
+// Get the lines of the source for the file as in get, without the empty line
+// after a final line break.
+func (s *sourceCache) lines(file string) ([]string, error) {
+	entry, err := s.entry(file)
+	if err != nil {
+		return nil, err
+	} else if entry.lines != nil {
+		return entry.lines, nil
+	}
+	entry.lines = strings.Split(strings.TrimSuffix(entry.source, "\n"), "\n")
+	s.grow(entry, len(entry.lines)*sourceCacheHeaderBytes)
+	return entry.lines, nil
+}
+
+// Get the source for the file as in get, tokenised as a whole so lexing is
+// accurate, and split into lines.
+func (s *sourceCache) tokenLines(file string) ([][]chroma.Token, error) {
+	entry, err := s.entry(file)
+	if err != nil {
+		return nil, err
+	} else if entry.tokenLines != nil {
+		return entry.tokenLines, nil
+	}
+	iter, err := tokeniseGo(entry.source)
+	if err != nil {
+		return nil, err
+	}
+	entry.tokenLines = chroma.SplitTokensIntoLines(iter.Tokens())
+	size := len(entry.tokenLines) * sourceCacheHeaderBytes
+	for _, line := range entry.tokenLines {
+		size += len(line) * sourceCacheTokenBytes
+	}
+	s.grow(entry, size)
+	return entry.tokenLines, nil
+}
+
+// Source of the code event's line, or empty if the file cannot be read or does
+// not have the line
+func (s *sourceCache) line(code *EventCode) string {
+	lines, err := s.lines(code.File)
+	if err != nil || code.Line < 1 || code.Line > len(lines) {
+		return ""
+	}
+	return lines[code.Line-1]
+}
+
+func (s *sourceCache) entry(file string) (*sourceCacheEntry, error) {
+	if elem := s.files[file]; elem != nil {
+		s.order.MoveToFront(elem)
+		return elem.Value.(*sourceCacheEntry), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %v: %w", file, err)
+	}
+	source := strings.ReplaceAll(strings.TrimPrefix(string(b), "\ufeff"), "\r\n", "\n")
+	entry := &sourceCacheEntry{file: file, source: source}
+	s.files[file] = s.order.PushFront(entry)
+	s.grow(entry, len(source))
+	return entry, nil
+}
+
+// Add to the size of the entry, which must be the most recently used, and
+// evict until under the max, but never that entry
+func (s *sourceCache) grow(entry *sourceCacheEntry, size int) {
+	entry.size += size
+	s.size += size
+	for s.maxBytes > 0 && s.size > s.maxBytes && s.order.Len() > 1 {
+		evicted := s.order.Remove(s.order.Back()).(*sourceCacheEntry)
+		delete(s.files, evicted.file)
+		s.size -= evicted.size
+	}
+}
@@ -0,0 +1,144 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// TextOptions are options for WriteText.
+type TextOptions struct {
+	// Use ANSI colors to distinguish server events, commands, and code lines.
+	// Callers are expected to only set this when writing to a terminal and the
+	// NO_COLOR environment variable is not set.
+	Color bool
+	// Only write the events of the final workflow task along with the event the
+	// replay failed on. See Result.FinalTaskEvents.
+	FinalTaskOnly bool
+}
+
+const (
+	ansiReset      = "\x1b[0m"
+	ansiBold       = "\x1b[1m"
+	ansiDim        = "\x1b[2m"
+	ansiServer     = "\x1b[1;36m"
+	ansiCommand    = "\x1b[33m"
+	ansiCoroutine  = "\x1b[35m"
+	ansiFailedOnID = "\x1b[1;31m"
+	ansiResult     = "\x1b[1;32m"
+)
+
+// WriteText writes a human-readable dump of the result's events. Consecutive
+// code events on contiguous lines of the same file and coroutine are collapsed
+// into a single line range and code events of coroutines other than the root
+// one are indented under a header with the coroutine name.
+func WriteText(w io.Writer, res *Result, opts TextOptions) error {
+	events := res.Events
+	if opts.FinalTaskOnly {
+		events = res.FinalTaskEvents()
+	}
+	tw := &textWriter{w: w, color: opts.Color}
+	lastFile, lastLine, lastCoroutine := "", -1, ""
+	// Code range not yet written, nil if none
+	var rangeStart *EventCode
+	flushRange := func() {
+		if rangeStart == nil {
+			return
+		}
+		indent := "\t"
+		if rangeStart.Coroutine != "" && rangeStart.Coroutine != rootCoroutineName {
+			indent = "\t\t"
+		}
+		tw.printf(ansiDim, "%v%v - ", indent, rangeStart.Package)
+		if rangeStart.Line == lastLine {
+			tw.printf("", "%v:%v\n", filepath.Base(rangeStart.File), lastLine)
+		} else {
+			tw.printf("", "%v:%v-%v\n", filepath.Base(rangeStart.File), rangeStart.Line, lastLine)
+		}
+		rangeStart = nil
+	}
+	for _, event := range events {
+		if event.Code == nil {
+			flushRange()
+		}
+		if event.Server != nil {
+			tw.printf(ansiServer, "Event %v - %v", event.Server.ID, event.Server.Type)
+			if details := event.Server.Details(); details != "" {
+				tw.printf("", " (%v)", details)
+			}
+			if event.Server.Note != "" {
+				tw.printf(ansiBold, " <- %v", event.Server.Note)
+			}
+			tw.printf("", "\n")
+			lastFile, lastLine, lastCoroutine = "", -1, ""
+		} else if event.Client != nil {
+			for i, command := range event.Client.Commands {
+				tw.printf(ansiCommand, "\tCommand - %v", command)
+				if details := event.Client.CommandDetails(i); details != "" {
+					tw.printf("", " (%v)", details)
+				}
+				tw.printf("", "\n")
+			}
+			lastFile, lastLine, lastCoroutine = "", -1, ""
+		} else if event.Code != nil {
+			// Ignore if matches last file and line, extend the range if the next
+			// line of the same file and coroutine. Lines after a gap are not
+			// included since the gap may be a call into another function.
+			sameRun := lastFile == event.Code.File && lastCoroutine == event.Code.Coroutine
+			if sameRun && lastLine == event.Code.Line {
+				continue
+			} else if sameRun && rangeStart != nil && event.Code.Line == lastLine+1 {
+				lastLine = event.Code.Line
+				continue
+			}
+			flushRange()
+			if event.Code.Coroutine != "" && event.Code.Coroutine != rootCoroutineName && event.Code.Coroutine != lastCoroutine {
+				tw.printf(ansiCoroutine, "\tCoroutine %v\n", event.Code.Coroutine)
+			}
+			rangeStart = event.Code
+			lastFile, lastLine, lastCoroutine = event.Code.File, event.Code.Line, event.Code.Coroutine
+		} else if event.Result != nil {
+			color := ansiResult
+			if event.Result.Error != "" {
+				color = ansiFailedOnID
+			}
+			tw.printf(color, "Workflow %v\n", event.Result.Details())
+			lastFile, lastLine, lastCoroutine = "", -1, ""
+		}
+	}
+	flushRange()
+	if opts.FinalTaskOnly {
+		// Last server event is the one replay failed on
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Server != nil {
+				tw.printf(ansiFailedOnID, "Failed on event %v - %v\n", events[i].Server.ID, events[i].Server.Type)
+				break
+			}
+		}
+	}
+	return tw.err
+}
+
+type textWriter struct {
+	w     io.Writer
+	color bool
+	err   error
+}
+
+// Writes the formatted string wrapped in the given color code if color is
+// enabled. The first error is kept and all writes after are skipped.
+func (t *textWriter) printf(color string, format string, v ...interface{}) {
+	if t.err != nil {
+		return
+	}
+	s := fmt.Sprintf(format, v...)
+	if t.color && color != "" {
+		// Keep trailing newline outside of the color
+		newline := ""
+		if len(s) > 0 && s[len(s)-1] == '\n' {
+			s, newline = s[:len(s)-1], "\n"
+		}
+		s = color + s + ansiReset + newline
+	}
+	_, t.err = io.WriteString(t.w, s)
+}
@@ -0,0 +1,98 @@
+package tracer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestWriteText(t *testing.T) {
+	res := &Result{Events: []*Event{
+		{Server: &EventServer{ID: 2, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_SCHEDULED)}},
+		{Server: &EventServer{ID: 3, Type: EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED), Note: "here"}},
+		{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: 10, Coroutine: "root"}},
+		{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: 10, Coroutine: "root"}},
+		{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: 20, Coroutine: "my-coroutine"}},
+		{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: 21, Coroutine: "my-coroutine"}},
+		{Client: &EventClient{
+			Commands: []EventClientCommandType{EventClientCommandType(enums.COMMAND_TYPE_START_TIMER)},
+			Details:  []*EventClientCommand{{Type: EventClientCommandType(enums.COMMAND_TYPE_START_TIMER), TimerID: "5"}},
+		}},
+	}}
+
+	// Plain
+	var b bytes.Buffer
+	require.NoError(t, WriteText(&b, res, TextOptions{}))
+	require.Equal(t, `Event 2 - WorkflowTaskScheduled
+Event 3 - WorkflowTaskStarted <- here
+	mypkg - workflow.go:10
+	Coroutine my-coroutine
+		mypkg - workflow.go:20-21
+	Command - StartTimer (timer ID: 5)
+`, b.String())
+
+	// Final task only
+	b.Reset()
+	require.NoError(t, WriteText(&b, res, TextOptions{FinalTaskOnly: true}))
+	require.Equal(t, `Event 3 - WorkflowTaskStarted <- here
+	mypkg - workflow.go:10
+	Coroutine my-coroutine
+		mypkg - workflow.go:20-21
+	Command - StartTimer (timer ID: 5)
+Failed on event 3 - WorkflowTaskStarted
+`, b.String())
+
+	// Colored
+	b.Reset()
+	require.NoError(t, WriteText(&b, res, TextOptions{Color: true}))
+	require.Contains(t, b.String(), ansiServer+"Event 2 - WorkflowTaskScheduled"+ansiReset+"\n")
+	require.Contains(t, b.String(), ansiCommand+"\tCommand - StartTimer"+ansiReset+" (timer ID: 5)\n")
+	require.Contains(t, b.String(), ansiCoroutine+"\tCoroutine my-coroutine"+ansiReset+"\n")
+}
+
+func TestWriteTextLineRanges(t *testing.T) {
+	code := func(line int, coroutine string) *Event {
+		return &Event{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: line, Coroutine: coroutine}}
+	}
+	// Long straight-line section, repeated lines are ignored
+	var events []*Event
+	for line := 10; line <= 25; line++ {
+		events = append(events, code(line, "root"), code(line, "root"))
+	}
+	events = append(events,
+		// A gap starts a new range, as does stepping back or another coroutine
+		code(40, "root"), code(41, "root"), code(12, "root"), code(30, "other"), code(31, "other"),
+		// Server events are a boundary
+		&Event{Server: &EventServer{ID: 5, Type: EventServerType(enums.EVENT_TYPE_TIMER_FIRED)}},
+		code(32, "other"), code(33, "other"),
+	)
+	var b bytes.Buffer
+	require.NoError(t, WriteText(&b, &Result{Events: events}, TextOptions{}))
+	require.Equal(t, `	mypkg - workflow.go:10-25
+	mypkg - workflow.go:40-41
+	mypkg - workflow.go:12
+	Coroutine other
+		mypkg - workflow.go:30-31
+Event 5 - TimerFired
+	Coroutine other
+		mypkg - workflow.go:32-33
+`, b.String())
+}
+
+func TestWriteTextResult(t *testing.T) {
+	res := &Result{Events: []*Event{
+		{Code: &EventCode{Package: "mypkg", File: "/src/workflow.go", Line: 10, Coroutine: "root"}},
+		{Result: &EventResult{Values: []string{`"done"`}}},
+	}}
+	var b bytes.Buffer
+	require.NoError(t, WriteText(&b, res, TextOptions{}))
+	require.Equal(t, "\tmypkg - workflow.go:10\nWorkflow returned \"done\"\n", b.String())
+
+	res.Events[1].Result = &EventResult{Error: "failed"}
+	b.Reset()
+	require.NoError(t, WriteText(&b, res, TextOptions{Color: true}))
+	require.Contains(t, b.String(), ansiFailedOnID+"Workflow error: failed"+ansiReset+"\n")
+	require.Equal(t, "returned no value", (&EventResult{}).Details())
+}
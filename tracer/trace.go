@@ -1,49 +1,140 @@
 package tracer
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-delve/delve/pkg/proc"
 	"github.com/go-delve/delve/service/api"
 	"github.com/go-delve/delve/service/debugger"
+	"go.temporal.io/api/enums/v1"
 )
 
 type trace struct {
 	*Tracer
+	// Temp dir containing the generated harness
+	dir string
+	// Dir the harness was built in, only differs from dir when the exe is from
+	// the build cache
+	buildDir     string
 	result       Result
 	debug        *debugger.Debugger
 	state        *api.DebuggerState
-	sourceCache  map[string]string
+	sourceCache  *sourceCache
 	packageFiles map[string]string
 	breakpoints  map[int]*breakpoint
+	// Key is file regexp, value is the only source file it matched
+	sourceFiles map[string]string
+	// Lazily resolved when multiple source files match
+	sdkInternalDir string
 	// Key is goroutine ID
 	coroutineNames map[int]string
+	// Key is goroutine ID, the scope of the last function a code event was
+	// recorded in since the scope only changes when the function does
+	scopes map[int]functionScope
+	// Expression for the coroutine name from the spawn args, set on first
+	// resolution so later spawns can load just the name
+	coroutineNameExpr string
+	// Key is coroutine name, only used when sampling
+	coroutineSteps map[string]int
+	// Incremented on each workflow task started event
+	currentTask int
+	// Key is goroutine ID, the qualified workflow function whose execution the
+	// coroutine belongs to. Set when a workflow function is entered and
+	// inherited by coroutines spawned after.
+	workflowFuncs map[int]string
+	// Goroutine of the last step in a coroutine with a workflow function. A
+	// newly spawned coroutine belongs to the same workflow since coroutines run
+	// one at a time.
+	lastWorkflowGoroutineID int
+	// Set once the user break location is reached, no more steps are captured
+	// after that
+	breakReached bool
+	// Set once an event past ReplayUntilEventID is processed
+	replayUntilReached bool
+	// Server events recorded, only used for progress
+	serverEvents int
+	// Only tracked when StartEventID is set
+	lastServerEventID int64
+	// Last recorded event, even if discarded from the result
+	lastEvent *Event
+	// Stats of every recorded event, even if discarded from the result
+	stats statsCounter
+	// Stops sending to Tracer.Events when the trace context is done
+	done <-chan struct{}
+	// Last workflow coroutine panic, only made the result failure if the replay
+	// fails since the panic may have been recovered
+	lastPanic *Failure
+	// Slash-separated with a trailing slash, the GOROOT src dir first then
+	// ExcludeDirs
+	excludeDirs []string
+}
+
+// Package of the SDK files with breakpoints
+const sdkInternalPkg = "go.temporal.io/sdk/internal"
+
+// Regexps for the normalized paths of the SDK internal files with breakpoints
+const matchInternalPkg = `.*/go\.temporal\.io/sdk.*/internal/`
+
+var (
+	matchInternalEventHandlers = regexp.MustCompile(matchInternalPkg + `internal_event_handlers\.go`)
+	matchInternalTaskHandlers  = regexp.MustCompile(matchInternalPkg + `internal_task_handlers\.go`)
+	matchInternalWorkflow      = regexp.MustCompile(matchInternalPkg + `internal_workflow\.go`)
+)
+
+// How often Config.OnProgress is called
+var progressInterval = time.Second
+
+type functionScope struct {
+	function string
+	scope    EventCodeScope
 }
 
 type breakpoint struct {
 	*api.Breakpoint
+	// What the breakpoint is for, used in diagnostics
+	name string
 	// Can be nil
 	handler func() error
+	// Number of times the breakpoint was hit
+	hits int
 }
 
-func (t *Tracer) newTrace(dir, exe string) (*trace, error) {
+func (t *Tracer) newTrace(ctx context.Context, dir, buildDir, exe string) (*trace, error) {
 	tr := &trace{
 		Tracer:         t,
-		sourceCache:    map[string]string{},
+		dir:            dir,
+		buildDir:       buildDir,
+		sourceCache:    newSourceCache(t.SourceCacheMaxBytes),
 		packageFiles:   map[string]string{},
 		breakpoints:    map[int]*breakpoint{},
 		coroutineNames: map[int]string{},
+		workflowFuncs:  map[int]string{},
+		scopes:         map[int]functionScope{},
+		coroutineSteps: map[string]int{},
+		sourceFiles:    map[string]string{},
+		done:           ctx.Done(),
 	}
 
 	// Create debugger
 	tr.Log.Debug("Starting debugger")
-	var err error
-	tr.debug, err = debugger.New(&debugger.Config{WorkingDir: dir, Backend: "default"}, []string{exe})
+	// Delve has no option for the launched process's environment, it inherits
+	// ours, so the replayer env vars are only set while launching
+	err := withEnv(tr.replayerEnv(), func() (err error) {
+		tr.debug, err = debugger.New(&debugger.Config{WorkingDir: dir, Backend: tr.DelveBackend}, []string{exe})
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed creating debugger: %w", err)
 	}
@@ -55,38 +146,81 @@ func (t *Tracer) newTrace(dir, exe string) (*trace, error) {
 		}
 	}()
 
+	if exe == tr.PrebuiltExe {
+		tr.checkPrebuiltExe()
+	}
+
+	// Stdlib is stepped out of, so it must be the GOROOT the harness was built
+	// with
+	if err := tr.resolveExcludeDirs(ctx); err != nil {
+		return nil, err
+	}
+
 	tr.Log.Debug("Setting breakpoints")
-	const (
-		matchInternalPkg           = `.*/go\.temporal\.io/sdk.*/internal/`
-		matchInternalEventHandlers = matchInternalPkg + `internal_event_handlers\.go`
-		matchInternalTaskHandlers  = matchInternalPkg + `internal_task_handlers\.go`
-		matchInternalWorkflow      = matchInternalPkg + `internal_workflow\.go`
-	)
-
-	// Add breakpoint for workflow start
-	var fnName string
-	if tr.fnStruct != "" {
-		fnName = tr.fnPkg + ".(*" + tr.fnStruct + ")." + tr.fn
-	} else {
-		fnName = tr.fnPkg + "." + tr.fn
+
+	// Determine the SDK version to know which code to set breakpoints on
+	sdkVersion, err := tr.detectSDKVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	anchors, err := anchorsForSDKVersion(sdkBreakpointAnchors, sdkVersion)
+	if err != nil {
+		return nil, err
+	}
+	tr.Log.Debug("Detected SDK version", "Version", sdkVersion)
+
+	// Add breakpoint for start of each workflow
+	for _, fn := range tr.fns {
+		fn := fn
+		handler := func() error {
+			tr.onWorkflowFunc(fn)
+			return nil
+		}
+		if err = tr.addFuncBreakpoint("workflow function "+fn.qualified, fn.symbol(), handler); err != nil {
+			err = tr.workflowFuncNotFoundError(fn, err)
+			break
+		}
 	}
-	err = tr.addFuncBreakpoint(fnName, nil)
 	// Add breakpoint for obtaining the event
 	if err == nil {
-		err = tr.addFileLineBreakpoint(matchInternalEventHandlers, "\tif event == nil {", tr.onProcessEvent)
+		err = tr.addFileLineBreakpoint("process event", matchInternalEventHandlers, anchors.processEvent, tr.onProcessEvent)
 	}
 	// Add breakpoint for obtaining the commands
 	if err == nil {
-		err = tr.addFileLineBreakpoint(matchInternalTaskHandlers, "if len(eventCommands) > 0 && !skipReplayCheck {",
-			tr.onReplayCommands)
+		err = tr.addFileLineBreakpoint("replay commands", matchInternalTaskHandlers, anchors.replayCommands, tr.onReplayCommands)
 	}
 	// Add breakpoint for coroutine spawning
 	if err == nil {
-		err = tr.addFileLineBreakpoint(matchInternalWorkflow, "\t\tf(spawned)", tr.populateCoroutineName)
+		err = tr.addFileLineBreakpoint("spawn coroutine", matchInternalWorkflow, anchors.spawnCoroutine, tr.populateCoroutineName)
 	}
 	// Add breakpoint for end of initial yield
 	if err == nil {
-		err = tr.addFileLineBreakpoint(matchInternalWorkflow, "\ts.blocked.Swap(false)", nil)
+		err = tr.addFileLineBreakpoint("end yield", matchInternalWorkflow, anchors.endYield, nil)
+	}
+	// Add breakpoint for the workflow result
+	if err == nil {
+		err = tr.addFileLineBreakpoint("complete", matchInternalWorkflow, anchors.complete, tr.onComplete)
+	}
+	// Add breakpoints for non-determinism errors
+	for kind, code := range anchors.nonDeterminism {
+		if err != nil {
+			break
+		}
+		kind := kind
+		err = tr.addFileLineBreakpoint("non-determinism "+kind, matchInternalTaskHandlers, code,
+			func() error { return tr.onNonDeterminism(kind) })
+	}
+	// Add breakpoint for panics to know where replay failed
+	if err == nil {
+		err = tr.addFuncBreakpoint("panic", "runtime.gopanic", tr.onPanic)
+	}
+	// Add breakpoint for user-requested stop location
+	if err == nil && tr.breakAtFile != "" {
+		err = tr.addBreakAtBreakpoint()
+	}
+	// Setting breakpoints can take a while, so don't start if cancelled
+	if err == nil {
+		err = tr.stopErr(ctx)
 	}
 	if err != nil {
 		return nil, err
@@ -96,6 +230,167 @@ func (t *Tracer) newTrace(dir, exe string) (*trace, error) {
 	return tr, nil
 }
 
+// For Config.PrebuiltExe, sets the build dir to the dir of the exe's main
+// package so its code is stepped out of like a generated harness. Also warns if
+// the workflow functions appear optimized since breakpoints may then be missed.
+func (t *trace) checkPrebuiltExe() {
+	bi := t.debug.Target().BinInfo()
+	if fn := bi.LookupFunc["main.main"]; fn != nil {
+		file, _, _ := bi.PCToLine(fn.Entry)
+		t.buildDir = filepath.Dir(file)
+	} else {
+		t.Log.Warn("No main.main in prebuilt exe, its main package code will be traced")
+	}
+	for _, wfFn := range t.fns {
+		if fn := bi.LookupFunc[wfFn.symbol()]; fn != nil && fn.Optimized() {
+			t.Log.Warn("Prebuilt exe appears to be optimized, breakpoints may be unreliable unless built with "+
+				`-gcflags="all=-N -l"`, "Function", wfFn.qualified)
+			break
+		}
+	}
+}
+
+// Sets the slash-terminated dirs to step out of, the src dir of the GOROOT of
+// the toolchain building the replayer first then Config.ExcludeDirs
+func (t *trace) resolveExcludeDirs(ctx context.Context) error {
+	out, err := t.goOutput(ctx, t.RootDir, "env", "GOROOT")
+	if err != nil {
+		return fmt.Errorf("failed resolving GOROOT: %w", err)
+	}
+	goRoot := strings.TrimSpace(string(out))
+	t.Log.Debug("Resolved GOROOT", "GOROOT", goRoot)
+	t.excludeDirs = []string{filepath.Join(goRoot, "src")}
+	for _, dir := range t.ExcludeDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("invalid exclude dir %v: %w", dir, err)
+		}
+		t.excludeDirs = append(t.excludeDirs, abs)
+	}
+	for i, dir := range t.excludeDirs {
+		t.excludeDirs[i] = strings.TrimSuffix(normalizePath(dir), "/") + "/"
+	}
+	return nil
+}
+
+// Code to match for internal SDK breakpoints, see addFileLineBreakpoint
+type breakpointAnchors struct {
+	// In internal_event_handlers.go where the event is available
+	processEvent string
+	// In internal_task_handlers.go where replay commands are available
+	replayCommands string
+	// In internal_workflow.go where a coroutine is spawned
+	spawnCoroutine string
+	// In internal_workflow.go at the end of the initial yield
+	endYield string
+	// In internal_workflow.go where the workflow result is completed
+	complete string
+	// In internal_task_handlers.go where each kind of non-determinism error is
+	// returned, keyed by NonDeterminism constant
+	nonDeterminism map[string]string
+}
+
+type sdkVersionRange struct {
+	// Inclusive
+	min string
+	// Exclusive
+	max string
+}
+
+func (s sdkVersionRange) String() string { return ">= " + s.min + " and < " + s.max }
+
+// Only versions the code was checked against are present. Ranges must not
+// overlap. Versions from v1.23.0 no longer have the replay commands code and
+// versions from v1.25.0 need a newer Go than the bundled Delve supports.
+var sdkBreakpointAnchors = map[sdkVersionRange]*breakpointAnchors{
+	{min: "v1.9.0", max: "v1.15.0"}: {
+		processEvent:   "if event == nil {",
+		replayCommands: "if len(eventCommands) > 0 && !skipReplayCheck {",
+		spawnCoroutine: "f(spawned)",
+		endYield:       "s.blocked.Swap(false)",
+		complete:       "env.Complete(rp.workflowResult, rp.error)",
+		nonDeterminism: map[string]string{
+			NonDeterminismMissingCommand: `return fmt.Errorf("nondeterministic workflow: missing replay command`,
+			NonDeterminismExtraCommand:   `return fmt.Errorf("nondeterministic workflow: extra replay command`,
+			NonDeterminismMismatch:       `return fmt.Errorf("nondeterministic workflow: history event is`,
+		},
+	},
+	// Non-determinism errors became history mismatch errors
+	{min: "v1.15.0", max: "v1.23.0"}: {
+		processEvent:   "if event == nil {",
+		replayCommands: "if len(eventCommands) > 0 && !skipReplayCheck {",
+		spawnCoroutine: "f(spawned)",
+		endYield:       "s.blocked.Swap(false)",
+		complete:       "env.Complete(rp.workflowResult, rp.error)",
+		nonDeterminism: map[string]string{
+			NonDeterminismMissingCommand: `return historyMismatchErrorf("nondeterministic workflow: missing replay command`,
+			NonDeterminismExtraCommand:   `return historyMismatchErrorf("nondeterministic workflow: extra replay command`,
+			NonDeterminismMismatch:       `return historyMismatchErrorf("nondeterministic workflow: history event is`,
+		},
+	},
+}
+
+var sdkSourceVersionRegexp = regexp.MustCompile(`/go\.temporal\.io/sdk@(v[^/]+)/`)
+
+// Detect the SDK version from the module cache path of the sources, falling
+// back to asking the Go tool for vendored or replaced modules
+func (t *trace) detectSDKVersion(ctx context.Context) (string, error) {
+	for _, file := range t.debug.Target().BinInfo().Sources {
+		if match := sdkSourceVersionRegexp.FindStringSubmatch(normalizePath(file)); match != nil {
+			return match[1], nil
+		}
+	}
+	// Same flags as the build so a vendor dir is used
+	args := append([]string{"list", "-m"}, t.goFlags()...)
+	out, err := t.goOutput(ctx, t.dir, append(args, "-f", "{{.Version}}", "go.temporal.io/sdk")...)
+	if err != nil {
+		return "", fmt.Errorf("failed detecting SDK version: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func anchorsForSDKVersion(anchors map[sdkVersionRange]*breakpointAnchors, version string) (*breakpointAnchors, error) {
+	var ranges []sdkVersionRange
+	for versionRange, anchor := range anchors {
+		if compareVersions(version, versionRange.min) >= 0 && compareVersions(version, versionRange.max) < 0 {
+			return anchor, nil
+		}
+		ranges = append(ranges, versionRange)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return compareVersions(ranges[i].min, ranges[j].min) < 0 })
+	rangeStrs := make([]string, len(ranges))
+	for i, versionRange := range ranges {
+		rangeStrs[i] = versionRange.String()
+	}
+	return nil, fmt.Errorf("SDK version %v not supported, supported versions: %v",
+		version, strings.Join(rangeStrs, ", "))
+}
+
+// Compares the major, minor, and patch of the versions ignoring any
+// pre-release or build suffix. Invalid pieces are treated as 0.
+func compareVersions(a, b string) int {
+	aPieces, bPieces := versionPieces(a), versionPieces(b)
+	for i := range aPieces {
+		if aPieces[i] < bPieces[i] {
+			return -1
+		} else if aPieces[i] > bPieces[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionPieces(version string) (pieces [3]int) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	for i, piece := range strings.SplitN(version, ".", 3) {
+		pieces[i], _ = strconv.Atoi(piece)
+	}
+	return
+}
+
 func (t *trace) close() {
 	t.Log.Debug("Halting debugger")
 	if _, err := t.debug.Command(&api.DebuggerCommand{Name: api.Halt}, nil); err != nil {
@@ -107,28 +402,85 @@ func (t *trace) close() {
 	}
 }
 
-func (t *trace) run() error {
+func (t *trace) run(ctx context.Context) (err error) {
+	// Halt the debugger when the context is done so that a command waiting on
+	// the process returns and the loop below can stop
+	runDone := make(chan struct{})
+	defer close(runDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Log.Debug("Context done, halting debugger")
+			if _, err := t.debug.Command(&api.DebuggerCommand{Name: api.Halt}, nil); err != nil {
+				t.Log.Debug("Failed halting", "Error", err)
+			}
+		case <-runDone:
+		}
+	}()
+
+	// Halting the debugger above can make whatever command was running fail, so
+	// prefer the reason we stopped
+	defer func() {
+		if stopErr := t.stopErr(ctx); err != nil && stopErr != nil {
+			err = stopErr
+		}
+	}()
+
+	// Record breakpoint hits however we return
+	defer func() {
+		t.result.Diagnostics = &Diagnostics{Breakpoints: t.breakpointHits()}
+		for _, bp := range t.result.Diagnostics.NeverHit() {
+			t.Log.Debug("Breakpoint never hit", "Name", bp.Name, "Function", bp.Function, "File", bp.File, "Line", bp.Line)
+		}
+	}()
+
 	// Continue until the breakpoint is hit
 	t.Log.Debug("Starting execution")
-	var err error
 	t.state, err = t.debug.Command(&api.DebuggerCommand{Name: api.Continue}, nil)
 	if err != nil {
 		return fmt.Errorf("failed starting execution: %w", err)
 	}
 
-	// Step until runtime exit
-	for !t.state.Exited {
+	// Step until runtime exit or the break location is reached
+	steps := 0
+	started := time.Now()
+	lastProgress := started
+	defer func() { t.result.Stats = t.stats.finish(steps, time.Since(started)) }()
+	for !t.state.Exited && !t.breakReached {
+		// Stop if the context is done or too many steps have been taken
+		if err := t.stopErr(ctx); err != nil {
+			return err
+		}
+		if t.MaxSteps > 0 && steps >= t.MaxSteps {
+			return fmt.Errorf("%w of %v", ErrMaxSteps, t.MaxSteps)
+		}
+		steps++
+		if t.OnProgress != nil && time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			t.OnProgress(Progress{
+				ServerEvents: t.serverEvents,
+				Steps:        steps,
+				File:         t.state.CurrentThread.File,
+				Line:         t.state.CurrentThread.Line,
+				Elapsed:      lastProgress.Sub(started),
+			})
+		}
 
 		// If we have hit a breakpoint, capture it
 		var bp *breakpoint
 		if t.state.CurrentThread.Breakpoint != nil {
 			bp = t.breakpoints[t.state.CurrentThread.Breakpoint.ID]
+			bp.hits++
 			// Run handler if set
 			if bp.handler != nil {
 				if err := bp.handler(); err != nil {
 					return err
 				}
 			}
+			if t.replayUntilReached {
+				t.Log.Debug("Task boundary reached, stopping capture", "EventID", t.ReplayUntilEventID)
+				break
+			}
 		}
 
 		// If there is a next in progress, it means a breakpoint was hit while
@@ -142,10 +494,7 @@ func (t *trace) run() error {
 
 		// Check if the file or the function matches any exclusion regexes. If it
 		// does, we want to step out. This is important for performance.
-		shouldStepOut :=
-			matchesAnyRegexp(filepath.ToSlash(t.state.CurrentThread.File), ImpliedExcludeFiles, t.ExcludeFiles) ||
-				matchesAnyRegexp(t.state.CurrentThread.Function.Name(), ImpliedExcludeFuncs, t.ExcludeFuncs)
-		if shouldStepOut {
+		if t.shouldStepOut(t.state.CurrentThread.File, t.state.CurrentThread.Function.Name()) {
 			// If the function is runtime.goexit, we cannot step out because there is
 			// nothing to step out to
 			if strings.HasPrefix(t.state.CurrentThread.Function.Name(), "runtime.goexit") {
@@ -159,15 +508,53 @@ func (t *trace) run() error {
 			continue
 		}
 
-		// This is a line that represents an event if there is a file
-		if t.state.CurrentThread.File != "" {
+		// This is a line that represents an event if there is a file and it is
+		// sampled
+		coroutine := t.coroutineNames[t.state.CurrentThread.GoroutineID]
+		if _, ok := t.workflowFuncs[t.state.CurrentThread.GoroutineID]; ok {
+			t.lastWorkflowGoroutineID = t.state.CurrentThread.GoroutineID
+		}
+		if t.state.CurrentThread.File != "" &&
+			t.shouldRecord(t.state.CurrentThread.File, t.state.CurrentThread.Function.Name()) &&
+			t.inCoroutineFilter(coroutine) && t.sampled(coroutine) {
 			pkg, _ := t.debug.CurrentPackage()
-			t.result.Events = append(t.result.Events, &Event{Code: &EventCode{
-				Package:   pkg,
-				File:      t.state.CurrentThread.File,
-				Line:      t.state.CurrentThread.Line,
-				Coroutine: t.coroutineNames[t.state.CurrentThread.GoroutineID],
-			}})
+			var scope EventCodeScope
+			if scope, err = t.currentScope(coroutine); err != nil {
+				return err
+			}
+			event := &EventCode{
+				Package:      pkg,
+				File:         t.state.CurrentThread.File,
+				Line:         t.state.CurrentThread.Line,
+				Coroutine:    coroutine,
+				Scope:        scope,
+				Task:         t.currentTask,
+				WorkflowFunc: t.workflowFuncs[t.state.CurrentThread.GoroutineID],
+			}
+			// Locals and stack are extra detail, so failing to load them only
+			// leaves them unset instead of failing the trace
+			if t.shouldCaptureLocals(pkg) {
+				if locals, err := t.loadLocals(); err != nil {
+					t.Log.Warn("Unable to capture locals", "File", event.File, "Line", event.Line, "Error", err)
+				} else {
+					event.Locals = locals
+				}
+			}
+			if t.CaptureStack {
+				if stack, err := t.loadStack(); err != nil {
+					t.Log.Warn("Unable to capture stack", "File", event.File, "Line", event.Line, "Error", err)
+				} else {
+					event.Stack = stack
+				}
+			}
+			t.addEvent(&Event{Code: event})
+		}
+
+		// Stop capturing if the break location was reached, we do this after
+		// recording the line so it is the last one in the result
+		if t.breakReached {
+			t.Log.Debug("Break location reached, stopping capture", "Location", t.BreakAt)
+			break
 		}
 
 		// Do a normal step
@@ -179,76 +566,413 @@ func (t *trace) run() error {
 
 	// If there was a failure, fail
 	if t.state.Exited && t.state.ExitStatus != 0 {
+		t.result.Failure = t.lastPanic
+	}
+	if t.state.Exited && t.state.ExitStatus != 0 && t.result.NonDeterminismError != nil {
+		return fmt.Errorf("failed with exit status %v: %w", t.state.ExitStatus, t.result.NonDeterminismError)
+	} else if t.state.Exited && t.state.ExitStatus != 0 {
 		return fmt.Errorf("failed with exit status: %v", t.state.ExitStatus)
 	}
 
 	return nil
 }
 
-// Breakpoint created for last line of code to match
-func (t *trace) addFileLineBreakpoint(fileRegex string, codeToMatch string, handler func() error) error {
-	// Find the file name
-	// TODO(cretz): Cache this lookup too?
-	var file string
-	fileRegexp, err := regexp.Compile(fileRegex)
+// Whether the given file and function should be stepped out of. This includes
+// all code in the generated harness regardless of function name since it may
+// have closures.
+func (t *trace) shouldStepOut(file, fn string) bool {
+	return (file != "" && t.inHarnessDir(file)) ||
+		t.inExcludeDir(file) ||
+		matchesAnyRegexp(filepath.ToSlash(file), ImpliedExcludeFiles, t.ExcludeFiles) ||
+		matchesAnyRegexp(fn, ImpliedExcludeFuncs, t.ExcludeFuncs) ||
+		(!t.IncludeTemporalInternal && matchesAnyRegexp(fn, ImpliedTemporalInternalExcludeFuncs))
+}
+
+// Whether the file is directly in the temp or build dir of the harness
+func (t *trace) inHarnessDir(file string) bool {
+	dir := path.Dir(normalizePath(file))
+	return dir == normalizePath(t.dir) || dir == normalizePath(t.buildDir)
+}
+
+func (t *trace) inExcludeDir(file string) bool {
+	file = normalizePath(file)
+	for _, dir := range t.excludeDirs {
+		if strings.HasPrefix(file, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// OS whose path rules normalizePath follows, only changed in tests
+var pathOS = runtime.GOOS
+
+// Normalizes a file path for comparison. Paths are slash-separated and, on
+// Windows where Delve may report a different case or separator than the file
+// system, lowercased.
+func normalizePath(file string) string {
+	if pathOS != "windows" {
+		return filepath.ToSlash(file)
+	}
+	return strings.ToLower(strings.ReplaceAll(file, `\`, "/"))
+}
+
+// Whether the code step matches the include patterns, if any
+func (t *trace) shouldRecord(file, fn string) bool {
+	if len(t.IncludeFuncs) == 0 && len(t.IncludeFiles) == 0 {
+		return true
+	}
+	return matchesAnyRegexp(filepath.ToSlash(file), t.IncludeFiles) || matchesAnyRegexp(fn, t.IncludeFuncs)
+}
+
+// Whether the coroutine is in the coroutine filter, if any
+func (t *trace) inCoroutineFilter(coroutine string) bool {
+	if len(t.CoroutineFilter) == 0 {
+		return true
+	}
+	for _, name := range t.CoroutineFilter {
+		if name == coroutine {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the current code step should be recorded based on the sample rate.
+// The count is per coroutine so coroutines with few steps are not entirely
+// dropped.
+func (t *trace) sampled(coroutine string) bool {
+	if t.SampleRate <= 1 {
+		return true
+	}
+	step := t.coroutineSteps[coroutine]
+	t.coroutineSteps[coroutine] = step + 1
+	return step%t.SampleRate == 0
+}
+
+func (t *trace) shouldCaptureLocals(pkg string) bool {
+	if !t.CaptureLocals {
+		return false
+	} else if len(t.CaptureLocalsPackages) == 0 {
+		for _, fn := range t.fns {
+			if pkg == fn.pkg {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prefix := range t.CaptureLocalsPackages {
+		if strings.HasPrefix(pkg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *trace) loadLocals() ([]EventCodeLocal, error) {
+	vars, err := t.debug.LocalVariables(t.state.CurrentThread.GoroutineID, 0, 0, proc.LoadConfig{
+		FollowPointers: true, MaxStringLen: 64, MaxArrayValues: 16, MaxStructFields: -1, MaxVariableRecurse: 1,
+	})
 	if err != nil {
-		return fmt.Errorf("invalid file regex: %w", err)
+		return nil, fmt.Errorf("failed loading locals: %w", err)
 	}
-	for _, maybeFile := range t.debug.Target().BinInfo().Sources {
-		if fileRegexp.MatchString(maybeFile) {
-			if file != "" {
-				return fmt.Errorf("both %v and %v match %v", file, maybeFile, fileRegex)
+	locals := make([]EventCodeLocal, len(vars))
+	for i, v := range vars {
+		locals[i] = EventCodeLocal{Name: v.Name, Value: api.ConvertVar(v).SinglelineString()}
+	}
+	return locals, nil
+}
+
+func (t *trace) loadStack() ([]StackFrame, error) {
+	// Depth is frames below the current one
+	frames, err := t.debug.Stacktrace(t.state.CurrentThread.GoroutineID, t.StackDepth-1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading stack: %w", err)
+	}
+	return stackFrames(frames), nil
+}
+
+// Frames deep enough to reach the SDK function running the code
+const scopeStackDepth = 50
+
+// SDK functions that run user code other than the workflow and coroutines.
+// Closures of these (e.g. "SideEffect.func1") also match.
+var scopeSDKFuncs = []struct {
+	prefix string
+	scope  EventCodeScope
+}{
+	{"go.temporal.io/sdk/internal.(*workflowEnvironmentImpl).SideEffect", EventCodeScopeSideEffect},
+	{"go.temporal.io/sdk/internal.(*workflowEnvironmentImpl).MutableSideEffect", EventCodeScopeSideEffect},
+	{"go.temporal.io/sdk/internal.(*localActivityTaskHandler).", EventCodeScopeLocalActivity},
+	{"go.temporal.io/sdk/internal.(*activityTaskHandlerImpl).", EventCodeScopeActivity},
+}
+
+func (t *trace) currentScope(coroutine string) (EventCodeScope, error) {
+	goroutineID := t.state.CurrentThread.GoroutineID
+	function := t.state.CurrentThread.Function.Name()
+	if last, ok := t.scopes[goroutineID]; ok && last.function == function {
+		return last.scope, nil
+	}
+	frames, err := t.debug.Stacktrace(goroutineID, scopeStackDepth, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed loading stack: %w", err)
+	}
+	functions := make([]string, 0, len(frames))
+	for _, frame := range stackFrames(frames) {
+		functions = append(functions, frame.Function)
+	}
+	scope := scopeFromStack(coroutine, functions)
+	t.scopes[goroutineID] = functionScope{function, scope}
+	return scope, nil
+}
+
+// Scope from the innermost SDK function running user code, falling back to
+// the coroutine. Functions are innermost first.
+func scopeFromStack(coroutine string, functions []string) EventCodeScope {
+	for _, function := range functions {
+		for _, sdkFunc := range scopeSDKFuncs {
+			if strings.HasPrefix(function, sdkFunc.prefix) {
+				return sdkFunc.scope
 			}
-			file = maybeFile
 		}
 	}
-	if file == "" {
-		return fmt.Errorf("unable to find file matching %v", fileRegex)
+	switch coroutine {
+	case "":
+		return ""
+	case rootCoroutineName:
+		return EventCodeScopeWorkflow
+	default:
+		return EventCodeScopeCoroutine
 	}
+}
 
-	// Get source lines
-	source := t.sourceCache[file]
-	if source == "" {
-		// Read it and split into lines
-		b, err := os.ReadFile(file)
-		if err != nil {
-			return fmt.Errorf("failed reading %v: %w", file, err)
+func stackFrames(frames []proc.Stackframe) []StackFrame {
+	stack := make([]StackFrame, 0, len(frames))
+	for _, frame := range frames {
+		if frame.Err != nil {
+			break
+		}
+		var fn string
+		if frame.Call.Fn != nil {
+			fn = frame.Call.Fn.Name
 		}
-		source = strings.ReplaceAll(string(b), "\r\n", "\n")
-		t.sourceCache[file] = source
+		stack = append(stack, StackFrame{Function: fn, File: frame.Call.File, Line: frame.Call.Line})
+	}
+	return stack
+}
+
+// Breakpoint created for the line containing the code to match. Whitespace is
+// normalized in both the code and the source lines so formatting changes do
+// not affect matching.
+func (t *trace) addFileLineBreakpoint(name string, fileRegexp *regexp.Regexp, codeToMatch string, handler func() error) error {
+	file, err := t.sourceFile(fileRegexp)
+	if err != nil {
+		return err
+	}
+
+	// Get source lines
+	source, err := t.sourceCache.get(file)
+	if err != nil {
+		return err
 	}
 
 	// Find line for code to match
-	codeIndex := strings.Index(source, codeToMatch)
-	if codeIndex == -1 {
-		return fmt.Errorf("cannot find matching code on %v", file)
-	} else if strings.LastIndex(source, codeToMatch) != codeIndex {
-		return fmt.Errorf("code found twice in %v", file)
+	code := normalizeCodeLine(codeToMatch)
+	line, err := findMatchingLine(source, func(line string) bool { return strings.Contains(line, code) })
+	if err != nil {
+		return fmt.Errorf("%w in %v", err, file)
 	}
-	line := strings.Count(source[:codeIndex+len(codeToMatch)], "\n") + 1
 
 	// Add the breakpoint
 	bp, err := t.debug.CreateBreakpoint(&api.Breakpoint{File: file, Line: line})
 	if err != nil {
 		return err
 	}
-	t.breakpoints[bp.ID] = &breakpoint{Breakpoint: bp, handler: handler}
+	t.breakpoints[bp.ID] = &breakpoint{Breakpoint: bp, name: name, handler: handler}
 	return nil
 }
 
-func (t *trace) addFuncBreakpoint(fn string, handler func() error) error {
+// The only source file of the binary matching the regexp. If several match,
+// e.g. a vendored and a module cache copy of the SDK, the one in the SDK dir
+// resolved by the Go tool is preferred. Results are cached since several
+// breakpoints are usually in the same file.
+func (t *trace) sourceFile(fileRegexp *regexp.Regexp) (string, error) {
+	if file, ok := t.sourceFiles[fileRegexp.String()]; ok {
+		return file, nil
+	}
+	files := matchingSourceFiles(t.debug.Target().BinInfo().Sources, fileRegexp)
+	if len(files) > 1 {
+		if sdkDir, err := t.resolveSDKInternalDir(); err != nil {
+			t.Log.Debug("Unable to resolve SDK dir to choose source file", "Error", err)
+		} else if preferred := filesInDir(files, sdkDir); len(preferred) == 1 {
+			t.Log.Debug("Multiple source files match, using the one in the SDK dir", "Regexp", fileRegexp,
+				"Candidates", files, "Chosen", preferred[0])
+			files = preferred
+		}
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("unable to find file matching %v", fileRegexp)
+	} else if len(files) > 1 {
+		return "", fmt.Errorf("multiple files match %v: %v", fileRegexp, strings.Join(files, ", "))
+	}
+	t.sourceFiles[fileRegexp.String()] = files[0]
+	return files[0], nil
+}
+
+// Dir of the SDK internal package as resolved by the Go tool for the harness,
+// which is the vendor dir when vendoring
+func (t *trace) resolveSDKInternalDir() (string, error) {
+	if t.sdkInternalDir != "" {
+		return t.sdkInternalDir, nil
+	}
+	args := append([]string{"list"}, t.goFlags()...)
+	out, err := t.goOutput(context.Background(), t.dir, append(args, "-f", "{{.Dir}}", sdkInternalPkg)...)
+	if err != nil {
+		return "", err
+	}
+	t.sdkInternalDir = strings.TrimSpace(string(out))
+	return t.sdkInternalDir, nil
+}
+
+// Sources whose normalized path matches the regexp
+func matchingSourceFiles(sources []string, fileRegexp *regexp.Regexp) []string {
+	var files []string
+	for _, file := range sources {
+		if fileRegexp.MatchString(normalizePath(file)) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Files directly in the dir, compared normalized
+func filesInDir(files []string, dir string) []string {
+	dir = strings.TrimSuffix(normalizePath(dir), "/")
+	var inDir []string
+	for _, file := range files {
+		if path.Dir(normalizePath(file)) == dir {
+			inDir = append(inDir, file)
+		}
+	}
+	return inDir
+}
+
+// Returns the 1-based line number of the only line that matches after being
+// normalized
+func findMatchingLine(source string, matches func(line string) bool) (int, error) {
+	line := -1
+	for i, sourceLine := range strings.Split(source, "\n") {
+		if matches(normalizeCodeLine(sourceLine)) {
+			if line != -1 {
+				return 0, fmt.Errorf("code found twice")
+			}
+			line = i + 1
+		}
+	}
+	if line == -1 {
+		return 0, fmt.Errorf("cannot find matching code")
+	}
+	return line, nil
+}
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// Trims and collapses all whitespace to a single space
+func normalizeCodeLine(line string) string {
+	return whitespaceRegexp.ReplaceAllString(strings.TrimSpace(line), " ")
+}
+
+func (t *trace) addFuncBreakpoint(name, fn string, handler func() error) error {
 	bp, err := t.debug.CreateBreakpoint(&api.Breakpoint{FunctionName: fn})
 	if err != nil {
 		return err
 	}
-	t.breakpoints[bp.ID] = &breakpoint{Breakpoint: bp, handler: handler}
+	t.breakpoints[bp.ID] = &breakpoint{Breakpoint: bp, name: name, handler: handler}
+	return nil
+}
+
+// Breakpoint created for the user-requested break location with the hit count
+// condition if present
+func (t *trace) addBreakAtBreakpoint() error {
+	var file string
+	for _, maybeFile := range t.debug.Target().BinInfo().Sources {
+		normFile := normalizePath(maybeFile)
+		if normFile == t.breakAtFile || strings.HasSuffix(normFile, "/"+t.breakAtFile) {
+			if file != "" {
+				return fmt.Errorf("both %v and %v match break location %v", file, maybeFile, t.BreakAt)
+			}
+			file = maybeFile
+		}
+	}
+	if file == "" {
+		return fmt.Errorf("unable to find file matching break location %v", t.BreakAt)
+	}
+	bp := &api.Breakpoint{File: file, Line: t.breakAtLine}
+	if t.BreakCount > 1 {
+		bp.HitCond = "== " + strconv.Itoa(t.BreakCount)
+	}
+	bp, err := t.debug.CreateBreakpoint(bp)
+	if err != nil {
+		return fmt.Errorf("failed creating breakpoint at %v: %w", t.BreakAt, err)
+	}
+	t.breakpoints[bp.ID] = &breakpoint{Breakpoint: bp, name: "break at " + t.BreakAt, handler: func() error {
+		t.breakReached = true
+		return nil
+	}}
 	return nil
 }
 
+// Error if the context is done, using ErrTraceTimeout if it is from
+// TraceTimeout
+func (t *trace) stopErr(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	} else if errors.Is(err, context.DeadlineExceeded) && t.TraceTimeout > 0 {
+		return fmt.Errorf("%w after %v", ErrTraceTimeout, t.TraceTimeout)
+	}
+	return fmt.Errorf("trace stopped: %w", err)
+}
+
+// Hits of each breakpoint in the order they were created
+func (t *trace) breakpointHits() []*BreakpointHits {
+	ids := make([]int, 0, len(t.breakpoints))
+	for id := range t.breakpoints {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	hits := make([]*BreakpointHits, len(ids))
+	for i, id := range ids {
+		bp := t.breakpoints[id]
+		hits[i] = &BreakpointHits{Name: bp.name, Function: bp.FunctionName, File: bp.File, Line: bp.Line, Hits: bp.hits}
+	}
+	return hits
+}
+
+// Builds an error for when the workflow function breakpoint could not be set
+// that includes similar function names from the binary
+func (t *trace) workflowFuncNotFoundError(wfFn *workflowFunc, err error) error {
+	fnName := wfFn.symbol()
+	var candidates []string
+	for _, fn := range t.debug.Target().BinInfo().Functions {
+		if fn.BaseName() == wfFn.name || (fn.PackageName() == wfFn.pkg && !strings.Contains(fn.Name, ".func")) {
+			candidates = append(candidates, fn.Name)
+			if len(candidates) >= 10 {
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("failed setting breakpoint on workflow function %v, no similar functions found: %w", fnName, err)
+	}
+	return fmt.Errorf("failed setting breakpoint on workflow function %v, similar functions: %v: %w",
+		fnName, strings.Join(candidates, ", "), err)
+}
+
 func (t *trace) onProcessEvent() error {
 	// Need the event and type from function args
 	vars, err := t.debug.FunctionArguments(t.state.CurrentThread.GoroutineID, 0, 0, proc.LoadConfig{
-		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: 1, MaxStructFields: -1,
+		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: 1, MaxStructFields: -1, MaxVariableRecurse: 6,
 	})
 	if err != nil {
 		return fmt.Errorf("failed loading vars: %w", err)
@@ -270,60 +994,446 @@ func (t *trace) onProcessEvent() error {
 					event.Type = EventServerType(i)
 				}
 			}
+			// After the ID so it can be logged
+			t.populateServerEventDetails(&event, arg)
 		}
 	}
-	t.result.Events = append(t.result.Events, &Event{Server: &event})
+	// Past the task boundary, stop capturing without recording the event
+	if t.ReplayUntilEventID > 0 && event.ID > t.ReplayUntilEventID {
+		t.replayUntilReached = true
+		return nil
+	}
+	event.Note = t.EventNotes[event.ID]
+	if enums.EventType(event.Type) == enums.EVENT_TYPE_WORKFLOW_TASK_STARTED {
+		t.currentTask++
+	}
+	t.addEvent(&Event{Server: &event})
 	return nil
 }
 
+// Sets activity and timer details from the attributes of the event variable
+func (t *trace) populateServerEventDetails(event *EventServer, eventVar api.Variable) {
+	if attrs, ok := childVar(eventVar, "Attributes", "ActivityTaskScheduledEventAttributes"); ok {
+		if v, ok := childVar(attrs, "ActivityType", "Name"); ok {
+			event.ActivityType = v.Value
+		}
+		if v, ok := childVar(attrs, "ActivityId"); ok {
+			event.ActivityID = v.Value
+		}
+	} else if attrs, ok := childVar(eventVar, "Attributes", "TimerStartedEventAttributes"); ok {
+		if v, ok := childVar(attrs, "TimerId"); ok {
+			event.TimerID = v.Value
+		}
+		if v, ok := childVar(attrs, "StartToFireTimeout"); ok {
+			if nanos, err := strconv.ParseInt(v.Value, 10, 64); err != nil {
+				t.Log.Debug("Unable to parse timer duration", "EventID", event.ID, "Value", v.Value, "Error", err)
+			} else {
+				event.TimerDuration = time.Duration(nanos).String()
+			}
+		}
+	}
+}
+
+// Walks the variable by the given field names, dereferencing pointers and
+// interfaces along the way. Returns false if any are missing or nil.
+func childVar(v api.Variable, names ...string) (api.Variable, bool) {
+	deref := func(v api.Variable) (api.Variable, bool) {
+		for v.Kind == reflect.Ptr || v.Kind == reflect.Interface {
+			// Nil pointers have a zero-address child and nil interfaces have
+			// no or invalid children
+			if len(v.Children) == 0 || v.Children[0].Kind == reflect.Invalid ||
+				(v.Kind == reflect.Ptr && v.Children[0].Addr == 0) {
+				return v, false
+			}
+			v = v.Children[0]
+		}
+		return v, true
+	}
+	var ok bool
+	if v, ok = deref(v); !ok {
+		return v, false
+	}
+	for _, name := range names {
+		found := false
+		for _, child := range v.Children {
+			if child.Name == name {
+				v, found = child, true
+				break
+			}
+		}
+		if !found {
+			return v, false
+		} else if v, ok = deref(v); !ok {
+			return v, false
+		}
+	}
+	return v, true
+}
+
 func (t *trace) onReplayCommands() error {
-	// Get "completedRequest" function arg which has "commands" array
-	vars, err := t.debug.LocalVariables(t.state.CurrentThread.GoroutineID, 0, 0, proc.LoadConfig{
-		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: 100, MaxStructFields: -1, MaxVariableRecurse: 3,
+	// Get "eventCommands" local which is the commands slice. We first load
+	// only the slice header to get the length since most calls have no
+	// commands and the deep load is the expensive part.
+	goroutineID := t.state.CurrentThread.GoroutineID
+	v, err := t.debug.EvalVariableInScope(goroutineID, 0, 0, "eventCommands", proc.LoadConfig{})
+	if err != nil {
+		return fmt.Errorf("failed loading commands: %w", err)
+	} else if v.Len == 0 {
+		return nil
+	}
+	// Now load the commands deep enough to reach the attributes of each
+	v, err = t.debug.EvalVariableInScope(goroutineID, 0, 0, "eventCommands", proc.LoadConfig{
+		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: int(v.Len), MaxStructFields: -1, MaxVariableRecurse: 6,
 	})
 	if err != nil {
-		return fmt.Errorf("failed loading vars: %w", err)
+		return fmt.Errorf("failed loading commands: %w", err)
 	}
-	// TODO(cretz): This is expensive!
-	var commands []EventClientCommandType
-	for _, arg := range api.ConvertVars(vars) {
-		if arg.Name == "eventCommands" {
-			for _, command := range arg.Children {
-				val := command.Children[0].Children[0].Value
-				i, err := intInTrailingParens(val)
-				if err != nil {
-					return fmt.Errorf("invalid command type %q: %w", val, err)
-				}
-				commands = append(commands, EventClientCommandType(i))
-			}
+	var client EventClient
+	for _, commandVar := range api.ConvertVar(v).Children {
+		command, err := commandFromVar(commandVar)
+		if err != nil {
+			return err
+		}
+		client.Commands = append(client.Commands, command.Type)
+		client.Details = append(client.Details, command)
+	}
+	if len(client.Commands) > 0 {
+		client.Task = t.currentTask
+		t.addEvent(&Event{Client: &client})
+	}
+	return nil
+}
+
+func (t *trace) onComplete() error {
+	goroutineID := t.state.CurrentThread.GoroutineID
+	loadConfig := proc.LoadConfig{
+		FollowPointers: true, MaxStringLen: 500, MaxArrayValues: 1024, MaxStructFields: -1, MaxVariableRecurse: 4,
+	}
+	var result EventResult
+	v, err := t.debug.EvalVariableInScope(goroutineID, 0, 0, "rp.workflowResult", loadConfig)
+	if err != nil {
+		return fmt.Errorf("failed loading workflow result: %w", err)
+	}
+	result.Values = payloadValues(api.ConvertVar(v))
+	if v, err = t.debug.EvalVariableInScope(goroutineID, 0, 0, "rp.error", loadConfig); err != nil {
+		return fmt.Errorf("failed loading workflow error: %w", err)
+	}
+	result.Error = errorMessage(api.ConvertVar(v))
+	t.addEvent(&Event{Result: &result})
+	return nil
+}
+
+// Values of a *Payloads variable, nil if the pointer is nil
+func payloadValues(v *api.Variable) []string {
+	payloadsVar, ok := childVar(*v, "Payloads")
+	if !ok {
+		return nil
+	}
+	var values []string
+	for _, payloadVar := range payloadsVar.Children {
+		dataVar, _ := childVar(payloadVar, "Data")
+		data := make([]byte, 0, len(dataVar.Children))
+		for _, b := range dataVar.Children {
+			n, _ := strconv.Atoi(b.Value)
+			data = append(data, byte(n))
+		}
+		switch {
+		case int64(len(data)) < dataVar.Len || !utf8.Valid(data):
+			values = append(values, fmt.Sprintf("<%v bytes>", dataVar.Len))
+		case len(data) == 0:
+			values = append(values, "null")
+		default:
+			values = append(values, string(data))
+		}
+	}
+	return values
+}
+
+// Message of an error interface variable, empty if nil. The message field of
+// common error types is used since methods cannot be called, falling back to
+// the fields of the error.
+func errorMessage(v *api.Variable) string {
+	errVar, ok := childVar(*v)
+	if !ok {
+		return ""
+	}
+	for _, field := range []string{"msg", "message", "s"} {
+		if child, ok := childVar(errVar, field); ok && child.Kind == reflect.String {
+			return child.Value
+		}
+	}
+	return errVar.SinglelineString()
+}
+
+// Builds a command from a *Command variable
+func commandFromVar(commandVar api.Variable) (*EventClientCommand, error) {
+	typeVar, ok := childVar(commandVar, "CommandType")
+	if !ok {
+		return nil, fmt.Errorf("command missing type")
+	}
+	i, err := intInTrailingParens(typeVar.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command type %q: %w", typeVar.Value, err)
+	}
+	command := &EventClientCommand{Type: EventClientCommandType(i)}
+	if v, ok := childVar(commandVar, "Attributes", "ScheduleActivityTaskCommandAttributes", "ActivityType", "Name"); ok {
+		command.ActivityType = v.Value
+	} else if v, ok := childVar(commandVar, "Attributes", "StartTimerCommandAttributes", "TimerId"); ok {
+		command.TimerID = v.Value
+	} else if v, ok := childVar(commandVar, "Attributes", "StartChildWorkflowExecutionCommandAttributes",
+		"WorkflowType", "Name"); ok {
+		command.ChildWorkflowType = v.Value
+	}
+	return command, nil
+}
+
+func (t *trace) onNonDeterminism(kind string) error {
+	cfg := proc.LoadConfig{
+		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: 10, MaxStructFields: -1, MaxVariableRecurse: 5,
+	}
+	// History event "e" and replay command "d"
+	var eventVar, commandVar *api.Variable
+	if kind != NonDeterminismExtraCommand {
+		v, err := t.debug.EvalVariableInScope(t.state.CurrentThread.GoroutineID, 0, 0, "e", cfg)
+		if err != nil {
+			return fmt.Errorf("failed loading history event: %w", err)
+		}
+		eventVar = api.ConvertVar(v)
+	}
+	if kind != NonDeterminismMissingCommand {
+		v, err := t.debug.EvalVariableInScope(t.state.CurrentThread.GoroutineID, 0, 0, "d", cfg)
+		if err != nil {
+			return fmt.Errorf("failed loading replay command: %w", err)
+		}
+		commandVar = api.ConvertVar(v)
+	}
+	nonDetErr, err := nonDeterminismErrorFromVars(kind, eventVar, commandVar)
+	if err != nil {
+		return err
+	}
+	t.result.NonDeterminismError = nonDetErr
+	return nil
+}
+
+// Builds the error from the optional history event and replay command vars
+func nonDeterminismErrorFromVars(kind string, eventVar, commandVar *api.Variable) (*NonDeterminismError, error) {
+	nonDetErr := &NonDeterminismError{Kind: kind}
+	if eventVar != nil {
+		if v, ok := childVar(*eventVar, "EventId"); !ok {
+			return nil, fmt.Errorf("history event missing ID")
+		} else if id, err := strconv.ParseInt(v.Value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid event ID %v: %w", v.Value, err)
+		} else {
+			nonDetErr.EventID = id
+		}
+		if v, ok := childVar(*eventVar, "EventType"); !ok {
+			return nil, fmt.Errorf("history event missing type")
+		} else if i, err := intInTrailingParens(v.Value); err != nil {
+			return nil, fmt.Errorf("invalid event type %q: %w", v.Value, err)
+		} else {
+			nonDetErr.EventType = EventServerType(i)
+			nonDetErr.ExpectedCommandType = EventClientCommandType(eventCommandType(enums.EventType(i)))
+		}
+	}
+	if commandVar != nil {
+		command, err := commandFromVar(*commandVar)
+		if err != nil {
+			return nil, err
+		}
+		nonDetErr.ActualCommand = command
+	}
+	return nonDetErr, nil
+}
+
+func (t *trace) addEvent(event *Event) {
+	// Nothing before the start event is recorded, but the server event is
+	// still counted as processed
+	if event.Server != nil {
+		t.serverEvents++
+	}
+	if t.StartEventID > 0 {
+		if event.Server != nil {
+			t.lastServerEventID = event.Server.ID
+		}
+		if t.lastServerEventID < t.StartEventID {
+			return
+		}
+	}
+	if !t.KeepDuplicateLines && t.lastEvent != nil && isDuplicateCode(t.lastEvent.Code, event.Code) {
+		return
+	}
+	t.lastEvent = event
+	t.stats.add(event)
+	if event.Code == nil || !t.DiscardCodeEvents {
+		t.result.Events = append(t.result.Events, event)
+	}
+	if t.OnEvent != nil {
+		t.OnEvent(event)
+	}
+	if t.events != nil {
+		select {
+		case t.events <- event:
+		case <-t.done:
+		}
+	}
+}
+
+// Whether the code event is the same line in the same coroutine and task as the
+// last one. Events with different captured locals or stacks are not duplicates.
+func isDuplicateCode(last, event *EventCode) bool {
+	if last == nil || event == nil || last.File != event.File || last.Line != event.Line ||
+		last.Coroutine != event.Coroutine || last.Task != event.Task || len(last.Locals) != len(event.Locals) ||
+		len(last.Stack) != len(event.Stack) {
+		return false
+	}
+	for i, local := range last.Locals {
+		if local != event.Locals[i] {
+			return false
+		}
+	}
+	for i, frame := range last.Stack {
+		if frame != event.Stack[i] {
+			return false
 		}
 	}
-	if len(commands) > 0 {
-		t.result.Events = append(t.result.Events, &Event{Client: &EventClient{Commands: commands}})
+	return true
+}
+
+func (t *trace) onPanic() error {
+	// Only panics in workflow code are relevant
+	goroutineID := t.state.CurrentThread.GoroutineID
+	coroutine, ok := t.coroutineNames[goroutineID]
+	if !ok {
+		return nil
+	}
+	failure := &Failure{Coroutine: coroutine}
+	args, err := t.debug.FunctionArguments(goroutineID, 0, 0, proc.LoadConfig{
+		FollowPointers: true, MaxStringLen: 500, MaxArrayValues: 16, MaxStructFields: -1, MaxVariableRecurse: 2,
+	})
+	if err != nil {
+		return fmt.Errorf("failed loading panic value: %w", err)
+	} else if len(args) > 0 {
+		failure.Message = panicMessage(api.ConvertVar(args[0]))
+	}
+	frames, err := t.debug.Stacktrace(goroutineID, scopeStackDepth, 0)
+	if err != nil {
+		return fmt.Errorf("failed loading stack: %w", err)
 	}
+	for _, frame := range stackFrames(frames) {
+		if strings.HasPrefix(frame.Function, "runtime.") && len(failure.Stack) == 0 {
+			continue
+		}
+		failure.Stack = append(failure.Stack, frame)
+	}
+	setLocation := func(frame StackFrame) {
+		failure.Function, failure.File, failure.Line = frame.Function, frame.File, frame.Line
+	}
+	if len(failure.Stack) > 0 {
+		setLocation(failure.Stack[0])
+	}
+	for _, frame := range failure.Stack {
+		if !t.shouldStepOut(frame.File, frame.Function) {
+			setLocation(frame)
+			break
+		}
+	}
+	t.Log.Debug("Workflow panicked", "Message", failure.Message, "File", failure.File, "Line", failure.Line)
+	t.lastPanic = failure
 	return nil
 }
 
+// Message of the interface value given to panic. Strings are shown unquoted,
+// errors and other values as their fields since methods cannot be called.
+func panicMessage(v *api.Variable) string {
+	if v.Kind == reflect.Interface && len(v.Children) == 1 {
+		v = &v.Children[0]
+	}
+	if v.Kind == reflect.String {
+		return v.Value
+	}
+	return v.SinglelineString()
+}
+
+// SDK name of the coroutine the workflow function runs in
+const rootCoroutineName = "root"
+
+func (t *trace) onWorkflowFunc(fn *workflowFunc) {
+	t.workflowFuncs[t.state.CurrentThread.GoroutineID] = fn.qualified
+	// The workflow function always starts on the root coroutine, so name it in
+	// case its spawn was not seen (e.g. a breakpoint anchor that did not hit)
+	if _, ok := t.coroutineNames[t.state.CurrentThread.GoroutineID]; !ok {
+		t.coroutineNames[t.state.CurrentThread.GoroutineID] = rootCoroutineName
+	}
+}
+
 func (t *trace) populateCoroutineName() error {
+	// Names never change once set
+	goroutineID := t.state.CurrentThread.GoroutineID
+	if _, ok := t.coroutineNames[goroutineID]; ok {
+		return nil
+	}
+	if fn, ok := t.workflowFuncs[t.lastWorkflowGoroutineID]; ok {
+		t.workflowFuncs[goroutineID] = fn
+	}
+	// If we've resolved the name before, only load that
+	if t.coroutineNameExpr != "" {
+		v, err := t.debug.EvalVariableInScope(goroutineID, 0, 0, t.coroutineNameExpr, proc.LoadConfig{MaxStringLen: 200})
+		if err == nil && v.Unreadable == nil {
+			t.coroutineNames[goroutineID] = api.ConvertVar(v).Value
+			return nil
+		}
+		t.Log.Debug("Failed loading coroutine name, falling back to all args", "Expr", t.coroutineNameExpr)
+	}
 	// Get function args which has "crt" which has "name"
-	vars, err := t.debug.FunctionArguments(t.state.CurrentThread.GoroutineID, 0, 0, proc.LoadConfig{
+	vars, err := t.debug.FunctionArguments(goroutineID, 0, 0, proc.LoadConfig{
 		FollowPointers: true, MaxStringLen: 200, MaxArrayValues: 1, MaxStructFields: -1, MaxVariableRecurse: 2,
 	})
 	if err != nil {
 		return fmt.Errorf("failed loading vars: %w", err)
 	}
-	// TODO(cretz): This is expensive!
-	for _, arg := range api.ConvertVars(vars) {
-		if arg.Name == "crt" {
-			for _, child := range arg.Children[0].Children {
-				if child.Name == "name" {
-					t.coroutineNames[t.state.CurrentThread.GoroutineID] = child.Value
-					return nil
-				}
+	if name, expr, ok := coroutineNameFromArgs(api.ConvertVars(vars)); ok {
+		t.coroutineNames[goroutineID] = name
+		t.coroutineNameExpr = expr
+	} else {
+		t.Log.Debug("Unable to resolve coroutine name from spawn args, coroutine will be blank",
+			"GoroutineID", goroutineID)
+	}
+	return nil
+}
+
+// Gets the coroutine name from the "name" field of the "crt" arg. If the SDK
+// has renamed the arg, this falls back to the first arg that is a struct (or
+// pointer to one) with a string "name" field. The expression to evaluate for
+// the name is also returned.
+func coroutineNameFromArgs(args []api.Variable) (name, expr string, ok bool) {
+	nameField := func(arg *api.Variable) (string, bool) {
+		// Deref pointer
+		if arg.Kind == reflect.Ptr && len(arg.Children) > 0 {
+			arg = &arg.Children[0]
+		}
+		if arg.Kind != reflect.Struct {
+			return "", false
+		}
+		for _, child := range arg.Children {
+			if child.Name == "name" && child.Kind == reflect.String {
+				return child.Value, true
 			}
 		}
+		return "", false
 	}
-	return nil
+	for i := range args {
+		if args[i].Name == "crt" {
+			if name, ok := nameField(&args[i]); ok {
+				return name, "crt.name", true
+			}
+		}
+	}
+	for i := range args {
+		if name, ok := nameField(&args[i]); ok {
+			return name, args[i].Name + ".name", true
+		}
+	}
+	return "", "", false
 }
 
 func intInTrailingParens(str string) (int, error) {
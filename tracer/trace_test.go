@@ -0,0 +1,505 @@
+package tracer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-delve/delve/pkg/proc"
+	"github.com/go-delve/delve/service/api"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestShouldStepOut(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "debug-go-trace-123")
+	tr := &trace{
+		Tracer: &Tracer{Config: Config{
+			ExcludeFuncs: []*regexp.Regexp{regexp.MustCompile(`^mypkg\.Excluded$`)},
+			ExcludeFiles: []*regexp.Regexp{regexp.MustCompile(`/excluded/[^/]*\.go$`)},
+		}},
+		dir:         dir,
+		excludeDirs: []string{"/goroot/src/", "/myvendor/"},
+	}
+	// Harness main and its closures
+	require.True(t, tr.shouldStepOut(filepath.Join(dir, "main.go"), "main.main"))
+	require.True(t, tr.shouldStepOut(filepath.Join(dir, "main.go"), "main.main.func1"))
+	// Implied and user exclusions
+	require.True(t, tr.shouldStepOut("/somewhere/foo.go", "go.temporal.io/sdk/internal.foo"))
+	require.True(t, tr.shouldStepOut("/somewhere/foo.go", "mypkg.Excluded"))
+	require.True(t, tr.shouldStepOut("/somewhere/excluded/foo.go", "mypkg.MyHelper"))
+	// GOROOT and other exclude dirs
+	require.True(t, tr.shouldStepOut("/goroot/src/sort/sort.go", "sort.Strings"))
+	require.True(t, tr.shouldStepOut("/myvendor/foo/foo.go", "foo.Foo"))
+	require.False(t, tr.shouldStepOut("/myvendorother/foo/foo.go", "foo.Foo"))
+	// Workflow code
+	require.False(t, tr.shouldStepOut("/somewhere/workflow.go", "mypkg.MyWorkflow"))
+	require.False(t, tr.shouldStepOut("/somewhere/workflow.go", "mypkg.MyWorkflow.func1"))
+
+	// Temporal internal code is only stepped through if included, runtime is
+	// still excluded
+	tr.IncludeTemporalInternal = true
+	require.False(t, tr.shouldStepOut("/somewhere/foo.go", "go.temporal.io/sdk/internal.foo"))
+	require.True(t, tr.shouldStepOut("/somewhere/proc.go", "runtime.gopark"))
+	require.True(t, tr.shouldStepOut("/goroot/src/sort/sort.go", "sort.Strings"))
+}
+
+func TestWindowsPaths(t *testing.T) {
+	defer func(prev string) { pathOS = prev }(pathOS)
+	pathOS = "windows"
+	require.Equal(t, "c:/go/src/sort/sort.go", normalizePath(`C:\Go\src\sort\sort.go`))
+	require.Equal(t, "c:/go/src/sort/sort.go", normalizePath("c:/Go/src/sort/sort.go"))
+
+	tr := &trace{
+		Tracer:      &Tracer{},
+		dir:         `C:\Users\me\debug-go-trace-123`,
+		excludeDirs: []string{normalizePath(`C:\Go\src`) + "/"},
+	}
+	// Delve may report a different case and separator than the dirs
+	require.True(t, tr.shouldStepOut("c:/users/me/debug-go-trace-123/main.go", "main.main"))
+	require.True(t, tr.shouldStepOut("C:/GO/SRC/sort/sort.go", "sort.Strings"))
+	require.True(t, tr.shouldStepOut(`c:\go\src\sort\sort.go`, "sort.Strings"))
+	require.False(t, tr.shouldStepOut(`C:\Users\me\app\workflow.go`, "mypkg.MyWorkflow"))
+
+	// Break location lookup compares normalized
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	config.BreakAt = `App\Workflow.go:12`
+	withBreak, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, "app/workflow.go", withBreak.breakAtFile)
+}
+
+func TestShouldRecord(t *testing.T) {
+	tr := &trace{Tracer: &Tracer{}}
+	require.True(t, tr.shouldRecord("/somewhere/workflow.go", "mypkg.MyWorkflow"))
+	tr.IncludeFuncs = []*regexp.Regexp{regexp.MustCompile(`^mypkg\.`)}
+	tr.IncludeFiles = []*regexp.Regexp{regexp.MustCompile(`/activities/`)}
+	require.True(t, tr.shouldRecord("/somewhere/workflow.go", "mypkg.MyWorkflow"))
+	require.True(t, tr.shouldRecord("/somewhere/activities/act.go", "otherpkg.MyActivity"))
+	require.False(t, tr.shouldRecord("/somewhere/helper.go", "otherpkg.Helper"))
+}
+
+func TestInCoroutineFilter(t *testing.T) {
+	tr := &trace{Tracer: &Tracer{}}
+	require.True(t, tr.inCoroutineFilter("root"))
+	tr.CoroutineFilter = []string{"my-coroutine"}
+	require.True(t, tr.inCoroutineFilter("my-coroutine"))
+	require.False(t, tr.inCoroutineFilter("root"))
+}
+
+func TestOnWorkflowFuncNamesRoot(t *testing.T) {
+	tr := &trace{
+		Tracer:         &Tracer{},
+		coroutineNames: map[int]string{},
+		workflowFuncs:  map[int]string{},
+		state:          &api.DebuggerState{CurrentThread: &api.Thread{GoroutineID: 5}},
+	}
+	tr.onWorkflowFunc(&workflowFunc{qualified: "example.com/foo.MyWorkflow"})
+	require.Equal(t, map[int]string{5: "example.com/foo.MyWorkflow"}, tr.workflowFuncs)
+	require.Equal(t, map[int]string{5: "root"}, tr.coroutineNames)
+
+	// Names from spawning are kept
+	tr.coroutineNames[5] = "my-coroutine"
+	tr.onWorkflowFunc(&workflowFunc{qualified: "example.com/foo.MyWorkflow"})
+	require.Equal(t, "my-coroutine", tr.coroutineNames[5])
+}
+
+func TestFindMatchingLine(t *testing.T) {
+	const source = "package foo\n\nfunc foo() {\n  if   event == nil {  \n\t\treturn\n\t}\n}\n"
+	code := normalizeCodeLine("\tif event == nil {")
+	line, err := findMatchingLine(source, func(line string) bool { return strings.Contains(line, code) })
+	require.NoError(t, err)
+	require.Equal(t, 4, line)
+
+	// Ambiguous and missing
+	_, err = findMatchingLine(source+"if event == nil {\n", func(line string) bool { return strings.Contains(line, code) })
+	require.EqualError(t, err, "code found twice")
+	_, err = findMatchingLine(source, func(line string) bool { return strings.Contains(line, "nope") })
+	require.EqualError(t, err, "cannot find matching code")
+}
+
+func TestSourceLineEndings(t *testing.T) {
+	cache := newSourceCache(0)
+	code := normalizeCodeLine("if event == nil {")
+	matches := func(line string) bool { return strings.Contains(line, code) }
+
+	// BOM is removed and CRLF is a single line break
+	source, err := cache.get("testdata/source_bom.go.txt")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(source, "package foo\n"))
+	line, err := findMatchingLine(source, matches)
+	require.NoError(t, err)
+	require.Equal(t, 4, line)
+
+	// Lone CR is not a line break to the Go compiler, so it must not shift the
+	// lines after it
+	source, err = cache.get("testdata/source_cr.go.txt")
+	require.NoError(t, err)
+	line, err = findMatchingLine(source, matches)
+	require.NoError(t, err)
+	require.Equal(t, 4, line)
+}
+
+func TestSourceCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	fileA, fileB := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	require.NoError(t, os.WriteFile(fileA, []byte("package a\n\nvar A = 1\n"), 0644))
+	require.NoError(t, os.WriteFile(fileB, []byte("package b\n"), 0644))
+
+	// Derived lines and tokens count toward the size
+	cache := newSourceCache(100)
+	lines, err := cache.lines(fileA)
+	require.NoError(t, err)
+	require.Equal(t, []string{"package a", "", "var A = 1"}, lines)
+	require.Equal(t, "var A = 1", cache.line(&EventCode{File: fileA, Line: 3}))
+	require.Empty(t, cache.line(&EventCode{File: fileA, Line: 4}))
+	require.Equal(t, 21+3*sourceCacheHeaderBytes, cache.size)
+	tokenLines, err := cache.tokenLines(fileA)
+	require.NoError(t, err)
+	require.Len(t, tokenLines, 3)
+	require.Greater(t, cache.size, 100)
+	require.Len(t, cache.files, 1)
+
+	// Adding another evicts the least recently used
+	_, err = cache.get(fileB)
+	require.NoError(t, err)
+	require.Len(t, cache.files, 1)
+	require.Equal(t, 10, cache.size)
+	require.Empty(t, cache.line(&EventCode{File: filepath.Join(dir, "missing.go"), Line: 1}))
+}
+
+func TestMatchingSourceFiles(t *testing.T) {
+	sources := []string{
+		"/mod/go.temporal.io/sdk@v1.11.1/internal/internal_workflow.go",
+		"/mod/go.temporal.io/sdk@v1.11.1/internal/internal_task_handlers.go",
+		"/app/workflow.go",
+		"/app/vendor/go.temporal.io/sdk/internal/internal_workflow.go",
+	}
+	files := matchingSourceFiles(sources, matchInternalWorkflow)
+	require.Equal(t, []string{sources[0], sources[3]}, files)
+	require.Empty(t, matchingSourceFiles(sources[1:3], matchInternalWorkflow))
+
+	// Ambiguity is resolved by the SDK dir
+	require.Equal(t, []string{sources[3]}, filesInDir(files, "/app/vendor/go.temporal.io/sdk/internal/"))
+	require.Equal(t, []string{sources[0]}, filesInDir(files, "/mod/go.temporal.io/sdk@v1.11.1/internal"))
+	require.Empty(t, filesInDir(files, "/mod/go.temporal.io/sdk@v1.11.1"))
+}
+
+// Scanning the sources of a large binary, which is done once per file regexp
+// now that lookups are cached on the trace
+func BenchmarkMatchSourceFile(b *testing.B) {
+	sources := make([]string, 0, 50000)
+	for i := 0; i < cap(sources)-1; i++ {
+		sources = append(sources, "/mod/example.com/pkg"+strconv.Itoa(i%500)+"/file"+strconv.Itoa(i)+".go")
+	}
+	sources = append(sources, "/mod/go.temporal.io/sdk@v1.11.1/internal/internal_workflow.go")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if files := matchingSourceFiles(sources, matchInternalWorkflow); len(files) != 1 {
+			b.Fatalf("expected 1 file, got %v", files)
+		}
+	}
+}
+
+func TestAnchorsForSDKVersion(t *testing.T) {
+	missingCommand := func(anchors *breakpointAnchors) string {
+		return anchors.nonDeterminism[NonDeterminismMissingCommand]
+	}
+
+	actual, err := anchorsForSDKVersion(sdkBreakpointAnchors, "v1.11.1")
+	require.NoError(t, err)
+	require.Equal(t, `return fmt.Errorf("nondeterministic workflow: missing replay command`, missingCommand(actual))
+	actual, err = anchorsForSDKVersion(sdkBreakpointAnchors, "v1.14.2-0.20220310170000-60c98e9cbfe2")
+	require.NoError(t, err)
+	require.Equal(t, `return fmt.Errorf("nondeterministic workflow: missing replay command`, missingCommand(actual))
+	actual, err = anchorsForSDKVersion(sdkBreakpointAnchors, "v1.15.0")
+	require.NoError(t, err)
+	require.Equal(t, `return historyMismatchErrorf("nondeterministic workflow: missing replay command`,
+		missingCommand(actual))
+	actual, err = anchorsForSDKVersion(sdkBreakpointAnchors, "v1.20.0")
+	require.NoError(t, err)
+	require.Equal(t, `return historyMismatchErrorf("nondeterministic workflow: missing replay command`,
+		missingCommand(actual))
+
+	const supported = "supported versions: >= v1.9.0 and < v1.15.0, >= v1.15.0 and < v1.23.0"
+	_, err = anchorsForSDKVersion(sdkBreakpointAnchors, "v1.8.0")
+	require.EqualError(t, err, "SDK version v1.8.0 not supported, "+supported)
+	_, err = anchorsForSDKVersion(sdkBreakpointAnchors, "v1.25.1")
+	require.EqualError(t, err, "SDK version v1.25.1 not supported, "+supported)
+}
+
+func TestCoroutineNameFromArgs(t *testing.T) {
+	coroutineState := func(fieldName string) api.Variable {
+		return api.Variable{Kind: reflect.Ptr, Children: []api.Variable{{
+			Kind: reflect.Struct,
+			Children: []api.Variable{
+				{Name: "id", Kind: reflect.Int, Value: "5"},
+				{Name: fieldName, Kind: reflect.String, Value: "root"},
+			},
+		}}}
+	}
+
+	// Happy path
+	crt := coroutineState("name")
+	crt.Name = "crt"
+	other := coroutineState("name")
+	other.Name = "other"
+	other.Children[0].Children[1].Value = "not-this"
+	name, expr, ok := coroutineNameFromArgs([]api.Variable{other, crt})
+	require.True(t, ok)
+	require.Equal(t, "root", name)
+	require.Equal(t, "crt.name", expr)
+
+	// Fallback when arg is renamed
+	renamed := coroutineState("name")
+	renamed.Name = "state"
+	name, expr, ok = coroutineNameFromArgs([]api.Variable{{Name: "f", Kind: reflect.Func}, renamed})
+	require.True(t, ok)
+	require.Equal(t, "root", name)
+	require.Equal(t, "state.name", expr)
+
+	// Fails when field is renamed too
+	renamed = coroutineState("coroutineName")
+	renamed.Name = "state"
+	_, _, ok = coroutineNameFromArgs([]api.Variable{renamed})
+	require.False(t, ok)
+}
+
+func TestPopulateServerEventDetails(t *testing.T) {
+	ptrTo := func(v api.Variable) api.Variable {
+		return api.Variable{Name: v.Name, Kind: reflect.Ptr, Children: []api.Variable{v}}
+	}
+	eventVar := func(attrsName string, attrs ...api.Variable) api.Variable {
+		attrsVar := ptrTo(api.Variable{Name: attrsName, Kind: reflect.Struct, Addr: 1, Children: attrs})
+		wrapper := ptrTo(api.Variable{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{attrsVar}})
+		return ptrTo(api.Variable{Name: "event", Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+			{Name: "EventId", Kind: reflect.Int64, Value: "5"},
+			{Name: "Attributes", Kind: reflect.Interface, Children: []api.Variable{wrapper}},
+		}})
+	}
+
+	var debugLogs []string
+	tr := &trace{Tracer: &Tracer{Config: Config{Log: LoggerFunc(func(level, msg string, keyVals ...interface{}) {
+		debugLogs = append(debugLogs, msg)
+	})}}}
+	var event EventServer
+	tr.populateServerEventDetails(&event, eventVar("ActivityTaskScheduledEventAttributes",
+		api.Variable{Name: "ActivityId", Kind: reflect.String, Value: "5"},
+		ptrTo(api.Variable{Name: "ActivityType", Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+			{Name: "Name", Kind: reflect.String, Value: "MyActivity"},
+		}}),
+	))
+	require.Equal(t, EventServer{ActivityType: "MyActivity", ActivityID: "5"}, event)
+	require.Equal(t, "activity type: MyActivity, activity ID: 5", event.Details())
+
+	event = EventServer{}
+	tr.populateServerEventDetails(&event, eventVar("TimerStartedEventAttributes",
+		api.Variable{Name: "TimerId", Kind: reflect.String, Value: "7"},
+		ptrTo(api.Variable{Name: "StartToFireTimeout", Kind: reflect.Int64, Addr: 1, Value: "90000000000"}),
+	))
+	require.Equal(t, EventServer{TimerID: "7", TimerDuration: "1m30s"}, event)
+
+	// Unparseable duration is logged and left unset
+	event = EventServer{}
+	tr.populateServerEventDetails(&event, eventVar("TimerStartedEventAttributes",
+		api.Variable{Name: "TimerId", Kind: reflect.String, Value: "7"},
+		ptrTo(api.Variable{Name: "StartToFireTimeout", Kind: reflect.Int64, Addr: 1, Value: "unreadable"}),
+	))
+	require.Equal(t, EventServer{TimerID: "7"}, event)
+	require.Equal(t, []string{"Unable to parse timer duration"}, debugLogs)
+
+	// Nil attributes are ignored
+	event = EventServer{}
+	tr.populateServerEventDetails(&event, ptrTo(api.Variable{Name: "event", Kind: reflect.Struct, Addr: 1,
+		Children: []api.Variable{{Name: "Attributes", Kind: reflect.Interface}}}))
+	require.Equal(t, EventServer{}, event)
+}
+
+func TestCommandFromVar(t *testing.T) {
+	ptrTo := func(v api.Variable) api.Variable {
+		return api.Variable{Name: v.Name, Kind: reflect.Ptr, Children: []api.Variable{v}}
+	}
+	attrs := ptrTo(api.Variable{Name: "ScheduleActivityTaskCommandAttributes", Kind: reflect.Struct, Addr: 1,
+		Children: []api.Variable{
+			{Name: "ActivityId", Kind: reflect.String, Value: "5"},
+			ptrTo(api.Variable{Name: "ActivityType", Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+				{Name: "Name", Kind: reflect.String, Value: "MyActivity"},
+			}}),
+		}})
+	commandVar := ptrTo(api.Variable{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+		{Name: "CommandType", Kind: reflect.Int32, Value: "COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK (1)"},
+		{Name: "Attributes", Kind: reflect.Interface, Children: []api.Variable{
+			ptrTo(api.Variable{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{attrs}}),
+		}},
+	}})
+	command, err := commandFromVar(commandVar)
+	require.NoError(t, err)
+	require.Equal(t, &EventClientCommand{
+		Type:         EventClientCommandType(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK),
+		ActivityType: "MyActivity",
+	}, command)
+	require.Equal(t, "activity type: MyActivity", command.Details())
+}
+
+func TestAddEventDuplicateCode(t *testing.T) {
+	tr := &trace{Tracer: &Tracer{}}
+	code := func(line int, locals ...EventCodeLocal) *Event {
+		return &Event{Code: &EventCode{File: "/foo.go", Line: line, Coroutine: "root", Locals: locals}}
+	}
+	tr.addEvent(code(1))
+	tr.addEvent(code(1))
+	tr.addEvent(code(2))
+	tr.addEvent(code(2, EventCodeLocal{Name: "i", Value: "1"}))
+	tr.addEvent(code(2, EventCodeLocal{Name: "i", Value: "1"}))
+	tr.addEvent(&Event{Server: &EventServer{}})
+	tr.addEvent(code(2))
+	require.Len(t, tr.result.Events, 5)
+
+	tr = &trace{Tracer: &Tracer{Config: Config{KeepDuplicateLines: true}}}
+	tr.addEvent(code(1))
+	tr.addEvent(code(1))
+	require.Len(t, tr.result.Events, 2)
+}
+
+func TestAddEventDiscardCodeEvents(t *testing.T) {
+	var streamed []*Event
+	tr := &trace{Tracer: &Tracer{Config: Config{
+		DiscardCodeEvents: true,
+		OnEvent:           func(event *Event) { streamed = append(streamed, event) },
+	}}}
+	server := &Event{Server: &EventServer{ID: 1}}
+	code := &Event{Code: &EventCode{File: "/foo.go", Line: 1, Coroutine: "root"}}
+	tr.addEvent(server)
+	tr.addEvent(code)
+	tr.addEvent(code)
+	require.Equal(t, []*Event{server}, tr.result.Events)
+	require.Equal(t, []*Event{server, code}, streamed)
+	stats := tr.stats.finish(3, 0)
+	require.Equal(t, 1, stats.CodeEvents)
+	require.Equal(t, 1, stats.ServerEvents)
+}
+
+func TestAddEventStartEventID(t *testing.T) {
+	tr := &trace{Tracer: &Tracer{Config: Config{StartEventID: 3}}}
+	code := &Event{Code: &EventCode{File: "/foo.go", Line: 1, Coroutine: "root"}}
+	tr.addEvent(&Event{Server: &EventServer{ID: 1}})
+	tr.addEvent(code)
+	tr.addEvent(&Event{Server: &EventServer{ID: 3}})
+	tr.addEvent(code)
+	require.Equal(t, []*Event{{Server: &EventServer{ID: 3}}, code}, tr.result.Events)
+	require.Equal(t, 2, tr.serverEvents)
+}
+
+func TestStackFrames(t *testing.T) {
+	stack := stackFrames([]proc.Stackframe{
+		{Call: proc.Location{File: "/foo.go", Line: 3, Fn: &proc.Function{Name: "foo.helper"}}},
+		{Call: proc.Location{File: "/foo.go", Line: 10, Fn: &proc.Function{Name: "foo.MyWorkflow"}}},
+		{Call: proc.Location{File: "/unknown.go", Line: 1}},
+		{Err: errors.New("unreadable"), Call: proc.Location{File: "/bar.go", Line: 1}},
+	})
+	require.Equal(t, []StackFrame{
+		{Function: "foo.helper", File: "/foo.go", Line: 3},
+		{Function: "foo.MyWorkflow", File: "/foo.go", Line: 10},
+		{File: "/unknown.go", Line: 1},
+	}, stack)
+
+	// Different stacks on the same line are not duplicates
+	last := &EventCode{File: "/foo.go", Line: 3, Stack: stack[:2]}
+	require.True(t, isDuplicateCode(last, &EventCode{File: "/foo.go", Line: 3, Stack: stack[:2]}))
+	require.False(t, isDuplicateCode(last, &EventCode{File: "/foo.go", Line: 3, Stack: stack}))
+}
+
+func TestScopeFromStack(t *testing.T) {
+	require.Equal(t, EventCodeScopeWorkflow, scopeFromStack("root", []string{"example.com/foo.MyWorkflow"}))
+	require.Equal(t, EventCodeScopeCoroutine, scopeFromStack("my-coroutine", []string{"example.com/foo.MyWorkflow.func1"}))
+	require.Equal(t, EventCodeScope(""), scopeFromStack("", []string{"example.com/foo.helper"}))
+	require.Equal(t, EventCodeScopeSideEffect, scopeFromStack("root", []string{
+		"example.com/foo.MyWorkflow.func1",
+		"go.temporal.io/sdk/internal.(*workflowEnvironmentInterceptor).SideEffect.func1",
+		"go.temporal.io/sdk/internal.(*workflowEnvironmentImpl).SideEffect",
+		"example.com/foo.MyWorkflow",
+	}))
+	require.Equal(t, EventCodeScopeSideEffect, scopeFromStack("root", []string{
+		"example.com/foo.MyWorkflow.func1",
+		"go.temporal.io/sdk/internal.(*workflowEnvironmentImpl).MutableSideEffect",
+	}))
+	require.Equal(t, EventCodeScopeLocalActivity, scopeFromStack("", []string{
+		"example.com/foo.MyLocalActivity",
+		"go.temporal.io/sdk/internal.(*localActivityTaskHandler).executeLocalActivityTask",
+	}))
+	require.Equal(t, EventCodeScopeActivity, scopeFromStack("", []string{
+		"example.com/foo.(*Activities).MyActivity",
+		"go.temporal.io/sdk/internal.(*activityTaskHandlerImpl).Execute",
+	}))
+}
+
+func TestPanicMessage(t *testing.T) {
+	// String in an interface is unwrapped
+	require.Equal(t, "boom", panicMessage(&api.Variable{Kind: reflect.Interface, Children: []api.Variable{
+		{Kind: reflect.String, Value: "boom"},
+	}}))
+	// Other values are shown as is
+	require.Equal(t, "42", panicMessage(&api.Variable{Kind: reflect.Interface, Children: []api.Variable{
+		{Kind: reflect.Int, Value: "42"},
+	}}))
+}
+
+func TestPayloadValues(t *testing.T) {
+	bytesVar := func(s string) api.Variable {
+		v := api.Variable{Name: "Data", Kind: reflect.Slice, Len: int64(len(s))}
+		for _, b := range []byte(s) {
+			v.Children = append(v.Children, api.Variable{Kind: reflect.Uint8, Value: strconv.Itoa(int(b))})
+		}
+		return v
+	}
+	payloadVar := func(data api.Variable) api.Variable {
+		return api.Variable{Kind: reflect.Ptr, Children: []api.Variable{
+			{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{data}},
+		}}
+	}
+	truncated := bytesVar("abc")
+	truncated.Len = 5000
+	v := &api.Variable{Kind: reflect.Ptr, Children: []api.Variable{{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+		{Name: "Payloads", Kind: reflect.Slice, Children: []api.Variable{
+			payloadVar(bytesVar(`"done"`)),
+			payloadVar(bytesVar("")),
+			payloadVar(bytesVar("\xff")),
+			payloadVar(truncated),
+		}},
+	}}}}
+	require.Equal(t, []string{`"done"`, "null", "<1 bytes>", "<5000 bytes>"}, payloadValues(v))
+
+	// Nil pointer
+	require.Nil(t, payloadValues(&api.Variable{Kind: reflect.Ptr, Children: []api.Variable{{Kind: reflect.Struct}}}))
+}
+
+func TestErrorMessage(t *testing.T) {
+	// Nil
+	require.Equal(t, "", errorMessage(&api.Variable{Kind: reflect.Interface}))
+	// Message field
+	require.Equal(t, "boom", errorMessage(&api.Variable{Kind: reflect.Interface, Children: []api.Variable{
+		{Kind: reflect.Ptr, Children: []api.Variable{{Kind: reflect.Struct, Addr: 1, Children: []api.Variable{
+			{Name: "msg", Kind: reflect.String, Value: "boom"},
+		}}}},
+	}}))
+}
+
+func TestAddEventStream(t *testing.T) {
+	tr := &trace{Tracer: &Tracer{}}
+	events := tr.Events()
+	event := &Event{Server: &EventServer{ID: 1}}
+	go tr.addEvent(event)
+	require.Same(t, event, <-events)
+
+	// Does not block once done
+	done := make(chan struct{})
+	close(done)
+	tr.done = done
+	tr.addEvent(&Event{Server: &EventServer{ID: 2}})
+	require.Len(t, tr.result.Events, 2)
+}
@@ -1,9 +1,15 @@
 package tracer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"go/format"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -14,201 +20,1273 @@ import (
 	"strings"
 	"time"
 
+	"github.com/alecthomas/chroma/styles"
+	"github.com/go-delve/delve/pkg/goversion"
+	"github.com/go-delve/delve/pkg/version"
+	"github.com/gogo/protobuf/jsonpb"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/history/v1"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/log"
 	"go.temporal.io/sdk/workflow"
 )
 
+// ImpliedExcludeFuncs are always stepped out of in addition to
+// Config.ExcludeFuncs
 var ImpliedExcludeFuncs = []*regexp.Regexp{
-	// Exclude all Temporal internal code
-	regexp.MustCompile(`^go\.temporal\.io/sdk/.*`),
 	// Exclude all Uber atomic code
 	regexp.MustCompile(`^go\.uber\.org/atomic\..*`),
 	// Exclude anything in runtime package (this does not appear as part of
 	// GOROOT so the file matcher does not apply)
 	regexp.MustCompile(`^runtime\..*`),
-	// Exclude the main.main function
-	regexp.MustCompile(`^main\.main$`),
 }
 
+// ImpliedTemporalInternalExcludeFuncs are also assumed unless
+// Config.IncludeTemporalInternal is set
+var ImpliedTemporalInternalExcludeFuncs = []*regexp.Regexp{
+	// Exclude all Temporal internal code
+	regexp.MustCompile(`^go\.temporal\.io/sdk/.*`),
+}
+
+// ImpliedExcludeFiles are matched against slash-separated file paths. Files in
+// the GOROOT of the toolchain building the replayer, which may differ from
+// this one, are also always excluded, see Config.ExcludeDirs.
 var ImpliedExcludeFiles = []*regexp.Regexp{
 	// No files in GOROOT
 	regexp.MustCompile("^" + filepath.ToSlash(filepath.Join(runtime.GOROOT(), "src")) + ".*"),
 }
 
+// Config for New. Only WorkflowFuncs and either Execution or HistoryFile are
+// required, everything else is optional with defaults documented per field.
 type Config struct {
+	// Options for connecting to the server when Execution is set
 	ClientOptions client.Options
+	// Optional TLS files for connecting to the server. Cert and key must be
+	// given together. These are used instead of
+	// ClientOptions.ConnectionOptions.TLS which cannot be set directly.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSCACertFile string
+	TLSServerName string
+	// Optional API key sent as a bearer token with the namespace header. This
+	// enables TLS if no TLS files are given. The key is never written to the
+	// generated main.go, instead it is passed via the APIKeyEnvVar environment
+	// variable set only on the replayer process when ReplayerFetchesHistory is
+	// true.
+	APIKey string
+	// Go binary used to build the replayer and query the Go environment.
+	// Default is "go" on the PATH.
+	GoBinary string
+	// Extra flags for building the replayer, each a single argument like
+	// "-mod=mod". Flags that disable debugging like -gcflags are not allowed.
+	BuildFlags []string
+	// Build tags for building the replayer
+	BuildTags []string
+	// By default, the tracer fetches the Execution history once and the
+	// replayer reads it from a file so the debugged process needs no server
+	// access. If true, the replayer connects and fetches history itself.
+	ReplayerFetchesHistory bool
+	// If set, this replayer exe is traced instead of generating and building
+	// one. It must be a replayer for the same execution or history file and
+	// should be built with -gcflags="all=-N -l" for reliable breakpoints. Build
+	// options are ignored.
+	PrebuiltExe string
+	// Delve backend to debug with, one of DelveBackends. Default is "default".
+	DelveBackend string
+	// Optional Go expression for the data converter used by the replayer,
+	// qualified by package, e.g. "example.com/mypkg.NewConverter()". The
+	// package is imported automatically. Only that package can be referenced
+	// in the rest of the expression.
+	DataConverterExpr string
+	// Optional Go expression for the worker.WorkflowReplayerOptions the
+	// replayer is created with, qualified by package the same as
+	// DataConverterExpr. If both are set, DataConverterExpr replaces the data
+	// converter of the options.
+	ReplayerOptionsExpr string
+	// By default, the traced process runs with the SDK's debug mode enabled
+	// via SDKDebugModeEnvVar. This disables deadlock detection, since stepping
+	// through workflow code easily takes longer than the one second a
+	// coroutine may run without yielding. If true, debug mode is not enabled
+	// and deadlock detection is kept.
+	KeepDeadlockDetection bool
 
+	// Default is DefaultLogger
 	Log log.Logger
-	// Qualified by package up to last dot. Only one supported for now
-	// TODO(cretz): Support multiple for child workflows?
+	// Messages to Log below this level are dropped. Default is LogLevelDebug
+	// which logs everything.
+	LogLevel LogLevel
+	// Qualified by package up to last dot. At least one required. All are
+	// registered with the replayer. A package starting with "./" or "../" is
+	// relative to RootDir and resolved with the module path of its go.mod,
+	// e.g. "./pkg/workflows.MyWorkflow" or "./.MyWorkflow" for the module root.
 	WorkflowFuncs []string
+	// If set, the workflow function is registered with this name instead of
+	// its function name, matching a RegisterWorkflowWithOptions registration.
+	// Only allowed with a single workflow function. If unset with a single
+	// workflow function, the workflow type of the history is used when it
+	// differs from the function name and the tracer loads the history.
+	WorkflowTypeName string
 
 	// One and only one of the next two fields required
-	Execution   *workflow.Execution
+	Execution *workflow.Execution
+	// History file may be "-" to read from stdin
 	HistoryFile string // TODO(cretz): Stop creating client if history file given
+	// Format of HistoryFile, default is to detect it
+	HistoryFormat HistoryFormat
 
 	// Temp dir created under this, usually the current working dir so func
 	// package works properly
-	RootDir       string
+	RootDir string
+	// If true, the temp dir with the generated harness is not removed
 	RetainTempDir bool
+	// Attempts to remove the temp dir. On Windows there is a delay after the
+	// process exits before the dir can be removed. Default is 20 on Windows
+	// and 1 elsewhere.
+	TempDirRemoveAttempts int
+	// Delay between temp dir remove attempts. Default is 1ms.
+	TempDirRemoveDelay time.Duration
+	// Maximum total bytes of source files, and what is derived from them, to
+	// keep cached while tracing and while generating Markdown or HTML. Least
+	// recently used sources are evicted and re-read when needed. Default of 0
+	// is unlimited.
+	SourceCacheMaxBytes int
 
-	// These are stepped out of if reached in any way. ImpliedExcludeFuncs and
-	// ImpliedExcludeFiles are automatically assumed.
+	// Name of the built replay binary, without the ".exe" suffix on Windows.
+	// Cannot contain path separators or be "." or "..". Default is the name of
+	// the temp dir which is unique.
+	ExeName string
+
+	// These are stepped out of if reached in any way. ImpliedExcludeFuncs,
+	// ImpliedExcludeFiles, and ImpliedTemporalInternalExcludeFuncs (unless
+	// IncludeTemporalInternal) are automatically assumed.
 	ExcludeFuncs []*regexp.Regexp
 	ExcludeFiles []*regexp.Regexp
+	// Directories whose files are stepped out of the same as GOROOT, e.g. a
+	// vendor directory. GOROOT is resolved with "go env GOROOT" in RootDir so
+	// it matches the toolchain building the replayer, not this one.
+	ExcludeDirs []string
+	// If either is non-empty, code lines are only recorded if the function
+	// matches one of IncludeFuncs or the file matches one of IncludeFiles.
+	// Unlike exclusions, other code is still stepped through since it may call
+	// included code.
+	IncludeFuncs []*regexp.Regexp
+	IncludeFiles []*regexp.Regexp
+	// If non-empty, code lines are only recorded for coroutines with one of
+	// these names, e.g. "root" or a name given to workflow.GoNamed. Server and
+	// client events are always recorded.
+	CoroutineFilter []string
 
+	// If true, Temporal SDK code is stepped through and recorded instead of
+	// stepped out of. GOROOT and runtime code are still excluded. This is very
+	// slow and mostly useful for debugging SDK interactions.
 	IncludeTemporalInternal bool
+
+	// If true, local variables are captured on each code step in packages
+	// prefixed with one of CaptureLocalsPackages. This is expensive.
+	CaptureLocals bool
+	// Package prefixes to capture locals for. Default is the package of the
+	// workflow function.
+	CaptureLocalsPackages []string
+
+	// If true, the call stack of the coroutine is captured on each code step to
+	// tell apart the call paths reaching the same line. This is expensive.
+	CaptureStack bool
+	// Maximum frames captured per stack, including the current one. Default is
+	// 10.
+	StackDepth int
+
+	// If greater than 1, only every Nth code step of each coroutine is recorded.
+	// Server and client events are always recorded.
+	SampleRate int
+	// By default, a code event on the same file, line, and coroutine as the
+	// event just before it (e.g. stepping back to a loop header) is not
+	// recorded again. If true, every step is recorded.
+	KeepDuplicateLines bool
+
+	// If set, server and code events before this history event ID are not
+	// recorded. Replay still starts from the beginning of the history.
+	StartEventID int64
+	// If set, history is trimmed to end at this event ID before replay, so
+	// nothing after it is replayed. The tracer loads the history itself to do
+	// this, so it cannot be combined with ReplayerFetchesHistory.
+	EndEventID int64
+	// If set, capture and replay stop at this workflow task completed event,
+	// like a reset point. Only events up to this task boundary are recorded and
+	// the replayer is killed once replay moves past it.
+	ReplayUntilEventID int64
+
+	// Notes to attach to server events, keyed by event ID
+	EventNotes map[int64]string
+
+	// If set, capture stops once this "file.go:line" location is reached. The
+	// file only has to match the end of the full source path.
+	BreakAt string
+	// If greater than 1, capture only stops when BreakAt is reached this many
+	// times
+	BreakCount int
+
+	// If set, the trace stops with ErrTraceTimeout once stepping has taken this
+	// long. This does not include building the replayer.
+	TraceTimeout time.Duration
+	// If greater than 0, the trace stops with ErrMaxSteps after this many
+	// debugger steps
+	MaxSteps int
+
+	// Default is ModeTrace
+	Mode Mode
+
+	// If set, built replay binaries are cached in this dir and reused when the
+	// generated main.go, the Go version, the module's go.mod and go.sum, and
+	// the main module's Go files it depends on are unchanged
+	BuildCacheDir string
+
+	// If set, called with each event as soon as it is recorded. Events are
+	// still collected in the result unless DiscardCodeEvents is set.
+	OnEvent func(*Event)
+	// If true, code events are only given to OnEvent and Events and are not
+	// kept in Result.Events. This bounds memory for long traces whose events
+	// are streamed elsewhere. Server and client events are still kept since
+	// they are needed to check the result against history, and Stats still
+	// counts every event.
+	DiscardCodeEvents bool
+	// If set, called about once a second while stepping with the progress of
+	// the trace so far
+	OnProgress func(Progress)
+
+	// Chroma style name for source in HTML output, one of styles.Names(). If
+	// unset, "github" is used with "monokai" when the browser prefers a dark
+	// color scheme.
+	HTMLStyle string
+}
+
+// HistoryFormat is the encoding of a history file. Either format may also be
+// gzipped.
+type HistoryFormat int
+
+const (
+	// HistoryFormatAuto treats the file as JSON if it starts with "{" after
+	// whitespace, otherwise as binary protobuf.
+	HistoryFormatAuto HistoryFormat = iota
+	HistoryFormatJSON
+	HistoryFormatProto
+)
+
+// Mode is how Trace runs the replay
+type Mode int
+
+const (
+	// ModeTrace steps through the replay with the debugger recording events
+	ModeTrace Mode = iota
+	// ModeReplayOnly runs the replay without the debugger and only reports
+	// whether it succeeded. This is much faster and suitable as a regression
+	// check.
+	ModeReplayOnly
+)
+
+// Progress of a running trace, see Config.OnProgress
+type Progress struct {
+	// Server events recorded so far
+	ServerEvents int
+	// Debugger steps taken so far, including steps not recorded as code events
+	Steps int
+	// Current location of the debugger
+	File string
+	Line int
+	// Time since stepping started
+	Elapsed time.Duration
 }
 
+// DelveBackends are the backends supported by Delve
+var DelveBackends = []string{"default", "native", "lldb", "rr"}
+
+// SDKDebugModeEnvVar is the environment variable that enables the SDK's debug
+// mode when set to any value.
+const SDKDebugModeEnvVar = "TEMPORAL_DEBUG"
+
+// APIKeyEnvVar is the environment variable the replayer reads the API key from
+const APIKeyEnvVar = "TEMPORAL_DEBUG_API_KEY"
+
+// Tracer traces workflow replays. Create with New. A tracer may trace more
+// than once, but not concurrently.
 type Tracer struct {
 	Config
-	fnPkg    string
-	fn       string
-	fnStruct string
+	fns []*workflowFunc
+	// Set by Events, closed and unset when Trace returns
+	events chan *Event
+
+	breakAtFile string
+	breakAtLine int
+
+	// Set when HistoryFile is "-"
+	stdinHistory     []byte
+	stdinHistoryFile string
+	// Set when the tracer fetches the execution history for the replayer
+	fetchedHistory *history.History
+	// "-mod=vendor" when building from the main module's vendor dir
+	modFlag string
+	// Workflow type of the history when it differs from the function name
+	detectedTypeName string
+
+	// Always os.RemoveAll except in tests
+	removeAll func(string) error
 }
 
+// New validates the config and creates a tracer. Defaults are applied to the
+// embedded config.
 func New(config Config) (*Tracer, error) {
-	t := &Tracer{Config: config}
+	t := &Tracer{Config: config, removeAll: os.RemoveAll}
 	if t.Execution == nil && t.HistoryFile == "" {
 		return nil, fmt.Errorf("must have existing execution or history file")
 	} else if t.Execution != nil && t.HistoryFile != "" {
 		return nil, fmt.Errorf("cannot have both execution and history file")
 	}
+	if t.Mode < ModeTrace || t.Mode > ModeReplayOnly {
+		return nil, fmt.Errorf("invalid mode %v", t.Mode)
+	}
+	if t.HistoryFormat < HistoryFormatAuto || t.HistoryFormat > HistoryFormatProto {
+		return nil, fmt.Errorf("invalid history format %v", t.HistoryFormat)
+	}
 	if t.Log == nil {
 		t.Log = DefaultLogger
 	}
+	if t.LogLevel < LogLevelDebug || t.LogLevel > LogLevelError {
+		return nil, fmt.Errorf("invalid log level %v", t.LogLevel)
+	} else if t.LogLevel > LogLevelDebug {
+		t.Log = NewLevelLogger(t.Log, t.LogLevel)
+	}
+	if err := t.applyTLS(); err != nil {
+		return nil, err
+	}
+	if t.DelveBackend == "" {
+		t.DelveBackend = "default"
+	} else if !stringInSlice(t.DelveBackend, DelveBackends) {
+		return nil, fmt.Errorf("unknown Delve backend %q, expected one of: %v", t.DelveBackend,
+			strings.Join(DelveBackends, ", "))
+	}
+	if t.HTMLStyle != "" && !stringInSlice(t.HTMLStyle, styles.Names()) {
+		return nil, fmt.Errorf("unknown HTML style %q, expected one of: %v", t.HTMLStyle,
+			strings.Join(styles.Names(), ", "))
+	}
+	if t.DataConverterExpr != "" {
+		if _, _, err := qualifiedExprWithAlias(t.DataConverterExpr, ""); err != nil {
+			return nil, fmt.Errorf("invalid data converter expression: %w", err)
+		}
+	}
+	if t.ReplayerOptionsExpr != "" {
+		if _, _, err := qualifiedExprWithAlias(t.ReplayerOptionsExpr, ""); err != nil {
+			return nil, fmt.Errorf("invalid replayer options expression: %w", err)
+		}
+	}
+	if t.APIKey != "" {
+		if t.ClientOptions.HeadersProvider != nil {
+			return nil, fmt.Errorf("cannot have API key and client headers provider")
+		}
+		t.ClientOptions.HeadersProvider = apiKeyHeadersProvider{apiKey: t.APIKey, namespace: t.ClientOptions.Namespace}
+	}
+	if t.TempDirRemoveAttempts < 0 {
+		return nil, fmt.Errorf("temp dir remove attempts cannot be negative")
+	} else if t.TempDirRemoveAttempts == 0 {
+		t.TempDirRemoveAttempts = 1
+		if runtime.GOOS == "windows" {
+			t.TempDirRemoveAttempts = 20
+		}
+	}
+	if t.TempDirRemoveDelay == 0 {
+		t.TempDirRemoveDelay = 1 * time.Millisecond
+	}
+	if t.GoBinary == "" {
+		t.GoBinary = "go"
+	} else if _, err := exec.LookPath(t.GoBinary); err != nil {
+		return nil, fmt.Errorf("Go binary %q is not executable: %w", t.GoBinary, err)
+	}
+	if t.PrebuiltExe != "" {
+		if t.HistoryFile == "-" {
+			return nil, fmt.Errorf("cannot read history from stdin with prebuilt exe")
+		}
+		var err error
+		if t.PrebuiltExe, err = filepath.Abs(t.PrebuiltExe); err != nil {
+			return nil, fmt.Errorf("invalid prebuilt exe: %w", err)
+		} else if _, err = os.Stat(t.PrebuiltExe); err != nil {
+			return nil, fmt.Errorf("invalid prebuilt exe: %w", err)
+		}
+	}
+	for _, flag := range t.BuildFlags {
+		if err := validateBuildFlag(flag); err != nil {
+			return nil, fmt.Errorf("invalid build flag %q: %w", flag, err)
+		}
+	}
+	if t.ExeName != "" && (strings.ContainsAny(t.ExeName, `/\`) || t.ExeName == "." || t.ExeName == ".." ||
+		t.ExeName == "main.go") {
+		return nil, fmt.Errorf("invalid exe name %q", t.ExeName)
+	}
 
-	// Split function and package
-	// TODO(cretz): Support multiple workflows
-	if len(t.WorkflowFuncs) != 1 {
-		return nil, fmt.Errorf("single workflow function required")
+	// Split functions and packages
+	if len(t.WorkflowFuncs) == 0 {
+		return nil, fmt.Errorf("at least one workflow function required")
 	}
-	lastDot := strings.LastIndex(config.WorkflowFuncs[0], ".")
-	if lastDot == -1 {
-		return nil, fmt.Errorf("workflow function missing dot")
+	for _, str := range t.WorkflowFuncs {
+		fn, err := parseWorkflowFunc(str)
+		if err == nil && isRelativePkg(fn.pkg) {
+			var pkg string
+			if pkg, err = resolveRelativePkg(t.RootDir, fn.pkg); err == nil {
+				fn.qualified, fn.pkg = pkg+str[len(fn.pkg):], pkg
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid workflow function %q: %w", str, err)
+		}
+		t.fns = append(t.fns, fn)
 	}
-	t.fnPkg, t.fn = config.WorkflowFuncs[0][:lastDot], config.WorkflowFuncs[0][lastDot+1:]
-	// check for struct-based workflow function
-	base := path.Base(config.WorkflowFuncs[0])
-	if strings.Count(base, ".") > 2 {
-		return nil, fmt.Errorf("workflow function has too many dots")
+	if t.WorkflowTypeName != "" && len(t.fns) != 1 {
+		return nil, fmt.Errorf("workflow type name requires exactly one workflow function")
+	} else if strings.TrimSpace(t.WorkflowTypeName) != t.WorkflowTypeName {
+		return nil, fmt.Errorf("workflow type name %q has surrounding whitespace", t.WorkflowTypeName)
 	}
-	structBased := strings.Count(base, ".") == 2
-	if lastDot2 := strings.LastIndex(t.fnPkg, "."); structBased && lastDot2 > -1 {
-		t.fnPkg, t.fnStruct = t.fnPkg[:lastDot2], t.fnPkg[lastDot2+1:]
+
+	// Split break location
+	if t.BreakAt != "" {
+		lastColon := strings.LastIndex(t.BreakAt, ":")
+		if lastColon == -1 {
+			return nil, fmt.Errorf("break location missing colon")
+		}
+		var err error
+		t.breakAtFile = normalizePath(t.BreakAt[:lastColon])
+		if t.breakAtLine, err = strconv.Atoi(t.BreakAt[lastColon+1:]); err != nil || t.breakAtLine < 1 {
+			return nil, fmt.Errorf("invalid break location line %q", t.BreakAt[lastColon+1:])
+		}
+	} else if t.BreakCount != 0 {
+		return nil, fmt.Errorf("cannot have break count without break location")
+	}
+	if t.SampleRate < 0 {
+		return nil, fmt.Errorf("sample rate cannot be negative")
+	}
+	if t.BreakCount < 0 {
+		return nil, fmt.Errorf("break count cannot be negative")
+	}
+	if t.TraceTimeout < 0 {
+		return nil, fmt.Errorf("trace timeout cannot be negative")
+	}
+	if t.MaxSteps < 0 {
+		return nil, fmt.Errorf("max steps cannot be negative")
+	}
+	if t.StartEventID < 0 || t.EndEventID < 0 || t.ReplayUntilEventID < 0 {
+		return nil, fmt.Errorf("event IDs cannot be negative")
+	} else if t.EndEventID > 0 && t.StartEventID > t.EndEventID {
+		return nil, fmt.Errorf("start event ID %v is after end event ID %v", t.StartEventID, t.EndEventID)
+	} else if t.EndEventID > 0 && t.Execution != nil && t.ReplayerFetchesHistory {
+		return nil, fmt.Errorf("cannot have end event ID when replayer fetches history")
+	}
+	if t.StackDepth < 0 {
+		return nil, fmt.Errorf("stack depth cannot be negative")
+	} else if t.StackDepth == 0 {
+		t.StackDepth = 10
 	}
 
 	return t, nil
 }
 
-// Trace This may still return a result, even if there is an error
-func (t *Tracer) Trace(ctx context.Context) (*Result, error) {
-	// Create temp dir
-	dir, err := os.MkdirTemp(t.RootDir, "debug-go-trace-")
+// Trace builds and runs the replayer, returning what was recorded. This may
+// still return a result, even if there is an error.
+func (t *Tracer) Trace(ctx context.Context) (res *Result, err error) {
+	if t.events != nil {
+		defer func() {
+			close(t.events)
+			t.events = nil
+		}()
+	}
+	if t.Mode == ModeReplayOnly {
+		return t.replayOnly(ctx)
+	}
+	started := time.Now()
+	defer func() {
+		if res != nil && res.Stats != nil {
+			res.Stats.Duration = time.Since(started)
+		}
+	}()
+	if err := t.CheckToolchain(ctx); err != nil {
+		return nil, err
+	}
+	dir, err := t.createTempDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed creating temp dir: %w", err)
+		return nil, err
 	}
-	dir, err = filepath.Abs(dir)
+	if !t.RetainTempDir {
+		defer func() { t.removeTempDirWithWarning(dir, res) }()
+	}
+	exe, buildDir, err := t.buildHarness(ctx, dir)
 	if err != nil {
-		return nil, fmt.Errorf("could not turn dir absolute: %w", err)
+		return nil, err
+	}
+	if t.ReplayUntilEventID > 0 {
+		hist, err := t.loadHistory(ctx)
+		if err != nil {
+			return nil, err
+		} else if err = checkTaskBoundary(hist, t.ReplayUntilEventID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Run trace
+	trace, err := t.newTrace(ctx, dir, buildDir, exe)
+	if err != nil {
+		return nil, err
+	}
+	defer trace.close()
+	// Run and return result even if it errors
+	trace.result = *newResult()
+	trace.result.Summary = &Summary{}
+	runCtx := ctx
+	if t.TraceTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, t.TraceTimeout)
+		defer cancel()
+	}
+	err = trace.run(runCtx)
+	// Nothing recorded usually means misconfiguration
+	if err == nil && len(trace.result.Events) == 0 {
+		return &trace.result, &NoEventsError{Breakpoints: trace.result.Diagnostics.Breakpoints}
+	}
+	// If it succeeded, confirm all history was processed and commands match
+	if err == nil && !trace.breakReached && !trace.replayUntilReached {
+		if hist, err := t.loadHistory(ctx); err != nil {
+			t.Log.Warn("Unable to load history to check against result", "Error", err)
+		} else {
+			t.checkHistoryProcessed(hist, &trace.result)
+			trace.result.Mismatches = findCommandMismatches(hist, &trace.result)
+		}
+	}
+	return &trace.result, err
+}
+
+// ErrTraceTimeout is matched by errors.Is on the error returned from Trace when
+// Config.TraceTimeout is reached. The partial result is still returned.
+var ErrTraceTimeout = errors.New("trace timed out")
+
+// ErrMaxSteps is matched by errors.Is on the error returned from Trace when
+// Config.MaxSteps is reached. The partial result is still returned.
+var ErrMaxSteps = errors.New("trace reached max steps")
+
+// ErrNoEvents is matched by errors.Is on the error returned from Trace when
+// the trace completed but no events were recorded. Use errors.As with
+// *NoEventsError for diagnostics.
+var ErrNoEvents = errors.New("no events recorded")
+
+// NoEventsError is returned from Trace when the trace completed without
+// recording any events. This usually means a workflow function is wrong or the
+// SDK breakpoints never matched.
+type NoEventsError struct {
+	// Every breakpoint set in the order they were set
+	Breakpoints []*BreakpointHits
+}
+
+func (e *NoEventsError) Error() string {
+	var neverHit []string
+	for _, bp := range (&Diagnostics{Breakpoints: e.Breakpoints}).NeverHit() {
+		neverHit = append(neverHit, bp.Name)
+	}
+	if len(neverHit) == 0 {
+		return ErrNoEvents.Error()
+	}
+	return fmt.Sprintf("%v, %v of %v breakpoints never hit: %v", ErrNoEvents, len(neverHit), len(e.Breakpoints),
+		strings.Join(neverHit, ", "))
+}
+
+func (e *NoEventsError) Is(target error) bool { return target == ErrNoEvents }
+
+// Builds and runs the replay harness without the debugger
+func (t *Tracer) replayOnly(ctx context.Context) (res *Result, err error) {
+	dir, err := t.createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	if !t.RetainTempDir {
+		defer func() { t.removeTempDirWithWarning(dir, res) }()
+	}
+	exe, _, err := t.buildHarness(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	if out, err := t.runHarness(ctx, dir, exe, t.apiKeyEnv()...); err != nil {
+		res = newResult()
+		res.ReplayError = strings.TrimSpace(string(out))
+		return res, fmt.Errorf("replay failed: %w", err)
+	}
+	res = newResult()
+	res.Success = true
+	return res, nil
+}
+
+// Environment variables, each KEY=VALUE, set for the traced replayer only
+func (t *Tracer) replayerEnv() []string {
+	var env []string
+	if !t.KeepDeadlockDetection {
+		env = append(env, SDKDebugModeEnvVar+"=true")
+	}
+	return append(env, t.apiKeyEnv()...)
+}
+
+// The API key env var, KEY=VALUE, for any harness run. Empty unless the
+// replayer fetches history itself since otherwise it never connects.
+func (t *Tracer) apiKeyEnv() []string {
+	if t.ReplayerFetchesHistory && t.APIKey != "" {
+		return []string{APIKeyEnvVar + "=" + t.APIKey}
+	}
+	return nil
+}
+
+// Sets the given KEY=VALUE env vars on this process while fn runs and restores
+// their previous values after
+func withEnv(env []string, fn func() error) error {
+	for _, kv := range env {
+		pieces := strings.SplitN(kv, "=", 2)
+		if prev, ok := os.LookupEnv(pieces[0]); ok {
+			defer os.Setenv(pieces[0], prev)
+		} else {
+			defer os.Unsetenv(pieces[0])
+		}
+		if err := os.Setenv(pieces[0], pieces[1]); err != nil {
+			return fmt.Errorf("failed setting env var %v: %w", pieces[0], err)
+		}
+	}
+	return fn()
+}
+
+// Runs the harness without the debugger with the given KEY=VALUE env vars added,
+// returning the combined output
+func (t *Tracer) runHarness(ctx context.Context, dir, exe string, env ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.CombinedOutput()
+}
+
+// Time zones FuzzReplay cycles through, with whole, fractional, and date line
+// crossing offsets
+var fuzzTimeZones = []string{"UTC", "America/Los_Angeles", "Asia/Kolkata", "Pacific/Chatham", "Pacific/Kiritimati"}
+
+// FuzzReplay builds the replay harness and runs it, without the debugger, the
+// given number of times with the SDK's deadlock detector enabled. This is meant
+// to proactively find latent nondeterminism. An error is returned if any run
+// fails.
+//
+// The SDK runs workflow coroutines one at a time, so varying scheduling does
+// not change replay. Instead, each run is a new process so map iteration order
+// and the wall clock naturally differ, and each run sets TZ to the next of
+// several time zones so code depending on local time differs. TZ is not
+// honored on Windows.
+func (t *Tracer) FuzzReplay(ctx context.Context, runs int) error {
+	if runs < 1 {
+		return fmt.Errorf("must have at least one run")
+	}
+	dir, err := t.createTempDir()
+	if err != nil {
+		return err
 	}
-	t.Log.Debug("Created temp dir", "Dir", dir)
 	if !t.RetainTempDir {
 		defer func() {
-			// We have to try this 20 times on Windows because there is a delay on
-			// process exit before we can delete. This mimics what
-			// github.com/go-delve/delve/pkg/gobuild.Remove does.
-			var err error
-			for i := 0; i < 20; i++ {
-				err := os.RemoveAll(dir)
-				if err == nil || runtime.GOOS != "windows" {
-					break
-				}
-				time.Sleep(1 * time.Millisecond)
-			}
-			if err != nil {
+			if err := t.removeTempDir(dir); err != nil {
 				t.Log.Warn("Failed deleting temp dir", "Dir", dir, "Error", err)
 			}
 		}()
 	}
+	exe, _, err := t.buildHarness(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for i := 0; i < runs; i++ {
+		tz := fuzzTimeZones[i%len(fuzzTimeZones)]
+		t.Log.Debug("Running replay", "Run", i+1, "TZ", tz)
+		env := append(t.apiKeyEnv(), "TZ="+tz, SDKDebugModeEnvVar+"=")
+		if out, err := t.runHarness(ctx, dir, exe, env...); err != nil {
+			t.Log.Warn("Replay failed", "Run", i+1, "TZ", tz, "Output", string(out))
+			failures = append(failures, fmt.Sprintf("run %v (TZ=%v): %v", i+1, tz, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%v of %v replays failed: %v", len(failures), runs, strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Events returns a channel that receives each event as it is recorded by the
+// next Trace call. It must be called before Trace. The channel is closed when
+// Trace returns. It is unbuffered, so it must be drained or stepping blocks
+// until the Trace context is done. Events are still collected in the result.
+func (t *Tracer) Events() <-chan *Event {
+	if t.events == nil {
+		t.events = make(chan *Event)
+	}
+	return t.events
+}
+
+// CheckToolchain confirms the Go toolchain that builds the replay harness is
+// supported by the version of Delve this tracer is built with. This is called
+// by Trace before building. Nothing is checked for Config.PrebuiltExe since it
+// is not built with the toolchain.
+func (t *Tracer) CheckToolchain(ctx context.Context) error {
+	if t.PrebuiltExe != "" {
+		return nil
+	}
+	buildVersion, err := t.goVersion(ctx)
+	if err != nil {
+		return err
+	}
+	ver, ok := goversion.Parse(buildVersion)
+	if !ok {
+		return fmt.Errorf("unable to parse Go version %q", buildVersion)
+	} else if ver.IsDevel() {
+		return nil
+	}
+	delveVersion := "v" + version.DelveVersion.Major + "." + version.DelveVersion.Minor + "." + version.DelveVersion.Patch
+	minVersion := goversion.GoVersion{Major: goversion.MinSupportedVersionOfGoMajor,
+		Minor: goversion.MinSupportedVersionOfGoMinor, Rev: -1}
+	tooNewVersion := goversion.GoVersion{Major: goversion.MaxSupportedVersionOfGoMajor,
+		Minor: goversion.MaxSupportedVersionOfGoMinor + 1, Rev: -1}
+	if !ver.AfterOrEqual(minVersion) {
+		return fmt.Errorf("Go version %v (tool built with %v) is too old for Delve %v, minimum supported is go%v.%v",
+			buildVersion, runtime.Version(), delveVersion, minVersion.Major, minVersion.Minor)
+	} else if ver.AfterOrEqual(tooNewVersion) {
+		return fmt.Errorf("Go version %v (tool built with %v) is too new for Delve %v which supports up to go%v.%v, "+
+			"upgrade github.com/go-delve/delve to support %v", buildVersion, runtime.Version(), delveVersion,
+			goversion.MaxSupportedVersionOfGoMajor, goversion.MaxSupportedVersionOfGoMinor, buildVersion)
+	}
+	return nil
+}
+
+// Version of the Go binary, e.g. "go1.17.5". GOVERSION is only in "go env"
+// since Go 1.16, so this falls back to parsing "go version".
+func (t *Tracer) goVersion(ctx context.Context) (string, error) {
+	out, err := t.goOutput(ctx, t.RootDir, "env", "GOVERSION")
+	if err != nil {
+		return "", fmt.Errorf("failed getting Go version: %w", err)
+	} else if v := strings.TrimSpace(string(out)); v != "" {
+		return v, nil
+	}
+	if out, err = t.goOutput(ctx, t.RootDir, "version"); err != nil {
+		return "", fmt.Errorf("failed getting Go version: %w", err)
+	}
+	return goVersionFromVersionOutput(string(out)), nil
+}
+
+// Version from "go version" output, e.g. "go1.15.15" from
+// "go version go1.15.15 linux/amd64". Empty if not in the expected form.
+func goVersionFromVersionOutput(out string) string {
+	if fields := strings.Fields(out); len(fields) >= 3 && fields[0] == "go" && fields[1] == "version" {
+		return fields[2]
+	}
+	return ""
+}
+
+func (t *Tracer) createTempDir() (string, error) {
+	dir, err := os.MkdirTemp(t.RootDir, "debug-go-trace-")
+	if err != nil {
+		return "", fmt.Errorf("failed creating temp dir: %w", err)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not turn dir absolute: %w", err)
+	}
+	t.Log.Debug("Created temp dir", "Dir", dir)
+	return dir, nil
+}
+
+// Removes the temp dir, retrying as configured. By default we have to try
+// this 20 times on Windows because there is a delay on process exit before we
+// can delete. This mimics what github.com/go-delve/delve/pkg/gobuild.Remove
+// does.
+func (t *Tracer) removeTempDir(dir string) (err error) {
+	for i := 0; i < t.TempDirRemoveAttempts; i++ {
+		if i > 0 {
+			time.Sleep(t.TempDirRemoveDelay)
+		}
+		if err = t.removeAll(dir); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed deleting temp dir %v after %v attempt(s): %w", dir, t.TempDirRemoveAttempts, err)
+}
+
+// Removes the temp dir, logging a warning and adding it to the result summary
+// if it fails
+func (t *Tracer) removeTempDirWithWarning(dir string, res *Result) {
+	if err := t.removeTempDir(dir); err != nil {
+		t.Log.Warn("Failed deleting temp dir", "Dir", dir, "Error", err)
+		if res != nil {
+			if res.Summary == nil {
+				res.Summary = &Summary{}
+			}
+			res.Summary.Warnings = append(res.Summary.Warnings, err.Error())
+		}
+	}
+}
+
+// Creates main.go in the dir and builds it, returning the path to the exe and
+// the dir it was built in. The build dir is only different from the given dir
+// if the exe came from the build cache.
+func (t *Tracer) buildHarness(ctx context.Context, dir string) (exe, buildDir string, err error) {
+	// Catch wrong workflow functions before fetching history or building
+	if t.PrebuiltExe == "" {
+		if err := t.resolveVendor(ctx); err != nil {
+			return "", "", err
+		} else if err := t.validateWorkflowFuncs(ctx); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Fetch execution history once for the replayer to read so it doesn't need
+	// server access
+	if t.tracerLoadsHistory() {
+		t.Log.Debug("Fetching history")
+		t.fetchedHistory = nil
+		hist, err := t.loadHistory(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		if t.EndEventID > 0 {
+			if hist, err = trimHistory(hist, t.EndEventID); err != nil {
+				return "", "", err
+			}
+		}
+		b, err := hist.Marshal()
+		if err != nil {
+			return "", "", fmt.Errorf("failed marshaling history: %w", err)
+		} else if err = os.WriteFile(filepath.Join(dir, fetchedHistoryFileName), b, 0644); err != nil {
+			return "", "", fmt.Errorf("failed writing temp history file: %w", err)
+		}
+		t.fetchedHistory = hist
+	}
+
+	// Prebuilt exes do not have a known build dir, it is determined from debug
+	// info when traced
+	if t.PrebuiltExe != "" {
+		t.Log.Debug("Using prebuilt exe", "Exe", t.PrebuiltExe)
+		return t.PrebuiltExe, "", nil
+	}
+
+	// Buffer stdin history to a file in the temp dir for the replayer
+	if t.HistoryFile == "-" {
+		if err := t.bufferStdinHistory(); err != nil {
+			return "", "", err
+		}
+		t.stdinHistoryFile = filepath.Join(dir, "history")
+		if err := os.WriteFile(t.stdinHistoryFile, t.stdinHistory, 0644); err != nil {
+			return "", "", fmt.Errorf("failed writing temp history file: %w", err)
+		}
+	}
+
+	// Register with the workflow type of the history if it differs
+	t.detectWorkflowTypeName(ctx)
 
 	// Create main.go
 	t.Log.Debug("Creating temp main.go")
-	if b, err := t.buildReplayMainCode(); err != nil {
-		return nil, fmt.Errorf("failed building temp main.go: %w", err)
-	} else if err = os.WriteFile(filepath.Join(dir, "main.go"), b, 0644); err != nil {
-		return nil, fmt.Errorf("failed writing temp main.go: %w", err)
+	source, err := t.buildReplayMainCode()
+	if err != nil {
+		return "", "", fmt.Errorf("failed building temp main.go: %w", err)
+	} else if err = os.WriteFile(filepath.Join(dir, "main.go"), source, 0644); err != nil {
+		return "", "", fmt.Errorf("failed writing temp main.go: %w", err)
+	}
+
+	// Use cached exe if present
+	var cacheKey string
+	if t.BuildCacheDir != "" {
+		if cacheKey, err = t.buildCacheKey(ctx, dir, source); err != nil {
+			return "", "", err
+		} else if exe, buildDir, ok := t.loadCachedHarness(cacheKey); ok {
+			t.Log.Debug("Using cached exe", "Exe", exe)
+			return exe, buildDir, nil
+		}
 	}
 
 	// Build binary with optimizations disabled (what the delve gobuild does for
 	// >= 1.10.0)
 	t.Log.Debug("Building temp main.go")
-	exe := filepath.Join(dir, "main")
+	exeName := t.ExeName
+	if exeName == "" {
+		exeName = filepath.Base(dir)
+	}
+	exe = filepath.Join(dir, exeName)
 	if runtime.GOOS == "windows" {
 		exe += ".exe"
 	}
-	cmd := exec.CommandContext(ctx, "go", "build", "-o", exe, "-gcflags=all=-N -l", "main.go")
+	cmd := exec.CommandContext(ctx, t.GoBinary, t.buildArgs(exe, "main.go")...)
 	cmd.Dir = dir
-	cmd.Stderr, cmd.Stdout = os.Stderr, os.Stdout
+	// Build output is diagnostic, stdout is left for trace output
+	cmd.Stderr, cmd.Stdout = os.Stderr, os.Stderr
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed building main exe: %w", err)
+		return "", "", fmt.Errorf("failed building main exe: %w", err)
 	}
+	if cacheKey != "" {
+		if err := t.storeCachedHarness(cacheKey, exe, dir); err != nil {
+			t.Log.Warn("Unable to store exe in build cache", "Error", err)
+		}
+	}
+	return exe, dir, nil
+}
 
-	// Run trace
-	trace, err := t.newTrace(dir, exe)
+// Sets the -mod=vendor flag if the main module has a vendor dir and no -mod
+// build flag was given. The Go tool would otherwise ignore the vendor dir if
+// GOFLAGS has -mod=mod or the go directive is older than 1.14.
+func (t *Tracer) resolveVendor(ctx context.Context) error {
+	t.modFlag = ""
+	for _, flag := range t.BuildFlags {
+		if strings.HasPrefix(strings.TrimLeft(flag, "-"), "mod=") {
+			return nil
+		}
+	}
+	out, err := t.goOutput(ctx, t.RootDir, "env", "GOMOD")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed resolving module: %w", err)
 	}
-	defer trace.close()
-	// Run and return result even if it errors
-	err = trace.run()
-	return &trace.result, err
+	goMod := strings.TrimSpace(string(out))
+	if goMod == "" || goMod == os.DevNull {
+		return nil
+	}
+	vendorDir := filepath.Join(filepath.Dir(goMod), "vendor")
+	if _, err := os.Stat(filepath.Join(vendorDir, "modules.txt")); err == nil {
+		t.Log.Debug("Building with vendor dir", "Dir", vendorDir)
+		t.modFlag = "-mod=vendor"
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed checking vendor dir: %w", err)
+	}
+	return nil
 }
 
-func (t *Tracer) buildReplayMainCode() ([]byte, error) {
-	optionsCode, err := t.buildClientOptionsCode()
-	if err != nil {
-		return nil, fmt.Errorf("invalid client options: %w", err)
+// Build flags for Go commands on the main module, which are the given build
+// flags and the -mod flag if resolved
+func (t *Tracer) goFlags() []string {
+	flags := append([]string(nil), t.BuildFlags...)
+	if t.modFlag != "" {
+		flags = append(flags, t.modFlag)
 	}
-	source := `package main
+	return flags
+}
 
-import (
-	"log"
-	"context"
+// Arguments to go for building with optimizations disabled (what the delve
+// gobuild does for >= 1.10.0) and the user's flags and tags
+func (t *Tracer) buildArgs(exe, file string) []string {
+	args := []string{"build", "-o", exe, "-gcflags=all=-N -l"}
+	args = append(args, t.goFlags()...)
+	if len(t.BuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(t.BuildTags, ","))
+	}
+	return append(args, file)
+}
 
-	fnpkg "` + t.fnPkg + `"
-	"go.temporal.io/api/enums/v1"
-	"go.temporal.io/api/history/v1"
-	"go.temporal.io/sdk/client"
-	"go.temporal.io/sdk/worker"
-)
+// Build flags that would stop the debugger from working or conflict with ones
+// we set
+func validateBuildFlag(flag string) error {
+	if !strings.HasPrefix(flag, "-") {
+		return fmt.Errorf("must start with -")
+	}
+	pieces := strings.SplitN(flag, "=", 2)
+	switch strings.TrimLeft(pieces[0], "-") {
+	case "gcflags":
+		return fmt.Errorf("gcflags cannot be set, optimizations must stay disabled for the debugger")
+	case "o":
+		return fmt.Errorf("output cannot be set")
+	case "tags":
+		return fmt.Errorf("tags must be set as build tags")
+	case "ldflags":
+		if len(pieces) == 2 {
+			for _, ldflag := range strings.Fields(pieces[1]) {
+				if ldflag == "-s" || ldflag == "-w" {
+					return fmt.Errorf("ldflags cannot strip debug information")
+				}
+			}
+		}
+	}
+	return nil
+}
 
-func main() {
-	// Create client
-	c, err := client.NewClient(` + optionsCode + `)
+// Sets the name to register the workflow function with from the workflow type
+// of the history when it differs from the function name. This is only done for
+// a single workflow function without Config.WorkflowTypeName, and only if the
+// tracer has the history without fetching it only for this.
+func (t *Tracer) detectWorkflowTypeName(ctx context.Context) {
+	t.detectedTypeName = ""
+	if t.WorkflowTypeName != "" || len(t.fns) != 1 || (t.Execution != nil && !t.tracerLoadsHistory()) {
+		return
+	}
+	hist, err := t.loadHistory(ctx)
 	if err != nil {
-		log.Fatalf("failed creating client: %v", err)
+		t.Log.Debug("Unable to load history to detect workflow type", "Error", err)
+		return
 	}
-	defer c.Close()
-`
-	var wfFn string
-	if t.fnStruct != "" {
-		source += `
-        var fnStruct *fnpkg.` + t.fnStruct
-		wfFn = "fnStruct." + t.fn
-	} else {
-		wfFn = "fnpkg." + t.fn
+	if typeName := historyWorkflowType(hist); typeName != "" && typeName != t.fns[0].name {
+		t.Log.Debug("Registering workflow with the workflow type of the history",
+			"Function", t.fns[0].qualified, "WorkflowType", typeName)
+		t.detectedTypeName = typeName
 	}
+}
 
-	source += `
-	// Create replayer
-	replayer := worker.NewWorkflowReplayer()
-	replayer.RegisterWorkflow(` + wfFn + `)
-`
-	// Load history if execution, otherwise use file
-	if t.Execution != nil {
-		source += `
+// Workflow type name of the started event, or empty if not present
+func historyWorkflowType(hist *history.History) string {
+	if len(hist.Events) == 0 {
+		return ""
+	}
+	return hist.Events[0].GetWorkflowExecutionStartedEventAttributes().GetWorkflowType().GetName()
+}
+
+// Name to register the workflow function with, if not the function name
+func (t *Tracer) registerName() string {
+	if t.WorkflowTypeName != "" {
+		return t.WorkflowTypeName
+	}
+	return t.detectedTypeName
+}
+
+// Whether the tracer loads the history and writes it to the temp dir for the
+// replayer to read instead of the replayer loading it
+func (t *Tracer) tracerLoadsHistory() bool {
+	return (t.Execution != nil && !t.ReplayerFetchesHistory) || t.EndEventID > 0
+}
+
+// Copy of the history with only the events up to and including the given ID.
+// Replay needs the beginning of the history, so only the end can be trimmed.
+func trimHistory(hist *history.History, endEventID int64) (*history.History, error) {
+	trimmed := &history.History{}
+	hasTask := false
+	for _, event := range hist.Events {
+		if event.EventId > endEventID {
+			break
+		}
+		trimmed.Events = append(trimmed.Events, event)
+		hasTask = hasTask || event.EventType == enums.EVENT_TYPE_WORKFLOW_TASK_STARTED
+	}
+	if !hasTask {
+		return nil, fmt.Errorf("end event ID %v is before the first workflow task started event", endEventID)
+	}
+	return trimmed, nil
+}
+
+// Confirms the event ID is a workflow task completed event in the history
+func checkTaskBoundary(hist *history.History, eventID int64) error {
+	for _, event := range hist.Events {
+		if event.EventId != eventID {
+			continue
+		} else if event.EventType != enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED {
+			return fmt.Errorf("replay until event %v is %v, not a workflow task completed event", eventID, event.EventType)
+		}
+		return nil
+	}
+	return fmt.Errorf("replay until event %v not found in history", eventID)
+}
+
+// Confirm the replayer processed up until the last workflow task of the
+// history. If it did not, the code may have returned earlier than the history
+// implies which is a form of drift that does not fail the replay.
+func (t *Tracer) checkHistoryProcessed(hist *history.History, res *Result) {
+	for _, event := range hist.Events {
+		if event.EventType == enums.EVENT_TYPE_WORKFLOW_TASK_STARTED {
+			res.Summary.LastHistoryEventID = event.EventId
+		}
+	}
+	for _, event := range res.Events {
+		if event.Server != nil {
+			res.Summary.LastProcessedEventID = event.Server.ID
+		}
+	}
+	if res.Summary.LastProcessedEventID < res.Summary.LastHistoryEventID {
+		warning := fmt.Sprintf("replay stopped at event %v but history has workflow task started at event %v, "+
+			"code may have completed earlier than the history implies",
+			res.Summary.LastProcessedEventID, res.Summary.LastHistoryEventID)
+		t.Log.Warn("History not fully processed",
+			"LastProcessedEventID", res.Summary.LastProcessedEventID,
+			"LastHistoryEventID", res.Summary.LastHistoryEventID)
+		res.Summary.Warnings = append(res.Summary.Warnings, warning)
+	}
+}
+
+type workflowFunc struct {
+	// As given in config
+	qualified string
+	pkg       string
+	// Empty if not a method
+	structName string
+	// Only relevant if structName is set
+	pointerReceiver bool
+	name            string
+	// Only set when found in source
+	file string
+	line int
+}
+
+// Accepts "pkg.Func", "pkg.(*Struct).Method", "pkg.(Struct).Method", and the
+// simplified "pkg.Struct.Method" which is treated as a pointer receiver. A
+// relative pkg is resolved by New.
+func parseWorkflowFunc(str string) (*workflowFunc, error) {
+	fn := &workflowFunc{qualified: str}
+	// Check for receiver expression
+	base := path.Base(str)
+	if recvStart := strings.Index(base, ".("); recvStart >= 0 {
+		recvLen := strings.Index(base[recvStart:], ").")
+		if recvLen == -1 {
+			return nil, fmt.Errorf("workflow function receiver missing closing parenthesis")
+		}
+		fn.pkg = str[:len(str)-len(base)] + base[:recvStart]
+		fn.structName = base[recvStart+2 : recvStart+recvLen]
+		fn.name = base[recvStart+recvLen+2:]
+		fn.pointerReceiver = strings.HasPrefix(fn.structName, "*")
+		fn.structName = strings.TrimPrefix(fn.structName, "*")
+		if fn.structName == "" || strings.ContainsAny(fn.structName, ".*()") {
+			return nil, fmt.Errorf("workflow function has invalid receiver")
+		} else if fn.name == "" || strings.ContainsAny(fn.name, ".()") {
+			return nil, fmt.Errorf("workflow function has invalid method name")
+		}
+		return fn, nil
+	}
+	lastDot := strings.LastIndex(str, ".")
+	if lastDot == -1 {
+		return nil, fmt.Errorf("workflow function missing dot")
+	}
+	fn.pkg, fn.name = str[:lastDot], str[lastDot+1:]
+	// check for struct-based workflow function
+	if strings.Count(base, ".") > 2 {
+		return nil, fmt.Errorf("workflow function has too many dots")
+	}
+	structBased := strings.Count(base, ".") == 2
+	if lastDot2 := strings.LastIndex(fn.pkg, "."); structBased && lastDot2 > -1 {
+		fn.pkg, fn.structName = fn.pkg[:lastDot2], fn.pkg[lastDot2+1:]
+		fn.pointerReceiver = true
+	}
+	return fn, nil
+}
+
+func isRelativePkg(pkg string) bool {
+	return pkg == "." || pkg == ".." || strings.HasPrefix(pkg, "./") || strings.HasPrefix(pkg, "../")
+}
+
+// Resolves a package path relative to rootDir (e.g. "./pkg/workflows") to its
+// import path using the module path in the go.mod of rootDir or its parents
+func resolveRelativePkg(rootDir, pkg string) (string, error) {
+	if rootDir == "" {
+		rootDir = "."
+	}
+	modDir, modPath, err := findModule(rootDir)
+	if err != nil {
+		return "", err
+	}
+	pkgDir, err := filepath.Abs(filepath.Join(rootDir, filepath.FromSlash(pkg)))
+	if err != nil {
+		return "", fmt.Errorf("failed resolving package dir: %w", err)
+	}
+	rel, err := filepath.Rel(modDir, pkgDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("package %v is outside of module %v", pkg, modPath)
+	} else if rel == "." {
+		return modPath, nil
+	}
+	return modPath + "/" + filepath.ToSlash(rel), nil
+}
+
+// Finds the absolute dir and module path of the go.mod in dir or its parents
+func findModule(dir string) (modDir, modPath string, err error) {
+	if modDir, err = filepath.Abs(dir); err != nil {
+		return "", "", fmt.Errorf("failed resolving dir: %w", err)
+	}
+	for {
+		b, err := os.ReadFile(filepath.Join(modDir, "go.mod"))
+		if err == nil {
+			if modPath = goModModulePath(b); modPath == "" {
+				return "", "", fmt.Errorf("no module path in %v", filepath.Join(modDir, "go.mod"))
+			}
+			return modDir, modPath, nil
+		} else if !os.IsNotExist(err) {
+			return "", "", fmt.Errorf("failed reading go.mod: %w", err)
+		}
+		parent := filepath.Dir(modDir)
+		if parent == modDir {
+			return "", "", fmt.Errorf("no go.mod found in %v or its parents", dir)
+		}
+		modDir = parent
+	}
+}
+
+// Module path from the module directive of a go.mod, or empty if none
+func goModModulePath(goMod []byte) string {
+	for _, line := range strings.Split(string(goMod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
+
+// Function name in the explicit form accepted by parseWorkflowFunc
+func (w *workflowFunc) configName() string {
+	if w.structName != "" && w.pointerReceiver {
+		return w.pkg + ".(*" + w.structName + ")." + w.name
+	} else if w.structName != "" {
+		return w.pkg + ".(" + w.structName + ")." + w.name
+	}
+	return w.pkg + "." + w.name
+}
+
+// Function name as known by the debugger
+func (w *workflowFunc) symbol() string {
+	if w.structName != "" && w.pointerReceiver {
+		return w.pkg + ".(*" + w.structName + ")." + w.name
+	} else if w.structName != "" {
+		return w.pkg + "." + w.structName + "." + w.name
+	}
+	return w.pkg + "." + w.name
+}
+
+// Name of the history file in the temp dir when the tracer fetches history.
+// This is relative so cached and prebuilt exes read the one for their run.
+const fetchedHistoryFileName = "history.pb"
+
+func (t *Tracer) buildReplayMainCode() ([]byte, error) {
+	// Only connect to the server if the replayer fetches history itself
+	replayerFetches := t.Execution != nil && t.ReplayerFetchesHistory
+	var optionsCode string
+	if replayerFetches {
+		var err error
+		if optionsCode, err = t.buildClientOptionsCode(); err != nil {
+			return nil, fmt.Errorf("invalid client options: %w", err)
+		}
+	}
+	// Alias each distinct package
+	pkgAliases := map[string]string{}
+	var pkgImports string
+	for _, fn := range t.fns {
+		if pkgAliases[fn.pkg] == "" {
+			pkgAliases[fn.pkg] = "fnpkg" + strconv.Itoa(len(pkgAliases))
+			pkgImports += "\n\t" + pkgAliases[fn.pkg] + " " + strconv.Quote(fn.pkg)
+		}
+	}
+
+	historyFile := t.HistoryFile
+	if historyFile == "-" {
+		historyFile = t.stdinHistoryFile
+	}
+	// Build the history loading first so we know which imports are needed
+	imports := []string{"log", "os", "go.temporal.io/sdk/worker"}
+	var replayCode string
+	if t.tracerLoadsHistory() {
+		imports = append(imports, "os", "go.temporal.io/api/history/v1")
+		replayCode = `
+	// Load history fetched by the tracer
+	b, err := os.ReadFile(` + strconv.Quote(fetchedHistoryFileName) + `)
+	if err != nil {
+		log.Fatalf("failed reading history file: %v", err)
+	}
+	var hist history.History
+	if err := hist.Unmarshal(b); err != nil {
+		log.Fatalf("failed unmarshaling history file: %v", err)
+	}
+
+	// Replay
+	err = replayer.ReplayWorkflowHistory(nil, &hist)`
+	} else if t.Execution != nil {
+		imports = append(imports, "context", "go.temporal.io/sdk/client", "go.temporal.io/api/enums/v1",
+			"go.temporal.io/api/history/v1")
+		replayCode = `
 	// Load history
 	var hist history.History
 	iter := c.GetWorkflowHistory(
@@ -228,18 +1306,189 @@ func main() {
 
 	// Replay
 	err = replayer.ReplayWorkflowHistory(nil, &hist)`
+	} else if gzipped, err := isGzipFile(historyFile); err != nil {
+		return nil, err
+	} else if format, err := t.historyFileFormat(); err != nil {
+		return nil, err
+	} else if gzipped || format == HistoryFormatProto {
+		imports = append(imports, "os", "go.temporal.io/api/history/v1")
+		if gzipped {
+			imports = append(imports, "compress/gzip")
+			replayCode = `
+	// Load gzipped history from file
+	f, err := os.Open(` + strconv.Quote(historyFile) + `)
+	if err != nil {
+		log.Fatalf("failed opening history file: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatalf("failed reading gzipped history file: %v", err)
+	}`
+		}
+		if format == HistoryFormatJSON {
+			imports = append(imports, "github.com/gogo/protobuf/jsonpb")
+			replayCode += `
+	var hist history.History
+	if err := jsonpb.Unmarshal(gz, &hist); err != nil {
+		log.Fatalf("failed unmarshaling history file: %v", err)
+	}`
+		} else {
+			if gzipped {
+				imports = append(imports, "io")
+				replayCode += `
+	b, err := io.ReadAll(gz)`
+			} else {
+				replayCode += `
+	// Load proto history from file
+	b, err := os.ReadFile(` + strconv.Quote(historyFile) + `)`
+			}
+			replayCode += `
+	if err != nil {
+		log.Fatalf("failed reading history file: %v", err)
+	}
+	var hist history.History
+	if err := hist.Unmarshal(b); err != nil {
+		log.Fatalf("failed unmarshaling history file: %v", err)
+	}`
+		}
+		replayCode += `
+
+	// Replay
+	err = replayer.ReplayWorkflowHistory(nil, &hist)`
+	} else {
+		// Nothing declares err before this unless the replayer was created with
+		// options
+		assign := ":="
+		if t.DataConverterExpr != "" || t.ReplayerOptionsExpr != "" {
+			assign = "="
+		}
+		replayCode = `
+	// Replay from file
+	err ` + assign + ` replayer.ReplayWorkflowHistoryFromJSONFile(nil, ` + strconv.Quote(historyFile) + `)`
+	}
+
+	if replayerFetches && t.APIKey != "" {
+		imports = append(imports, "context", "os")
+	}
+	if replayerFetches && t.hasTLS() {
+		imports = append(imports, "crypto/tls")
+		if t.TLSCACertFile != "" {
+			imports = append(imports, "crypto/x509", "os")
+		}
+	}
+
+	var dataConverterCode string
+	if t.DataConverterExpr != "" {
+		pkg, expr, err := qualifiedExprWithAlias(t.DataConverterExpr, "dcpkg")
+		if err != nil {
+			return nil, fmt.Errorf("invalid data converter expression: %w", err)
+		}
+		pkgImports += "\n\tdcpkg " + strconv.Quote(pkg)
+		dataConverterCode = `
+	// Create data converter
+	dataConverter := ` + expr + `
+`
+	}
+
+	var replayerCode string
+	if t.ReplayerOptionsExpr != "" {
+		pkg, expr, err := qualifiedExprWithAlias(t.ReplayerOptionsExpr, "ropkg")
+		if err != nil {
+			return nil, fmt.Errorf("invalid replayer options expression: %w", err)
+		}
+		pkgImports += "\n\tropkg " + strconv.Quote(pkg)
+		replayerCode = `
+	// Create replayer
+	replayerOptions := ` + expr
+		if t.DataConverterExpr != "" {
+			replayerCode += `
+	replayerOptions.DataConverter = dataConverter`
+		}
+		replayerCode += `
+	replayer, err := worker.NewWorkflowReplayerWithOptions(replayerOptions)
+	if err != nil {
+		log.Fatalf("failed creating replayer: %v", err)
+	}
+`
+	} else if t.DataConverterExpr != "" {
+		replayerCode = `
+	// Create replayer
+	replayer, err := worker.NewWorkflowReplayerWithOptions(worker.WorkflowReplayerOptions{DataConverter: dataConverter})
+	if err != nil {
+		log.Fatalf("failed creating replayer: %v", err)
+	}
+`
 	} else {
+		replayerCode = `
+	// Create replayer
+	replayer := worker.NewWorkflowReplayer()
+`
+	}
+
+	registerName := t.registerName()
+	if registerName != "" {
+		imports = append(imports, "go.temporal.io/sdk/workflow")
+	}
+
+	source := `package main
+
+import (`
+	for _, imp := range dedupeStrings(imports) {
+		source += "\n\t" + strconv.Quote(imp)
+	}
+	source += "\n" + pkgImports + `
+)
+
+func main() {
+	// Replayer logs and workflow prints are diagnostics, so they go to stderr
+	// to leave the tracer's stdout for trace output
+	os.Stdout = os.Stderr
+` + dataConverterCode
+	if replayerFetches {
 		source += `
-	// Run from file
-	err = replayer.ReplayWorkflowHistoryFromJSONFile(nil, ` + strconv.Quote(t.HistoryFile) + `) error
-	`
+	// Create client
+	c, err := client.NewClient(` + optionsCode + `)
+	if err != nil {
+		log.Fatalf("failed creating client: %v", err)
 	}
-	source += `
+	defer c.Close()
+`
+	}
+	source += replayerCode
+	for i, fn := range t.fns {
+		wfFn := pkgAliases[fn.pkg] + "." + fn.name
+		if fn.structName != "" {
+			structVar := "fnStruct" + strconv.Itoa(i)
+			structType := pkgAliases[fn.pkg] + "." + fn.structName
+			if fn.pointerReceiver {
+				structType = "*" + structType
+			}
+			source += `
+	var ` + structVar + ` ` + structType
+			wfFn = structVar + "." + fn.name
+		}
+		if registerName != "" {
+			source += `
+	replayer.RegisterWorkflowWithOptions(` + wfFn + `, workflow.RegisterOptions{Name: ` +
+				strconv.Quote(registerName) + `})`
+		} else {
+			source += `
+	replayer.RegisterWorkflow(` + wfFn + `)`
+		}
+	}
+	source += "\n" + replayCode + `
 	if err != nil {
 		log.Fatalf("failed replaying workflow: %v", err)
 	}
 }
 `
+	if replayerFetches && t.hasTLS() {
+		source += t.buildTLSConfigCode()
+	}
+	if replayerFetches && t.APIKey != "" {
+		source += t.buildAPIKeyHeadersProviderCode()
+	}
 	return format.Source([]byte(source))
 }
 
@@ -251,6 +1500,310 @@ func (t *Tracer) buildClientOptionsCode() (string, error) {
 		return "", fmt.Errorf("missing namespace")
 	}
 	// TODO(cretz): Validate none of the unsupported values are set
-	return fmt.Sprintf("client.Options{HostPort: %q, Namespace: %q}",
-		t.ClientOptions.HostPort, t.ClientOptions.Namespace), nil
+	if t.ClientOptions.ConnectionOptions.TLS != nil && !t.hasTLS() {
+		return "", fmt.Errorf("TLS must be configured via TLS file settings")
+	}
+	if _, ok := t.ClientOptions.HeadersProvider.(apiKeyHeadersProvider); t.ClientOptions.HeadersProvider != nil && !ok {
+		return "", fmt.Errorf("custom headers provider not supported, use API key setting")
+	}
+	code := fmt.Sprintf("client.Options{HostPort: %q, Namespace: %q", t.ClientOptions.HostPort, t.ClientOptions.Namespace)
+	if t.hasTLS() {
+		code += ", ConnectionOptions: client.ConnectionOptions{TLS: tlsConfig()}"
+	}
+	if t.APIKey != "" {
+		code += ", HeadersProvider: apiKeyHeadersProvider{}"
+	}
+	if t.DataConverterExpr != "" {
+		code += ", DataConverter: dataConverter"
+	}
+	return code + "}", nil
+}
+
+func (t *Tracer) hasTLS() bool {
+	return t.TLSCertFile != "" || t.TLSKeyFile != "" || t.TLSCACertFile != "" || t.TLSServerName != "" ||
+		t.APIKey != ""
+}
+
+type apiKeyHeadersProvider struct {
+	apiKey    string
+	namespace string
+}
+
+func (a apiKeyHeadersProvider) GetHeaders(context.Context) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + a.apiKey, "temporal-namespace": a.namespace}, nil
+}
+
+// Builds the apiKeyHeadersProvider type for main.go which reads the API key
+// from the environment at runtime
+func (t *Tracer) buildAPIKeyHeadersProviderCode() string {
+	return `
+type apiKeyHeadersProvider struct{}
+
+func (apiKeyHeadersProvider) GetHeaders(context.Context) (map[string]string, error) {
+	apiKey := os.Getenv(` + strconv.Quote(APIKeyEnvVar) + `)
+	if apiKey == "" {
+		log.Fatalf("missing API key env var ` + APIKeyEnvVar + `")
+	}
+	return map[string]string{
+		"authorization":      "Bearer " + apiKey,
+		"temporal-namespace": ` + strconv.Quote(t.ClientOptions.Namespace) + `,
+	}, nil
+}
+`
+}
+
+// Validates the TLS files, makes them absolute for use by the replayer, and
+// sets the TLS config on the client options for in-process use
+func (t *Tracer) applyTLS() error {
+	if !t.hasTLS() {
+		return nil
+	} else if t.ClientOptions.ConnectionOptions.TLS != nil {
+		return fmt.Errorf("cannot have TLS files and client TLS config")
+	} else if (t.TLSCertFile == "") != (t.TLSKeyFile == "") {
+		return fmt.Errorf("TLS cert and key files must be given together")
+	}
+	for _, file := range []*string{&t.TLSCertFile, &t.TLSKeyFile, &t.TLSCACertFile} {
+		if *file == "" {
+			continue
+		} else if _, err := os.Stat(*file); err != nil {
+			return fmt.Errorf("invalid TLS file: %w", err)
+		}
+		var err error
+		if *file, err = filepath.Abs(*file); err != nil {
+			return fmt.Errorf("failed making TLS file path absolute: %w", err)
+		}
+	}
+	conf := &tls.Config{ServerName: t.TLSServerName}
+	if t.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.TLSCertFile, t.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed loading TLS cert and key: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if t.TLSCACertFile != "" {
+		b, err := os.ReadFile(t.TLSCACertFile)
+		if err != nil {
+			return fmt.Errorf("failed reading TLS CA cert: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("failed parsing TLS CA cert")
+		}
+	}
+	t.ClientOptions.ConnectionOptions.TLS = conf
+	return nil
+}
+
+// Builds the tlsConfig function for main.go which loads the TLS files at
+// runtime
+func (t *Tracer) buildTLSConfigCode() string {
+	code := `
+func tlsConfig() *tls.Config {
+	conf := &tls.Config{ServerName: ` + strconv.Quote(t.TLSServerName) + `}`
+	if t.TLSCertFile != "" {
+		code += `
+	cert, err := tls.LoadX509KeyPair(` + strconv.Quote(t.TLSCertFile) + `, ` + strconv.Quote(t.TLSKeyFile) + `)
+	if err != nil {
+		log.Fatalf("failed loading TLS cert and key: %v", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}`
+	}
+	if t.TLSCACertFile != "" {
+		code += `
+	caCert, err := os.ReadFile(` + strconv.Quote(t.TLSCACertFile) + `)
+	if err != nil {
+		log.Fatalf("failed reading TLS CA cert: %v", err)
+	}
+	conf.RootCAs = x509.NewCertPool()
+	if !conf.RootCAs.AppendCertsFromPEM(caCert) {
+		log.Fatalf("failed parsing TLS CA cert")
+	}`
+	}
+	return code + `
+	return conf
+}
+`
+}
+
+func (t *Tracer) loadHistory(ctx context.Context) (*history.History, error) {
+	// If the history file is present, unmarshal from it. Otherwise load from
+	// execution.
+	if t.fetchedHistory != nil {
+		return t.fetchedHistory, nil
+	}
+	var hist history.History
+	if t.HistoryFile != "" {
+		b, err := t.readHistory()
+		if err != nil {
+			return nil, fmt.Errorf("failed loading history file: %w", err)
+		}
+		if t.HistoryFormat == HistoryFormatProto ||
+			(t.HistoryFormat == HistoryFormatAuto && sniffHistoryFormat(b) == HistoryFormatProto) {
+			err = hist.Unmarshal(b)
+		} else {
+			err = jsonpb.UnmarshalString(string(b), &hist)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed unmarshaling history file: %w", err)
+		}
+	} else if t.Execution != nil {
+		// We have to connect to server to obtain history
+		c, err := client.NewClient(t.ClientOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed connecting to server: %w", err)
+		}
+		defer c.Close()
+
+		// Iterate and build events
+		iter := c.GetWorkflowHistory(ctx, t.Execution.ID, t.Execution.RunID, false, enums.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
+		for iter.HasNext() {
+			event, err := iter.Next()
+			if err != nil {
+				return nil, fmt.Errorf("failed fetching history: %w", err)
+			}
+			hist.Events = append(hist.Events, event)
+		}
+	} else {
+		return nil, fmt.Errorf("must have execution or history file")
+	}
+	return &hist, nil
+}
+
+// Whether the file has a ".gz" extension or starts with the gzip magic header
+func isGzipFile(file string) (bool, error) {
+	if strings.HasSuffix(file, ".gz") {
+		return true, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false, fmt.Errorf("failed opening history file: %w", err)
+	}
+	defer f.Close()
+	var header [2]byte
+	n, err := io.ReadFull(f, header[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("failed reading history file: %w", err)
+	}
+	return n == 2 && header == [2]byte{0x1f, 0x8b}, nil
+}
+
+// Reads the history file, decompressing if gzipped
+func readHistoryFile(file string) ([]byte, error) {
+	if gzipped, err := isGzipFile(file); err != nil {
+		return nil, err
+	} else if !gzipped {
+		return os.ReadFile(file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return gunzip(f)
+}
+
+func gunzip(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
+
+// Reads the history, decompressing if gzipped. Stdin is only read once.
+func (t *Tracer) readHistory() ([]byte, error) {
+	if t.HistoryFile != "-" {
+		return readHistoryFile(t.HistoryFile)
+	} else if err := t.bufferStdinHistory(); err != nil {
+		return nil, err
+	} else if bytes.HasPrefix(t.stdinHistory, []byte{0x1f, 0x8b}) {
+		return gunzip(bytes.NewReader(t.stdinHistory))
+	}
+	return t.stdinHistory, nil
+}
+
+func (t *Tracer) bufferStdinHistory() error {
+	if t.stdinHistory != nil {
+		return nil
+	}
+	b, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed reading history from stdin: %w", err)
+	}
+	t.stdinHistory = b
+	return nil
+}
+
+// Resolves the history file format, sniffing the file if needed
+func (t *Tracer) historyFileFormat() (HistoryFormat, error) {
+	if t.HistoryFormat != HistoryFormatAuto {
+		return t.HistoryFormat, nil
+	}
+	b, err := t.readHistory()
+	if err != nil {
+		return 0, fmt.Errorf("failed loading history file: %w", err)
+	}
+	return sniffHistoryFormat(b), nil
+}
+
+func sniffHistoryFormat(b []byte) HistoryFormat {
+	if trimmed := bytes.TrimLeft(b, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return HistoryFormatJSON
+	}
+	return HistoryFormatProto
+}
+
+func dedupeStrings(strs []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, str := range strs {
+		if !seen[str] {
+			seen[str] = true
+			ret = append(ret, str)
+		}
+	}
+	return ret
+}
+
+// Package paths qualifying an identifier, e.g. "example.com/mypkg.Options"
+var qualifiedPkgRegexp = regexp.MustCompile(`[\w.~-]+(/[\w.~-]+)+\.\w`)
+
+// String literals, so paths in them are not taken as package references
+var stringLitRegexp = regexp.MustCompile("\"(\\\\.|[^\"\\\\])*\"|`[^`]*`")
+
+// Splits an expression qualified by a leading package, e.g.
+// "example.com/mypkg.NewThing()", into the package and the expression using
+// the given alias for the package. Later references to the same package are
+// aliased too. Other packages with a path cannot be imported, so referencing
+// them is an error.
+func qualifiedExprWithAlias(expr, alias string) (pkg, aliasedExpr string, err error) {
+	head := expr
+	if paren := strings.Index(head, "("); paren >= 0 {
+		head = head[:paren]
+	}
+	lastSlash := strings.LastIndex(head, "/")
+	dot := strings.Index(head[lastSlash+1:], ".")
+	if dot <= 0 {
+		return "", "", fmt.Errorf("expression %q not qualified by package", expr)
+	}
+	pkgEnd := lastSlash + 1 + dot
+	pkg = expr[:pkgEnd]
+	samePkg := regexp.MustCompile(`(^|[^\w./~-])` + regexp.QuoteMeta(pkg) + `\.`)
+	rest := samePkg.ReplaceAllString(expr[pkgEnd:], "${1}"+alias+".")
+	if ref := qualifiedPkgRegexp.FindString(stringLitRegexp.ReplaceAllString(rest, `""`)); ref != "" {
+		return "", "", fmt.Errorf("expression %q references %v, only package %v can be referenced", expr,
+			ref[:len(ref)-2], pkg)
+	}
+	return pkg, alias + rest, nil
+}
+
+func stringInSlice(str string, strs []string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,643 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/workflow"
+)
+
+func TestParseWorkflowFunc(t *testing.T) {
+	// Package-level function
+	fn, err := parseWorkflowFunc("example.com/foo/bar.MyWorkflow")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", fn.pkg)
+	require.Equal(t, "", fn.structName)
+	require.Equal(t, "MyWorkflow", fn.name)
+	require.Equal(t, "example.com/foo/bar.MyWorkflow", fn.symbol())
+
+	// Pointer receiver
+	fn, err = parseWorkflowFunc("example.com/foo/bar.(*Workflows).MyWorkflow")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", fn.pkg)
+	require.Equal(t, "Workflows", fn.structName)
+	require.True(t, fn.pointerReceiver)
+	require.Equal(t, "MyWorkflow", fn.name)
+	require.Equal(t, "example.com/foo/bar.(*Workflows).MyWorkflow", fn.symbol())
+
+	// Value receiver
+	fn, err = parseWorkflowFunc("example.com/foo/bar.(Workflows).MyWorkflow")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", fn.pkg)
+	require.Equal(t, "Workflows", fn.structName)
+	require.False(t, fn.pointerReceiver)
+	require.Equal(t, "example.com/foo/bar.Workflows.MyWorkflow", fn.symbol())
+
+	// Simplified form is a pointer receiver
+	fn, err = parseWorkflowFunc("example.com/foo/bar.Workflows.MyWorkflow")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", fn.pkg)
+	require.Equal(t, "Workflows", fn.structName)
+	require.True(t, fn.pointerReceiver)
+	require.Equal(t, "example.com/foo/bar.(*Workflows).MyWorkflow", fn.symbol())
+
+	// Invalid
+	for _, str := range []string{
+		"MyWorkflow",
+		"example.com/foo/bar.(*Workflows.MyWorkflow",
+		"example.com/foo/bar.().MyWorkflow",
+		"example.com/foo/bar.(*Workflows).",
+		"example.com/foo/bar.A.B.C",
+	} {
+		_, err = parseWorkflowFunc(str)
+		require.Error(t, err, str)
+	}
+}
+
+func TestTLSClientOptions(t *testing.T) {
+	// Write a self-signed cert and key
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0644))
+
+	config := Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: "my-id"},
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+		TLSCACertFile: certFile,
+		TLSServerName: "my-server",
+		// TLS is only in the generated code if the replayer connects
+		ReplayerFetchesHistory: true,
+	}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, "my-server", tr.ClientOptions.ConnectionOptions.TLS.ServerName)
+	require.Len(t, tr.ClientOptions.ConnectionOptions.TLS.Certificates, 1)
+	require.NotNil(t, tr.ClientOptions.ConnectionOptions.TLS.RootCAs)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), "ConnectionOptions: client.ConnectionOptions{TLS: tlsConfig()}")
+	require.Contains(t, string(source), "tls.LoadX509KeyPair("+strconv.Quote(certFile)+", "+strconv.Quote(keyFile)+")")
+
+	// Missing key or file fails
+	badConfig := config
+	badConfig.TLSKeyFile = ""
+	_, err = New(badConfig)
+	require.Error(t, err)
+	badConfig = config
+	badConfig.TLSCACertFile = filepath.Join(dir, "missing.pem")
+	_, err = New(badConfig)
+	require.Error(t, err)
+}
+
+func TestAPIKeyClientOptions(t *testing.T) {
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: "my-id"},
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "my-ns"},
+		APIKey:        "my-secret-key",
+		// The key is only used in the generated code if the replayer connects
+		ReplayerFetchesHistory: true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, tr.ClientOptions.ConnectionOptions.TLS)
+	headers, err := tr.ClientOptions.HeadersProvider.GetHeaders(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"authorization": "Bearer my-secret-key", "temporal-namespace": "my-ns"}, headers)
+	// Key must not be in the generated code
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), "HeadersProvider: apiKeyHeadersProvider{}")
+	require.Contains(t, string(source), `os.Getenv("`+APIKeyEnvVar+`")`)
+	require.NotContains(t, string(source), "my-secret-key")
+}
+
+func TestReplayMainCodeFetchedHistory(t *testing.T) {
+	// By default, the replayer reads history fetched by the tracer and never
+	// connects
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: "my-id"},
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+	})
+	require.NoError(t, err)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), `os.ReadFile("`+fetchedHistoryFileName+`")`)
+	require.NotContains(t, string(source), "client.NewClient")
+	require.NotContains(t, string(source), "GetWorkflowHistory")
+
+	// Unless the replayer fetches
+	tr.ReplayerFetchesHistory = true
+	source, err = tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source), "client.NewClient")
+	require.Contains(t, string(source), "GetWorkflowHistory")
+}
+
+func TestQualifiedExprWithAlias(t *testing.T) {
+	pkg, expr, err := qualifiedExprWithAlias("example.com/foo/bar.NewConverter(example.com/foo/bar.Options{})", "dcpkg")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", pkg)
+	require.Equal(t, "dcpkg.NewConverter(dcpkg.Options{})", expr)
+	pkg, expr, err = qualifiedExprWithAlias("example.com/foo/bar.DefaultConverter", "dcpkg")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", pkg)
+	require.Equal(t, "dcpkg.DefaultConverter", expr)
+	_, _, err = qualifiedExprWithAlias("NewConverter()", "dcpkg")
+	require.Error(t, err)
+
+	// Other packages cannot be imported, but paths in strings are fine
+	_, _, err = qualifiedExprWithAlias("example.com/foo/bar.NewConverter(example.com/foo/baz.Options{})", "dcpkg")
+	require.EqualError(t, err, `expression "example.com/foo/bar.NewConverter(example.com/foo/baz.Options{})" `+
+		"references example.com/foo/baz, only package example.com/foo/bar can be referenced")
+	_, _, err = qualifiedExprWithAlias("example.com/foo/bar.NewConverter(example.com/foo/bar/sub.Options{})", "dcpkg")
+	require.Error(t, err)
+	pkg, expr, err = qualifiedExprWithAlias(`example.com/foo/bar.New("example.com/foo/baz.x", "\"a/b.c")`, "dcpkg")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/foo/bar", pkg)
+	require.Equal(t, `dcpkg.New("example.com/foo/baz.x", "\"a/b.c")`, expr)
+}
+
+func TestBuildHarnessDataConverter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the harness")
+	}
+	tr, err := New(Config{
+		WorkflowFuncs:     []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+		Execution:         &workflow.Execution{ID: "my-id"},
+		ClientOptions:     client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+		DataConverterExpr: "github.com/cretz/temporal-debug-go/examples/zlibconverter.NewConverter()",
+		RootDir:           "..",
+		// Only testing the build, not fetching history
+		ReplayerFetchesHistory: true,
+	})
+	require.NoError(t, err)
+	dir, err := tr.createTempDir()
+	require.NoError(t, err)
+	defer tr.removeTempDir(dir)
+	exe, _, err := tr.buildHarness(context.Background(), dir)
+	require.NoError(t, err)
+	require.FileExists(t, exe)
+}
+
+func TestBuildHarnessJSONHistoryFile(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	require.NoError(t, os.WriteFile(historyFile, []byte(`{"events":[]}`), 0644))
+	const (
+		dataConverterExpr   = "github.com/cretz/temporal-debug-go/examples/zlibconverter.NewConverter()"
+		replayerOptionsExpr = "go.temporal.io/sdk/worker.WorkflowReplayerOptions{}"
+	)
+	for _, exprs := range [][2]string{{"", ""}, {dataConverterExpr, ""}, {"", replayerOptionsExpr}, {dataConverterExpr, replayerOptionsExpr}} {
+		tr, err := New(Config{
+			WorkflowFuncs:       []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+			HistoryFile:         historyFile,
+			DataConverterExpr:   exprs[0],
+			ReplayerOptionsExpr: exprs[1],
+			RootDir:             "..",
+		})
+		require.NoError(t, err)
+		source, err := tr.buildReplayMainCode()
+		require.NoError(t, err)
+		require.Contains(t, string(source), "replayer.ReplayWorkflowHistoryFromJSONFile(nil, "+strconv.Quote(historyFile)+")")
+		require.NotContains(t, string(source), "client.NewClient")
+		if exprs[1] != "" {
+			require.Contains(t, string(source), "replayerOptions := ropkg.WorkflowReplayerOptions{}")
+			require.Equal(t, exprs[0] != "", strings.Contains(string(source), "replayerOptions.DataConverter = dataConverter"))
+		}
+		if testing.Short() {
+			continue
+		}
+		// Confirm it compiles
+		dir, err := tr.createTempDir()
+		require.NoError(t, err)
+		defer tr.removeTempDir(dir)
+		exe, _, err := tr.buildHarness(context.Background(), dir)
+		require.NoError(t, err)
+		require.FileExists(t, exe)
+	}
+}
+
+func TestWorkflowTypeName(t *testing.T) {
+	config := Config{
+		WorkflowFuncs:    []string{"example.com/foo.MyWorkflow", "example.com/foo.OtherWorkflow"},
+		HistoryFile:      "history.json",
+		WorkflowTypeName: "my-workflow",
+	}
+	_, err := New(config)
+	require.EqualError(t, err, "workflow type name requires exactly one workflow function")
+	config.WorkflowFuncs = config.WorkflowFuncs[:1]
+	config.WorkflowTypeName = " my-workflow"
+	_, err = New(config)
+	require.EqualError(t, err, `workflow type name " my-workflow" has surrounding whitespace`)
+
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	require.NoError(t, os.WriteFile(historyFile, []byte(`{"events":[]}`), 0644))
+	tr, err := New(Config{
+		WorkflowFuncs:    []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+		HistoryFile:      historyFile,
+		WorkflowTypeName: "my-workflow",
+		RootDir:          "..",
+	})
+	require.NoError(t, err)
+	source, err := tr.buildReplayMainCode()
+	require.NoError(t, err)
+	require.Contains(t, string(source),
+		`replayer.RegisterWorkflowWithOptions(fnpkg0.MyWorkflow, workflow.RegisterOptions{Name: "my-workflow"})`)
+	require.NotContains(t, string(source), "replayer.RegisterWorkflow(")
+	if testing.Short() {
+		return
+	}
+	// Confirm it compiles
+	dir, err := tr.createTempDir()
+	require.NoError(t, err)
+	defer tr.removeTempDir(dir)
+	exe, _, err := tr.buildHarness(context.Background(), dir)
+	require.NoError(t, err)
+	require.FileExists(t, exe)
+}
+
+func TestBuildHarnessVendored(t *testing.T) {
+	if testing.Short() {
+		t.Skip("vendors the SDK and builds the harness")
+	}
+	// Module requiring the same deps as this one, vendored from the module cache
+	modDir := t.TempDir()
+	goMod, err := os.ReadFile("../go.mod")
+	require.NoError(t, err)
+	goMod = regexp.MustCompile(`(?m)^module .*$`).ReplaceAll(goMod, []byte("module example.com/vendored"))
+	require.NoError(t, os.WriteFile(filepath.Join(modDir, "go.mod"), goMod, 0644))
+	goSum, err := os.ReadFile("../go.sum")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(modDir, "go.sum"), goSum, 0644))
+	// The harness needs the worker package vendored too
+	require.NoError(t, os.WriteFile(filepath.Join(modDir, "workflow.go"), []byte(`package vendored
+
+import (
+	_ "go.temporal.io/sdk/worker"
+	"go.temporal.io/sdk/workflow"
+)
+
+func MyWorkflow(ctx workflow.Context) error {
+	return nil
+}
+`), 0644))
+	cmd := exec.Command("go", "mod", "vendor")
+	cmd.Dir = modDir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "go mod vendor failed: %s", out)
+
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	require.NoError(t, os.WriteFile(historyFile, []byte(`{"events":[]}`), 0644))
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"example.com/vendored.MyWorkflow"},
+		HistoryFile:   historyFile,
+		RootDir:       modDir,
+	})
+	require.NoError(t, err)
+	dir, err := tr.createTempDir()
+	require.NoError(t, err)
+	defer tr.removeTempDir(dir)
+	exe, _, err := tr.buildHarness(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, "-mod=vendor", tr.modFlag)
+	require.Contains(t, tr.buildArgs(exe, "main.go"), "-mod=vendor")
+
+	// The SDK sources in the binary are the vendored ones and are matched
+	b, err := os.ReadFile(exe)
+	require.NoError(t, err)
+	vendoredFile := filepath.ToSlash(filepath.Join(modDir, "vendor/go.temporal.io/sdk/internal/internal_workflow.go"))
+	require.True(t, bytes.Contains(b, []byte(vendoredFile)))
+	require.Equal(t, []string{vendoredFile}, matchingSourceFiles([]string{vendoredFile}, matchInternalWorkflow))
+
+	// An explicit -mod flag is left alone
+	tr.BuildFlags = []string{"-mod=mod"}
+	require.NoError(t, tr.resolveVendor(context.Background()))
+	require.Empty(t, tr.modFlag)
+}
+
+func TestDelveBackend(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, "default", tr.DelveBackend)
+	config.DelveBackend = "rr"
+	_, err = New(config)
+	require.NoError(t, err)
+	config.DelveBackend = "gdb"
+	_, err = New(config)
+	require.EqualError(t, err, `unknown Delve backend "gdb", expected one of: default, native, lldb, rr`)
+}
+
+func TestBuildHarnessCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the harness")
+	}
+	tr, err := New(Config{
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+		Execution:     &workflow.Execution{ID: "my-id"},
+		ClientOptions: client.Options{HostPort: "127.0.0.1:7233", Namespace: "default"},
+		RootDir:       "..",
+		BuildCacheDir: t.TempDir(),
+		// Only testing the build, not fetching history
+		ReplayerFetchesHistory: true,
+	})
+	require.NoError(t, err)
+	build := func() (exe, buildDir, dir string) {
+		dir, err := tr.createTempDir()
+		require.NoError(t, err)
+		t.Cleanup(func() { tr.removeTempDir(dir) })
+		exe, buildDir, err = tr.buildHarness(context.Background(), dir)
+		require.NoError(t, err)
+		return exe, buildDir, dir
+	}
+
+	// First is built, second is from cache with original build dir
+	exe1, buildDir1, dir1 := build()
+	require.Equal(t, dir1, buildDir1)
+	require.Equal(t, dir1, filepath.Dir(exe1))
+	exe2, buildDir2, dir2 := build()
+	require.NotEqual(t, dir1, dir2)
+	require.Equal(t, dir1, buildDir2)
+	require.Equal(t, tr.BuildCacheDir, filepath.Dir(filepath.Dir(exe2)))
+
+	// Changing client options invalidates
+	tr.ClientOptions.Namespace = "other-namespace"
+	_, buildDir3, dir3 := build()
+	require.Equal(t, dir3, buildDir3)
+}
+
+func TestRemoveTempDirRetries(t *testing.T) {
+	tr, err := New(Config{
+		WorkflowFuncs:         []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:           "history.json",
+		TempDirRemoveAttempts: 3,
+		TempDirRemoveDelay:    time.Microsecond,
+	})
+	require.NoError(t, err)
+
+	// Succeeds on the last attempt, like Windows once the process has exited
+	var attempts int
+	tr.removeAll = func(string) error {
+		if attempts++; attempts < 3 {
+			return fmt.Errorf("in use")
+		}
+		return nil
+	}
+	require.NoError(t, tr.removeTempDir("some-dir"))
+	require.Equal(t, 3, attempts)
+
+	// Fails all attempts and is added to result warnings
+	attempts = 0
+	tr.removeAll = func(string) error {
+		attempts++
+		return fmt.Errorf("in use")
+	}
+	res := &Result{}
+	tr.removeTempDirWithWarning("some-dir", res)
+	require.Equal(t, 3, attempts)
+	require.Equal(t, []string{"failed deleting temp dir some-dir after 3 attempt(s): in use"}, res.Summary.Warnings)
+}
+
+func TestReplayerEnv(t *testing.T) {
+	tr, err := New(Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"})
+	require.NoError(t, err)
+	require.Equal(t, []string{SDKDebugModeEnvVar + "=true"}, tr.replayerEnv())
+	tr.KeepDeadlockDetection = true
+	require.Empty(t, tr.replayerEnv())
+	tr.APIKey = "my-secret-key"
+	require.Empty(t, tr.replayerEnv())
+	require.Empty(t, tr.apiKeyEnv())
+	tr.ReplayerFetchesHistory = true
+	require.Equal(t, []string{APIKeyEnvVar + "=my-secret-key"}, tr.replayerEnv())
+	require.Equal(t, []string{APIKeyEnvVar + "=my-secret-key"}, tr.apiKeyEnv())
+
+	// Only set while the func runs, the previous state is restored after
+	const unsetVar, setVar = "TEMPORAL_DEBUG_TEST_UNSET", "TEMPORAL_DEBUG_TEST_SET"
+	os.Unsetenv(unsetVar)
+	os.Setenv(setVar, "before")
+	defer os.Unsetenv(setVar)
+	err = withEnv([]string{unsetVar + "=a", setVar + "=b"}, func() error {
+		require.Equal(t, "a", os.Getenv(unsetVar))
+		require.Equal(t, "b", os.Getenv(setVar))
+		return nil
+	})
+	require.NoError(t, err)
+	_, ok := os.LookupEnv(unsetVar)
+	require.False(t, ok)
+	require.Equal(t, "before", os.Getenv(setVar))
+}
+
+func TestNoEventsError(t *testing.T) {
+	err := error(&NoEventsError{Breakpoints: []*BreakpointHits{
+		{Name: "workflow function example.com/foo.MyWorkflow", Hits: 0},
+		{Name: "process event", Hits: 4},
+		{Name: "spawn coroutine", Hits: 0},
+	}})
+	require.True(t, errors.Is(err, ErrNoEvents))
+	require.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), ErrNoEvents))
+	require.EqualError(t, err, "no events recorded, 2 of 3 breakpoints never hit: "+
+		"workflow function example.com/foo.MyWorkflow, spawn coroutine")
+	require.EqualError(t, &NoEventsError{}, "no events recorded")
+}
+
+func TestExeNameConfig(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	config.ExeName = "my-replayer"
+	_, err := New(config)
+	require.NoError(t, err)
+	for _, name := range []string{".", "..", "foo/bar", `foo\bar`, "bar/", "main.go"} {
+		config.ExeName = name
+		_, err = New(config)
+		require.EqualError(t, err, fmt.Sprintf("invalid exe name %q", name))
+	}
+}
+
+func TestTraceLimitsConfig(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	config.TraceTimeout, config.MaxSteps = time.Minute, 1000
+	_, err := New(config)
+	require.NoError(t, err)
+	config.TraceTimeout = -time.Second
+	_, err = New(config)
+	require.EqualError(t, err, "trace timeout cannot be negative")
+	config.TraceTimeout, config.MaxSteps = 0, -1
+	_, err = New(config)
+	require.EqualError(t, err, "max steps cannot be negative")
+}
+
+func TestStackDepthConfig(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, 10, tr.StackDepth)
+	config.StackDepth = -1
+	_, err = New(config)
+	require.EqualError(t, err, "stack depth cannot be negative")
+}
+
+func TestEventRangeConfig(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	config.StartEventID, config.EndEventID = 5, 10
+	_, err := New(config)
+	require.NoError(t, err)
+	config.StartEventID = 11
+	_, err = New(config)
+	require.EqualError(t, err, "start event ID 11 is after end event ID 10")
+	config.StartEventID = -1
+	_, err = New(config)
+	require.EqualError(t, err, "event IDs cannot be negative")
+	config.StartEventID, config.ReplayUntilEventID = 0, -1
+	_, err = New(config)
+	require.EqualError(t, err, "event IDs cannot be negative")
+	config = Config{
+		WorkflowFuncs:          []string{"example.com/foo.MyWorkflow"},
+		Execution:              &workflow.Execution{ID: "my-id"},
+		ReplayerFetchesHistory: true,
+		EndEventID:             10,
+	}
+	_, err = New(config)
+	require.EqualError(t, err, "cannot have end event ID when replayer fetches history")
+}
+
+func TestGoBinary(t *testing.T) {
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json"}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, "go", tr.GoBinary)
+
+	// Must be executable
+	notExe := filepath.Join(t.TempDir(), "go")
+	require.NoError(t, os.WriteFile(notExe, []byte("not a binary"), 0644))
+	for _, goBinary := range []string{notExe, filepath.Join(t.TempDir(), "missing", "go")} {
+		config.GoBinary = goBinary
+		_, err = New(config)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is not executable")
+	}
+}
+
+func TestBuildFlags(t *testing.T) {
+	config := Config{
+		WorkflowFuncs: []string{"example.com/foo.MyWorkflow"},
+		HistoryFile:   "history.json",
+		BuildFlags:    []string{"-mod=mod", "-ldflags=-X main.foo=bar"},
+		BuildTags:     []string{"foo", "bar"},
+	}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.Equal(t, []string{"build", "-o", "my.exe", "-gcflags=all=-N -l", "-mod=mod", "-ldflags=-X main.foo=bar",
+		"-tags", "foo,bar", "main.go"}, tr.buildArgs("my.exe", "main.go"))
+
+	// Flags that break debugging
+	for _, flag := range []string{"-gcflags=all=-l", "--gcflags", "-o=foo", "-tags=foo", "-ldflags=-s -w", "mod=mod"} {
+		config.BuildFlags = []string{flag}
+		_, err = New(config)
+		require.Error(t, err, flag)
+	}
+}
+
+func TestGoVersionFromVersionOutput(t *testing.T) {
+	require.Equal(t, "go1.15.15", goVersionFromVersionOutput("go version go1.15.15 linux/amd64\n"))
+	require.Equal(t, "devel", goVersionFromVersionOutput("go version devel go1.18-2d6d3a0 Tue Nov 2 linux/amd64"))
+	require.Empty(t, goVersionFromVersionOutput("unexpected"))
+}
+
+func TestPrebuiltExe(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "replayer")
+	require.NoError(t, os.WriteFile(exe, nil, 0755))
+	config := Config{WorkflowFuncs: []string{"example.com/foo.MyWorkflow"}, HistoryFile: "history.json", PrebuiltExe: exe}
+	tr, err := New(config)
+	require.NoError(t, err)
+	// Used as is without building
+	actualExe, buildDir, err := tr.buildHarness(context.Background(), t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, exe, actualExe)
+	require.Empty(t, buildDir)
+	// Not built with the toolchain, so not checked against it
+	require.NoError(t, tr.CheckToolchain(context.Background()))
+
+	// Must exist and cannot be used with stdin history
+	config.PrebuiltExe = exe + "-missing"
+	_, err = New(config)
+	require.Error(t, err)
+	config.PrebuiltExe, config.HistoryFile = exe, "-"
+	_, err = New(config)
+	require.EqualError(t, err, "cannot read history from stdin with prebuilt exe")
+}
+
+func TestRelativeWorkflowFunc(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "go.mod"),
+		[]byte("// My module\nmodule example.com/mymod // comment\n\ngo 1.17\n"), 0644))
+	subDir := filepath.Join(root, "cmd")
+	require.NoError(t, os.Mkdir(subDir, 0755))
+
+	for _, test := range []struct {
+		rootDir  string
+		fn       string
+		expected string
+		pkg      string
+	}{
+		// Relative to the module root or a dir in it
+		{root, "./pkg/workflows.MyWorkflow", "example.com/mymod/pkg/workflows.MyWorkflow", "example.com/mymod/pkg/workflows"},
+		{root, "./.MyWorkflow", "example.com/mymod.MyWorkflow", "example.com/mymod"},
+		{subDir, "../pkg/workflows.(*Workflows).MyWorkflow", "example.com/mymod/pkg/workflows.(*Workflows).MyWorkflow",
+			"example.com/mymod/pkg/workflows"},
+		// Fully qualified is unchanged
+		{root, "example.com/mymod/pkg/workflows.MyWorkflow", "example.com/mymod/pkg/workflows.MyWorkflow",
+			"example.com/mymod/pkg/workflows"},
+		{root, "example.com/other.MyWorkflow", "example.com/other.MyWorkflow", "example.com/other"},
+	} {
+		tr, err := New(Config{WorkflowFuncs: []string{test.fn}, HistoryFile: "history.json", RootDir: test.rootDir})
+		require.NoError(t, err, test.fn)
+		require.Equal(t, test.expected, tr.fns[0].qualified, test.fn)
+		require.Equal(t, test.pkg, tr.fns[0].pkg, test.fn)
+	}
+
+	// Outside of the module or without one
+	_, err := New(Config{WorkflowFuncs: []string{"../other.MyWorkflow"}, HistoryFile: "history.json", RootDir: root})
+	require.EqualError(t, err, `invalid workflow function "../other.MyWorkflow": `+
+		"package ../other is outside of module example.com/mymod")
+	// Temp dir is not expected to be in a module, but not guaranteed
+	if _, err = resolveRelativePkg(t.TempDir(), "./pkg"); err != nil {
+		require.Contains(t, err.Error(), "no go.mod found")
+	}
+}
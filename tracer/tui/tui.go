@@ -0,0 +1,341 @@
+// Package tui is an interactive terminal browser for trace results.
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/gdamore/tcell"
+)
+
+// Run shows the result in the terminal until the user quits. Events are listed
+// in a sidebar and the selected event is shown in the main pane, with source
+// lines around code events.
+func Run(res *tracer.Result) error {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return fmt.Errorf("failed creating screen: %w", err)
+	}
+	return run(screen, res)
+}
+
+func run(screen tcell.Screen, res *tracer.Result) error {
+	if err := screen.Init(); err != nil {
+		return fmt.Errorf("failed initializing screen: %w", err)
+	}
+	defer screen.Fini()
+	b := newBrowser(res)
+	for {
+		b.draw(screen)
+		screen.Show()
+		switch ev := screen.PollEvent().(type) {
+		case nil:
+			// Screen was finalized
+			return nil
+		case *tcell.EventResize:
+			screen.Sync()
+		case *tcell.EventKey:
+			if !b.handleKey(ev) {
+				return nil
+			}
+		}
+	}
+}
+
+type eventKind int
+
+const (
+	eventKindServer eventKind = iota
+	eventKindClient
+	eventKindCode
+	// Cannot be hidden
+	eventKindResult
+)
+
+func kindOf(event *tracer.Event) eventKind {
+	switch {
+	case event.Server != nil:
+		return eventKindServer
+	case event.Client != nil:
+		return eventKindClient
+	case event.Result != nil:
+		return eventKindResult
+	default:
+		return eventKindCode
+	}
+}
+
+// Number of source lines shown before and after a code event's line
+const sourceContextLines = 10
+
+// Width of the event sidebar
+const sidebarWidth = 50
+
+type browser struct {
+	events []*tracer.Event
+	// Kinds that are hidden
+	hidden map[eventKind]bool
+	// Indexes into events of the visible events
+	visible []int
+	// Index into visible of the selected event
+	selected int
+	// Index into visible of the first event shown in the sidebar
+	scroll int
+	// Height of the sidebar on last draw, used for paging
+	pageSize int
+	// Key is file, value is nil if the file could not be read
+	sources map[string][]string
+}
+
+func newBrowser(res *tracer.Result) *browser {
+	b := &browser{events: res.Events, hidden: map[eventKind]bool{}, pageSize: 1, sources: map[string][]string{}}
+	b.applyFilter()
+	return b
+}
+
+// Rebuilds the visible events, keeping the selected event if it is still
+// visible
+func (b *browser) applyFilter() {
+	prevSelected := b.selectedIndex()
+	b.visible = b.visible[:0]
+	b.selected = 0
+	for i, event := range b.events {
+		if b.hidden[kindOf(event)] {
+			continue
+		}
+		if i <= prevSelected {
+			b.selected = len(b.visible)
+		}
+		b.visible = append(b.visible, i)
+	}
+}
+
+// Index into events of the selected event or -1 if none
+func (b *browser) selectedIndex() int {
+	if b.selected < len(b.visible) {
+		return b.visible[b.selected]
+	}
+	return -1
+}
+
+func (b *browser) move(delta int) {
+	b.selected += delta
+	if b.selected >= len(b.visible) {
+		b.selected = len(b.visible) - 1
+	}
+	if b.selected < 0 {
+		b.selected = 0
+	}
+}
+
+// Returns false if the browser should close
+func (b *browser) handleKey(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return false
+	case tcell.KeyUp:
+		b.move(-1)
+	case tcell.KeyDown:
+		b.move(1)
+	case tcell.KeyPgUp:
+		b.move(-b.pageSize)
+	case tcell.KeyPgDn:
+		b.move(b.pageSize)
+	case tcell.KeyHome:
+		b.move(-len(b.visible))
+	case tcell.KeyEnd:
+		b.move(len(b.visible))
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return false
+		case 'k':
+			b.move(-1)
+		case 'j':
+			b.move(1)
+		case '1':
+			b.toggle(eventKindServer)
+		case '2':
+			b.toggle(eventKindClient)
+		case '3':
+			b.toggle(eventKindCode)
+		case 'a':
+			b.hidden = map[eventKind]bool{}
+			b.applyFilter()
+		}
+	}
+	return true
+}
+
+func (b *browser) toggle(kind eventKind) {
+	b.hidden[kind] = !b.hidden[kind]
+	b.applyFilter()
+}
+
+func (b *browser) draw(screen tcell.Screen) {
+	screen.Clear()
+	width, height := screen.Size()
+	// Last line is the status line
+	b.pageSize = height - 1
+	if b.pageSize < 1 {
+		b.pageSize = 1
+	}
+	sideWidth := sidebarWidth
+	if sideWidth > width/2 {
+		sideWidth = width / 2
+	}
+
+	// Keep the selected event in view
+	if b.selected < b.scroll {
+		b.scroll = b.selected
+	} else if b.selected >= b.scroll+b.pageSize {
+		b.scroll = b.selected - b.pageSize + 1
+	}
+
+	// Sidebar
+	for y := 0; y < b.pageSize && b.scroll+y < len(b.visible); y++ {
+		style := tcell.StyleDefault
+		if b.scroll+y == b.selected {
+			style = style.Reverse(true)
+		}
+		drawText(screen, 0, y, sideWidth-1, style, eventSummary(b.events[b.visible[b.scroll+y]]))
+	}
+	for y := 0; y < b.pageSize; y++ {
+		screen.SetContent(sideWidth-1, y, tcell.RuneVLine, nil, tcell.StyleDefault)
+	}
+
+	// Main pane
+	if index := b.selectedIndex(); index >= 0 {
+		for y, line := range b.eventDetails(b.events[index], b.pageSize) {
+			style := tcell.StyleDefault
+			if line.highlight {
+				style = style.Reverse(true)
+			}
+			drawText(screen, sideWidth+1, y, width-sideWidth-1, style, line.text)
+		}
+	} else {
+		drawText(screen, sideWidth+1, 0, width-sideWidth-1, tcell.StyleDefault, "No events")
+	}
+
+	// Status line
+	status := fmt.Sprintf("%v/%v  [1] server %v  [2] commands %v  [3] code %v  [a] all  [q] quit",
+		b.selected+1, len(b.visible), onOff(!b.hidden[eventKindServer]),
+		onOff(!b.hidden[eventKindClient]), onOff(!b.hidden[eventKindCode]))
+	drawText(screen, 0, height-1, width, tcell.StyleDefault.Bold(true), status)
+}
+
+type detailLine struct {
+	text      string
+	highlight bool
+}
+
+func (b *browser) eventDetails(event *tracer.Event, maxLines int) []detailLine {
+	var lines []detailLine
+	add := func(format string, v ...interface{}) {
+		lines = append(lines, detailLine{text: fmt.Sprintf(format, v...)})
+	}
+	switch {
+	case event.Server != nil:
+		add("Event %v - %v", event.Server.ID, event.Server.Type)
+		if details := event.Server.Details(); details != "" {
+			add("  %v", details)
+		}
+		if event.Server.Note != "" {
+			add("  Note: %v", event.Server.Note)
+		}
+	case event.Client != nil:
+		add("Commands to server (task %v)", event.Client.Task)
+		for i, command := range event.Client.Commands {
+			if details := event.Client.CommandDetails(i); details != "" {
+				add("  %v (%v)", command, details)
+			} else {
+				add("  %v", command)
+			}
+		}
+	case event.Result != nil:
+		add("Workflow %v", event.Result.Details())
+	case event.Code != nil:
+		add("%v - %v:%v (coroutine: %v)", event.Code.Package, filepath.Base(event.Code.File),
+			event.Code.Line, event.Code.Coroutine)
+		add("")
+		source := b.source(event.Code.File)
+		if source == nil {
+			add("Unable to read %v", event.Code.File)
+		} else {
+			// Fit the context in the lines we have left, leaving room for locals
+			context := sourceContextLines
+			if avail := (maxLines - len(lines) - len(event.Code.Locals) - 2) / 2; avail < context {
+				context = avail
+			}
+			if context < 0 {
+				context = 0
+			}
+			for line := event.Code.Line - context; line <= event.Code.Line+context; line++ {
+				if line >= 1 && line <= len(source) {
+					lines = append(lines, detailLine{
+						text:      fmt.Sprintf("%5d  %v", line, strings.ReplaceAll(source[line-1], "\t", "    ")),
+						highlight: line == event.Code.Line,
+					})
+				}
+			}
+		}
+		if len(event.Code.Locals) > 0 {
+			add("")
+			add("Locals:")
+			for _, local := range event.Code.Locals {
+				add("  %v = %v", local.Name, local.Value)
+			}
+		}
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	return lines
+}
+
+func (b *browser) source(file string) []string {
+	lines, ok := b.sources[file]
+	if !ok {
+		if byts, err := os.ReadFile(file); err == nil {
+			lines = strings.Split(string(byts), "\n")
+		}
+		b.sources[file] = lines
+	}
+	return lines
+}
+
+func eventSummary(event *tracer.Event) string {
+	switch {
+	case event.Server != nil:
+		return fmt.Sprintf("Event %v - %v", event.Server.ID, event.Server.Type)
+	case event.Client != nil:
+		commands := make([]string, len(event.Client.Commands))
+		for i, command := range event.Client.Commands {
+			commands[i] = command.String()
+		}
+		return "  Commands - " + strings.Join(commands, ", ")
+	case event.Result != nil:
+		return "Workflow " + event.Result.Details()
+	default:
+		return fmt.Sprintf("    %v:%v", filepath.Base(event.Code.File), event.Code.Line)
+	}
+}
+
+func drawText(screen tcell.Screen, x, y, width int, style tcell.Style, text string) {
+	for i, r := range []rune(text) {
+		if i >= width {
+			return
+		}
+		screen.SetContent(x+i, y, r, nil, style)
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
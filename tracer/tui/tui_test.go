@@ -0,0 +1,90 @@
+package tui
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/temporal-debug-go/tracer"
+	"github.com/gdamore/tcell"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/api/enums/v1"
+)
+
+func TestBrowserFilter(t *testing.T) {
+	b := newBrowser(testResult(t))
+	require.Len(t, b.visible, 4)
+
+	// Select the code event then hide server events, selection should stay
+	b.handleKey(tcell.NewEventKey(tcell.KeyDown, 0, 0))
+	b.handleKey(tcell.NewEventKey(tcell.KeyDown, 0, 0))
+	require.NotNil(t, b.events[b.selectedIndex()].Code)
+	b.handleKey(tcell.NewEventKey(tcell.KeyRune, '1', 0))
+	require.Equal(t, []int{1, 2}, b.visible)
+	require.NotNil(t, b.events[b.selectedIndex()].Code)
+
+	// Hide code, selection moves to the previous visible event
+	b.handleKey(tcell.NewEventKey(tcell.KeyRune, '3', 0))
+	require.Equal(t, []int{1}, b.visible)
+	require.NotNil(t, b.events[b.selectedIndex()].Client)
+
+	// Show all again and go to end
+	b.handleKey(tcell.NewEventKey(tcell.KeyRune, 'a', 0))
+	b.handleKey(tcell.NewEventKey(tcell.KeyEnd, 0, 0))
+	require.Equal(t, 3, b.selectedIndex())
+
+	// Quit
+	require.False(t, b.handleKey(tcell.NewEventKey(tcell.KeyRune, 'q', 0)))
+}
+
+func TestBrowserDraw(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	require.NoError(t, screen.Init())
+	defer screen.Fini()
+	screen.SetSize(120, 20)
+
+	// Select the code event and confirm source is shown
+	b := newBrowser(testResult(t))
+	b.move(2)
+	b.draw(screen)
+	screen.Show()
+	text := screenText(screen)
+	require.Contains(t, text, "Event 3 - WorkflowTaskStarted")
+	require.Contains(t, text, "Commands - ScheduleActivityTask")
+	require.Contains(t, text, "    3  line 3")
+	require.Contains(t, text, "Locals:")
+	require.Contains(t, text, "foo = bar")
+}
+
+func testResult(t *testing.T) *tracer.Result {
+	file := filepath.Join(t.TempDir(), "workflow.go")
+	require.NoError(t, os.WriteFile(file, []byte("line 1\nline 2\nline 3\nline 4\n"), 0644))
+	return &tracer.Result{Events: []*tracer.Event{
+		{Server: &tracer.EventServer{ID: 3, Type: tracer.EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_STARTED)}},
+		{Client: &tracer.EventClient{
+			Commands: []tracer.EventClientCommandType{tracer.EventClientCommandType(enums.COMMAND_TYPE_SCHEDULE_ACTIVITY_TASK)},
+		}},
+		{Code: &tracer.EventCode{
+			Package: "mypkg", File: file, Line: 3, Coroutine: "root",
+			Locals: []tracer.EventCodeLocal{{Name: "foo", Value: "bar"}},
+		}},
+		{Server: &tracer.EventServer{ID: 4, Type: tracer.EventServerType(enums.EVENT_TYPE_WORKFLOW_TASK_COMPLETED)}},
+	}}
+}
+
+func screenText(screen tcell.SimulationScreen) string {
+	cells, width, _ := screen.GetContents()
+	var s strings.Builder
+	for i, cell := range cells {
+		if i > 0 && i%width == 0 {
+			s.WriteString("\n")
+		}
+		if len(cell.Runes) > 0 {
+			s.WriteRune(cell.Runes[0])
+		} else {
+			s.WriteRune(' ')
+		}
+	}
+	return s.String()
+}
@@ -0,0 +1,374 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const workflowPkg = "go.temporal.io/sdk/workflow"
+
+// Confirm each workflow function is an exported function or method in its
+// package that takes a workflow.Context first and returns an error last. This
+// is done before building since a wrong function otherwise either fails to
+// compile with a confusing error or never hits its breakpoint. Packages are
+// type checked, so this must be called after resolveVendor.
+func (t *Tracer) validateWorkflowFuncs(ctx context.Context) error {
+	pkgFuncs := map[string][]*workflowFunc{}
+	for _, fn := range t.fns {
+		candidates, ok := pkgFuncs[fn.pkg]
+		if !ok {
+			var err error
+			if candidates, err = t.workflowFuncsInPackage(ctx, fn.pkg); err != nil {
+				return err
+			}
+			pkgFuncs[fn.pkg] = candidates
+		}
+		found := false
+		for _, candidate := range candidates {
+			if candidate.structName == fn.structName && candidate.pointerReceiver == fn.pointerReceiver &&
+				candidate.name == fn.name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			msg := fmt.Sprintf("no such exported workflow function %v in package %v",
+				strings.TrimPrefix(fn.qualified, fn.pkg+"."), fn.pkg)
+			if suggestions := suggestWorkflowFuncs(fn, candidates); len(suggestions) > 0 {
+				return fmt.Errorf("%v, did you mean %v?", msg, strings.Join(suggestions, " or "))
+			}
+			names := make([]string, len(candidates))
+			for i, candidate := range candidates {
+				names[i] = candidate.qualified
+			}
+			list := "none"
+			if len(names) > 0 {
+				list = strings.Join(names, ", ")
+			}
+			return fmt.Errorf("%v, workflow functions in package: %v", msg, list)
+		}
+	}
+	return nil
+}
+
+// WorkflowFuncsConfig is how packages are loaded to find workflow functions.
+type WorkflowFuncsConfig struct {
+	// Dir of the module the packages are resolved from. Default is current dir.
+	RootDir string
+	// Go binary to list packages with. Default is "go" on the PATH.
+	GoBinary string
+	// Build tags deciding which files are read
+	BuildTags []string
+}
+
+// ListWorkflowFuncs returns the exported functions and methods in the package
+// that take a workflow.Context first and return an error last. The packages are
+// type checked, so aliases of either type are followed. Names are in the form
+// accepted by Config.WorkflowFuncs and sorted.
+func ListWorkflowFuncs(ctx context.Context, config WorkflowFuncsConfig, pkg string) ([]string, error) {
+	infos, err := FindWorkflowFuncs(ctx, config, pkg)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name
+	}
+	return names, nil
+}
+
+// WorkflowFuncInfo is a workflow function found in source.
+type WorkflowFuncInfo struct {
+	// In the form accepted by Config.WorkflowFuncs
+	Name string `json:"name"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// FindWorkflowFuncs is like ListWorkflowFuncs but for every package matching
+// the go list patterns (e.g. "./...") and including where each is declared.
+func FindWorkflowFuncs(
+	ctx context.Context,
+	config WorkflowFuncsConfig,
+	patterns ...string,
+) ([]*WorkflowFuncInfo, error) {
+	var flags []string
+	if len(config.BuildTags) > 0 {
+		flags = append(flags, "-tags", strings.Join(config.BuildTags, ","))
+	}
+	fns, err := loadWorkflowFuncs(ctx, config.GoBinary, config.RootDir, flags, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*WorkflowFuncInfo, len(fns))
+	for i, fn := range fns {
+		infos[i] = &WorkflowFuncInfo{Name: fn.qualified, File: fn.file, Line: fn.line}
+	}
+	return infos, nil
+}
+
+// Candidates whose name is close to the given function's name, closest first
+func suggestWorkflowFuncs(fn *workflowFunc, candidates []*workflowFunc) []string {
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	for _, candidate := range candidates {
+		// Allow a typo per few characters
+		distance := editDistance(strings.ToLower(fn.name), strings.ToLower(candidate.name))
+		if candidate.structName != fn.structName || candidate.pointerReceiver != fn.pointerReceiver {
+			distance++
+		}
+		if maxDistance := len(fn.name)/4 + 1; distance <= maxDistance {
+			suggestions = append(suggestions, suggestion{candidate.qualified, distance})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].distance < suggestions[j].distance })
+	names := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		names[i] = s.name
+	}
+	return names
+}
+
+// Levenshtein distance
+func editDistance(a, b string) int {
+	prev, curr := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v < first {
+			first = v
+		}
+	}
+	return first
+}
+
+func (t *Tracer) workflowFuncsInPackage(ctx context.Context, pkg string) ([]*workflowFunc, error) {
+	flags := t.goFlags()
+	if len(t.BuildTags) > 0 {
+		flags = append(flags, "-tags", strings.Join(t.BuildTags, ","))
+	}
+	return loadWorkflowFuncs(ctx, t.GoBinary, t.RootDir, flags, pkg)
+}
+
+// Packages are loaded with syntax for all dependencies but go/packages does not
+// type check them. Only signatures are needed, so function bodies are dropped
+// when parsing and the packages are type checked without them by
+// packageTypeChecker.
+const workflowFuncsLoadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedImports | packages.NeedDeps | packages.NeedSyntax
+
+// Type checked workflow functions in the packages matching the patterns sorted
+// by qualified name
+func loadWorkflowFuncs(
+	ctx context.Context,
+	goBinary string,
+	rootDir string,
+	buildFlags []string,
+	patterns ...string,
+) ([]*workflowFunc, error) {
+	fset := token.NewFileSet()
+	var pkgs []*packages.Package
+	err := withGoBinary(goBinary, func() (err error) {
+		pkgs, err = packages.Load(&packages.Config{
+			Mode:       workflowFuncsLoadMode,
+			Context:    ctx,
+			Dir:        rootDir,
+			BuildFlags: buildFlags,
+			Fset:       fset,
+			ParseFile:  parseFileSignatures,
+		}, patterns...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed loading package %v: %w", strings.Join(patterns, " "), err)
+	}
+	checker := &packageTypeChecker{fset: fset, checked: map[*packages.Package]*types.Package{}}
+	var fns []*workflowFunc
+	for _, pkg := range pkgs {
+		// Type errors are expected without function bodies (e.g. unused
+		// imports), and any real ones fail the build anyway
+		for _, pkgErr := range pkg.Errors {
+			if pkgErr.Kind != packages.TypeError {
+				return nil, fmt.Errorf("failed loading package %v: %v", pkg.PkgPath, pkgErr)
+			}
+		}
+		fns = append(fns, workflowFuncsInTypes(fset, checker.check(pkg))...)
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].qualified < fns[j].qualified })
+	return fns, nil
+}
+
+// Runs the function with the Go binary first on the PATH as "go" since
+// go/packages always runs "go" from the PATH
+func withGoBinary(goBinary string, fn func() error) error {
+	if goBinary == "" || goBinary == "go" {
+		return fn()
+	}
+	path, err := exec.LookPath(goBinary)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed finding Go binary %v: %w", goBinary, err)
+	}
+	binDir := filepath.Dir(path)
+	if ext := filepath.Ext(path); strings.TrimSuffix(filepath.Base(path), ext) != "go" {
+		// Link it as "go" in a temp dir
+		if binDir, err = os.MkdirTemp("", "temporal-debug-go-bin-"); err != nil {
+			return fmt.Errorf("failed creating temp dir: %w", err)
+		}
+		defer os.RemoveAll(binDir)
+		if err := os.Symlink(path, filepath.Join(binDir, "go"+ext)); err != nil {
+			return fmt.Errorf("failed linking Go binary: %w", err)
+		}
+	}
+	return withEnv([]string{"PATH=" + binDir + string(os.PathListSeparator) + os.Getenv("PATH")}, fn)
+}
+
+// Parses the file without function bodies
+func parseFileSignatures(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+	f, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if f != nil {
+		for _, decl := range f.Decls {
+			if funcDecl, ok := decl.(*ast.FuncDecl); ok {
+				funcDecl.Body = nil
+			}
+		}
+	}
+	return f, err
+}
+
+// Type checks loaded packages and their dependencies from syntax, each package
+// only once
+type packageTypeChecker struct {
+	fset    *token.FileSet
+	checked map[*packages.Package]*types.Package
+}
+
+func (p *packageTypeChecker) check(pkg *packages.Package) *types.Package {
+	if typesPkg, ok := p.checked[pkg]; ok {
+		return typesPkg
+	}
+	config := &types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if path == "unsafe" {
+				return types.Unsafe, nil
+			} else if imp := pkg.Imports[path]; imp != nil {
+				return p.check(imp), nil
+			}
+			return nil, fmt.Errorf("package %v not found", path)
+		}),
+		Sizes: types.SizesFor("gc", runtime.GOARCH),
+		// Errors are expected without bodies, see loadWorkflowFuncs
+		Error: func(error) {},
+	}
+	typesPkg, _ := config.Check(pkg.PkgPath, p.fset, pkg.Syntax, nil)
+	p.checked[pkg] = typesPkg
+	return typesPkg
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (i importerFunc) Import(path string) (*types.Package, error) { return i(path) }
+
+// Exported functions and methods in the package whose first param is
+// workflow.Context and last result is error, compared by type identity so
+// aliases and dot imports are followed and shadowed names are not matched
+func workflowFuncsInTypes(fset *token.FileSet, pkg *types.Package) []*workflowFunc {
+	workflowPkg := findImportedPackage(pkg, workflowPkg, map[*types.Package]bool{})
+	if workflowPkg == nil {
+		return nil
+	}
+	contextObj := workflowPkg.Scope().Lookup("Context")
+	if contextObj == nil {
+		return nil
+	}
+	errorType := types.Universe.Lookup("error").Type()
+	isWorkflowSig := func(sig *types.Signature) bool {
+		params, results := sig.Params(), sig.Results()
+		return params.Len() > 0 && results.Len() > 0 &&
+			types.Identical(params.At(0).Type(), contextObj.Type()) &&
+			types.Identical(results.At(results.Len()-1).Type(), errorType)
+	}
+	newFunc := func(obj types.Object) *workflowFunc {
+		pos := fset.Position(obj.Pos())
+		return &workflowFunc{pkg: pkg.Path(), name: obj.Name(), file: pos.Filename, line: pos.Line}
+	}
+
+	var fns []*workflowFunc
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		switch obj := scope.Lookup(name).(type) {
+		case *types.Func:
+			if obj.Exported() && isWorkflowSig(obj.Type().(*types.Signature)) {
+				fn := newFunc(obj)
+				fn.qualified = fn.configName()
+				fns = append(fns, fn)
+			}
+		case *types.TypeName:
+			named, ok := obj.Type().(*types.Named)
+			if !ok || !obj.Exported() || obj.IsAlias() {
+				continue
+			}
+			for i := 0; i < named.NumMethods(); i++ {
+				method := named.Method(i)
+				sig := method.Type().(*types.Signature)
+				if !method.Exported() || !isWorkflowSig(sig) {
+					continue
+				}
+				fn := newFunc(method)
+				fn.structName = obj.Name()
+				_, fn.pointerReceiver = sig.Recv().Type().(*types.Pointer)
+				fn.qualified = fn.configName()
+				fns = append(fns, fn)
+			}
+		}
+	}
+	return fns
+}
+
+// The package with the path among the package's transitive imports, or nil
+func findImportedPackage(pkg *types.Package, path string, seen map[*types.Package]bool) *types.Package {
+	for _, imp := range pkg.Imports() {
+		if imp.Path() == path {
+			return imp
+		} else if !seen[imp] {
+			seen[imp] = true
+			if found := findImportedPackage(imp, path, seen); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package tracer
+
+import (
+	"context"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkflowFuncsInTypes(t *testing.T) {
+	const workflowSource = `package workflow
+
+type Context interface{ Done() }
+`
+	const aliasSource = `package alias
+
+import "go.temporal.io/sdk/workflow"
+
+type Context = workflow.Context
+`
+	const source = `package foo
+
+import (
+	"context"
+
+	"example.com/alias"
+	. "go.temporal.io/sdk/workflow"
+)
+
+type Workflows struct{}
+type unexported struct{}
+
+func MyWorkflow(ctx Context) error { return nil }
+func MyWorkflowWithResult(ctx Context, in string) (string, error) { return "", nil }
+func (*Workflows) PointerWorkflow(ctx Context) error { return nil }
+func (Workflows) ValueWorkflow(ctx Context) error { return nil }
+func (*unexported) HiddenWorkflow(ctx Context) error { return nil }
+func unexportedWorkflow(ctx Context) error { return nil }
+func MyActivity(ctx context.Context) error { return nil }
+func NoError(ctx Context) {}
+func AliasWorkflow(ctx alias.Context) error { return nil }
+
+type notAlias Context
+
+func NotAliasWorkflow(ctx notAlias) error { return nil }
+`
+	const shadowSource = `package bar
+
+import "go.temporal.io/sdk/workflow"
+
+type error interface{}
+
+func ShadowedError(ctx workflow.Context) error { return nil }
+`
+	fset := token.NewFileSet()
+	pkgs := map[string]*types.Package{}
+	check := func(path, file, source string) *types.Package {
+		f, err := parser.ParseFile(fset, file, source, 0)
+		require.NoError(t, err)
+		config := &types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+			if pkg := pkgs[path]; pkg != nil {
+				return pkg, nil
+			}
+			return importer.Default().Import(path)
+		})}
+		pkg, err := config.Check(path, fset, []*ast.File{f}, nil)
+		require.NoError(t, err)
+		pkgs[path] = pkg
+		return pkg
+	}
+	check(workflowPkg, "workflow.go", workflowSource)
+	check("example.com/alias", "alias.go", aliasSource)
+
+	var names []string
+	fns := workflowFuncsInTypes(fset, check("example.com/foo", "foo.go", source))
+	for _, fn := range fns {
+		names = append(names, fn.qualified)
+	}
+	require.Equal(t, []string{
+		"example.com/foo.AliasWorkflow",
+		"example.com/foo.MyWorkflow",
+		"example.com/foo.MyWorkflowWithResult",
+		"example.com/foo.(*Workflows).PointerWorkflow",
+		"example.com/foo.(Workflows).ValueWorkflow",
+	}, names)
+	require.Equal(t, "foo.go", fns[1].file)
+	require.Equal(t, 13, fns[1].line)
+
+	// Shadowed error type does not match
+	require.Empty(t, workflowFuncsInTypes(fset, check("example.com/bar", "bar.go", shadowSource)))
+}
+
+func TestValidateWorkflowFuncs(t *testing.T) {
+	config := Config{
+		WorkflowFuncs: []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"},
+		HistoryFile:   "history.json",
+		RootDir:       "..",
+	}
+	tr, err := New(config)
+	require.NoError(t, err)
+	require.NoError(t, tr.validateWorkflowFuncs(context.Background()))
+
+	// Typo
+	config.WorkflowFuncs = []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflo"}
+	tr, err = New(config)
+	require.NoError(t, err)
+	require.EqualError(t, tr.validateWorkflowFuncs(context.Background()),
+		"no such exported workflow function MyWorkflo in package github.com/cretz/temporal-debug-go/examples/cancellation, "+
+			"did you mean github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow?")
+
+	// Nothing close
+	config.WorkflowFuncs = []string{"github.com/cretz/temporal-debug-go/examples/cancellation.(*Activities).Other"}
+	tr, err = New(config)
+	require.NoError(t, err)
+	require.EqualError(t, tr.validateWorkflowFuncs(context.Background()),
+		"no such exported workflow function (*Activities).Other in package github.com/cretz/temporal-debug-go/examples/cancellation, "+
+			"workflow functions in package: github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow")
+
+	// Missing package
+	config.WorkflowFuncs = []string{"github.com/cretz/temporal-debug-go/examples/missing.MyWorkflow"}
+	tr, err = New(config)
+	require.NoError(t, err)
+	require.Error(t, tr.validateWorkflowFuncs(context.Background()))
+}
+
+func TestListWorkflowFuncs(t *testing.T) {
+	names, err := ListWorkflowFuncs(context.Background(), WorkflowFuncsConfig{RootDir: ".."}, "github.com/cretz/temporal-debug-go/examples/cancellation")
+	require.NoError(t, err)
+	require.Equal(t, []string{"github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow"}, names)
+	names, err = ListWorkflowFuncs(context.Background(), WorkflowFuncsConfig{RootDir: ".."}, "github.com/cretz/temporal-debug-go/examples/zlibconverter")
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestSuggestWorkflowFuncs(t *testing.T) {
+	candidates := []*workflowFunc{
+		{qualified: "foo.OrderWorkflow", pkg: "foo", name: "OrderWorkflow"},
+		{qualified: "foo.(*Workflows).OrderWorkflow", pkg: "foo", structName: "Workflows", pointerReceiver: true, name: "OrderWorkflow"},
+		{qualified: "foo.ShippingWorkflow", pkg: "foo", name: "ShippingWorkflow"},
+	}
+	fn, err := parseWorkflowFunc("foo.OrderWorkfow")
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo.OrderWorkflow", "foo.(*Workflows).OrderWorkflow"}, suggestWorkflowFuncs(fn, candidates))
+	fn, err = parseWorkflowFunc("foo.Workflows.orderworkflow")
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo.(*Workflows).OrderWorkflow", "foo.OrderWorkflow"}, suggestWorkflowFuncs(fn, candidates))
+	fn, err = parseWorkflowFunc("foo.Unrelated")
+	require.NoError(t, err)
+	require.Empty(t, suggestWorkflowFuncs(fn, candidates))
+	require.Equal(t, 3, editDistance("kitten", "sitting"))
+}
+
+func TestFindWorkflowFuncs(t *testing.T) {
+	infos, err := FindWorkflowFuncs(context.Background(), WorkflowFuncsConfig{RootDir: ".."}, "./examples/...")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, "github.com/cretz/temporal-debug-go/examples/cancellation.MyWorkflow", infos[0].Name)
+	require.Equal(t, "workflow.go", filepath.Base(infos[0].File))
+	require.Equal(t, 12, infos[0].Line)
+}